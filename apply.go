@@ -0,0 +1,846 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockCheckPath returns the file an operation modifies in place, which must
+// not be held open by another application, or "" if there is none
+func lockCheckPath(op Operation) string {
+	switch op.Type {
+	case "mv", "rm":
+		return op.From
+	case "symlink", "hardlink", "import":
+		return op.To
+	}
+	return ""
+}
+
+// findLockedOps runs the preflight lock check and returns the indexes of
+// operations whose files are in use
+func findLockedOps(ops []Operation) map[int]bool {
+	locked := make(map[int]bool)
+	for i, op := range ops {
+		rel := lockCheckPath(op)
+		if rel == "" {
+			continue
+		}
+		if full, err := resolvePath(rel); err == nil && isLocked(full) {
+			locked[i] = true
+		}
+	}
+	return locked
+}
+
+// applyPhase is where the one plan allowed at a time is
+type applyPhase int
+
+const (
+	applyIdle applyPhase = iota
+	applyConfirming
+	applyExecuting
+	applyBatched // Between batches of /apply/batch
+	applyQueued  // Waiting for -apply-window to open
+)
+
+func (p applyPhase) String() string {
+	switch p {
+	case applyConfirming:
+		return "waiting for confirmation"
+	case applyExecuting:
+		return "executing"
+	case applyBatched:
+		return "running in batches"
+	case applyQueued:
+		return "queued for the apply window"
+	}
+	return "idle"
+}
+
+var (
+	applyMu    sync.Mutex
+	applyState applyPhase
+)
+
+// beginApply claims the apply state for a new plan, or returns the phase of
+// the plan already in flight
+func beginApply() (applyPhase, bool) {
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if applyState != applyIdle {
+		return applyState, false
+	}
+	applyState = applyConfirming
+	return applyState, true
+}
+
+func setApplyPhase(p applyPhase) {
+	applyMu.Lock()
+	applyState = p
+	applyMu.Unlock()
+}
+
+func currentApplyPhase() applyPhase {
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	return applyState
+}
+
+// confirmedPlan is a plan as it is executed, after the terminal or the web
+// UI approved it
+type confirmedPlan struct {
+	ops       []Operation
+	locked    map[int]bool // Indexes of operations on files in use
+	protected []Operation  // Left out to protect recently modified files
+	deletes   []Operation  // Left out for want of -allow-deletes
+	checksum  string
+}
+
+// preparedPlan is a posted plan as the server would execute it, with what
+// was left out of it
+type preparedPlan struct {
+	ops          []Operation
+	deletes      []Operation // Left out for want of -allow-deletes
+	protected    []Operation // Left out to protect recently modified files
+	neverTouched int         // Operations left out on never-touch paths
+}
+
+// preparePlan turns the operations of a posted plan into the ones the
+// server executes, in execution order. /apply and /validate share it so
+// the simulation sees what would run.
+func preparePlan(ops []Operation) preparedPlan {
+	var p preparedPlan
+	ops = orderOperations(importFromSource(ops))
+	ops, p.neverTouched = withoutNeverTouched(ops)
+	ops, p.deletes = withoutDeletes(ops)
+	p.ops, p.protected = withoutProtected(ops)
+	return p
+}
+
+// confirmPlan does what /apply does before executing: decode the plan, claim
+// the apply state, print the plan and wait for confirmation. batch is the
+// batch size for /apply/batch, 0 for all at once. It returns nil after
+// writing the response when the plan won't run; otherwise the caller holds
+// the apply state (in applyConfirming) and must release it.
+func confirmPlan(w http.ResponseWriter, r *http.Request, batch int) *confirmedPlan {
+	// Decode and checksum the plan as it arrives
+	plan, checksumHex, err := decodePlan(requestBody(w, r, maxPlanBytes))
+	if err != nil {
+		planError(w, err)
+		return nil
+	}
+
+	if !noTerminalConfirm && !assumeYes && !terminalConfirm {
+		http.Error(w, errNoTerminal, http.StatusServiceUnavailable)
+		return nil
+	}
+
+	// One plan at a time: a second one would interleave prompts on stdin
+	if phase, ok := beginApply(); !ok {
+		http.Error(w, "Another plan is "+phase.String(), http.StatusConflict)
+		return nil
+	}
+	confirmed := false
+	defer func() {
+		if !confirmed {
+			setApplyPhase(applyIdle)
+		}
+	}()
+
+	// A plan computed against an older catalog may no longer make sense
+	if seq := currentCatalogSeq(); plan.CatalogSeq != 0 && plan.CatalogSeq != seq {
+		http.Error(w, fmt.Sprintf("Catalog changed since the plan was computed (plan #%d, catalog #%d)", plan.CatalogSeq, seq), http.StatusConflict)
+		return nil
+	}
+
+	prepared := preparePlan(plan.Operations)
+	plan.Operations = prepared.ops
+	printSkippedNeverTouched(prepared.neverTouched)
+	printSkippedDeletes(prepared.deletes)
+	printProtected(prepared.protected)
+
+	// Preflight: operations on files held open elsewhere are deferred
+	locked := findLockedOps(plan.Operations)
+	summary := printPlan(plan.Operations, locked, checksumHex)
+	if batch > 0 {
+		fmt.Printf(tr("Runs in batches of %d operations, each one started through /apply/batch/next\n"), batch)
+		summary += fmt.Sprintf(", in batches of %d", batch)
+	}
+
+	// A plan that runs out of inodes halfway is worse than none
+	if err := checkInodes(plan.Operations); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v, plan not executed\n", err)
+		http.Error(w, "Plan refused: "+err.Error(), http.StatusInsufficientStorage)
+		return nil
+	}
+
+	if noTerminalConfirm {
+		// No one at the terminal, the web UI decides
+		confirmed = waitForWebConfirm(r, checksumHex, summary)
+	} else {
+		if assumeYes {
+			fmt.Println(tr("Confirmed by -assume-yes."))
+			confirmed = true
+		} else if confirmChecksum {
+			confirmed = checksumPrompt(bufio.NewReader(os.Stdin), checksumHex)
+		} else {
+			confirmed = confirmPrompt(bufio.NewReader(os.Stdin))
+		}
+
+		// Second confirmation from the web UI for shared servers
+		if confirmed && dualConfirm {
+			confirmed = waitForWebConfirm(r, checksumHex, summary)
+		}
+	}
+
+	if !confirmed {
+		fmt.Println(tr("Aborted."))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "aborted"})
+		return nil
+	}
+	return &confirmedPlan{ops: plan.Operations, locked: locked, protected: prepared.protected, deletes: prepared.deletes, checksum: checksumHex}
+}
+
+// rescanAfterApply updates the catalog after operations were executed and
+// reports whether the rescan worked
+func rescanAfterApply() bool {
+	fmt.Fprint(os.Stderr, tr("Rescanning directory...\n"))
+	rescan, err := scanDirectory(targetDir, useHashing)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not rescan: %v\n", err)
+		return false
+	}
+	setCatalog(rescan)
+	return true
+}
+
+// handleApply receives a plan and executes it after terminal confirmation
+func handleApply(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	plan := confirmPlan(w, r, 0)
+	if plan == nil {
+		return
+	}
+
+	// With -apply-window the plan runs in the background, in the window
+	if window != nil {
+		status := queuePlan(plan)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "queued", "queued": status})
+		return
+	}
+	defer setApplyPhase(applyIdle)
+
+	setApplyPhase(applyExecuting)
+	target := currentTarget()
+	snapshot, ok := target.snapshotBeforeApply()
+	if !ok {
+		http.Error(w, "Could not snapshot the target, plan not executed", http.StatusInternalServerError)
+		return
+	}
+
+	askCheckpoint = serverCheckpoint(r, plan.checksum)
+	errors, deferred, backups, undo := target.executePlan(plan.ops, plan.locked)
+	askCheckpoint = nil
+	if rescanAfterApply() && writeManifestOn {
+		writeManifestAfter(plan.ops, errors)
+	}
+	notifyLibraries(plan.ops)
+
+	w.Header().Set("Content-Type", "application/json")
+	result := map[string]interface{}{
+		"status":   "completed",
+		"errors":   errors,
+		"deferred": deferred,
+	}
+	if snapshot != "" {
+		result["snapshot"] = snapshot
+	}
+	if len(backups) > 0 {
+		result["backups"] = backups
+	}
+	if len(plan.protected) > 0 {
+		result["protected"] = plan.protected
+	}
+	if len(plan.deletes) > 0 {
+		result["skippedDeletes"] = plan.deletes
+	}
+	if len(undo.Operations) > 0 {
+		result["undo"] = undo
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// opLabels are the terminal labels and colors of executable operations
+var opLabels = map[string][2]string{
+	"mv":          {"MOVE", colorBlue},
+	"cp":          {"COPY", colorGreen},
+	"rm":          {"DELETE", colorRed},
+	"symlink":     {"SYMLINK", colorMagenta},
+	"hardlink":    {"HARDLINK", colorMagenta},
+	"placeholder": {"STUB", colorYellow},
+	"import":      {"IMPORT", colorGreen},
+}
+
+// topFolder returns the first component of a plan path, "." for top-level files
+func topFolder(p string) string {
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i]
+	}
+	return "."
+}
+
+// printPlan shows the plan in the terminal, grouped by top-level folder,
+// and returns a one-line summary. Paths are shell-quoted so odd names can't
+// garble the terminal and lines can be copy-pasted safely.
+func printPlan(ops []Operation, locked map[int]bool, checksumHex string) string {
+	fmt.Println("\n" + strings.Repeat("=", 60))
+	fmt.Println(colorize(colorBold, tr("PLAN TO EXECUTE")))
+	fmt.Println(strings.Repeat("=", 60))
+	printIntents(ops)
+	printLint(ops)
+
+	// Group printed lines by top folder, keeping plan order within a group
+	var folders []string
+	lines := make(map[string][]string)
+	counts := make(map[string]int)
+	rules := targetNamingRules()
+	for i, op := range ops {
+		label, ok := opLabels[op.Type]
+		if !ok {
+			// Missing and updated files need data from the source, nothing to print
+			counts[op.Type]++
+			continue
+		}
+
+		var line string
+		switch {
+		case locked[i]:
+			line = colorize(colorYellow, fmt.Sprintf("%-9s", "DEFERRED")) + " " + op.Type + " " + shellQuote(lockCheckPath(op)) + " (in use)"
+		case op.Type == "rm":
+			line = colorize(label[1], fmt.Sprintf("%-9s", label[0])) + " " + shellQuote(op.From)
+			counts[op.Type]++
+		case op.Type == "placeholder":
+			kind := "empty"
+			if op.Sparse {
+				kind = "sparse, " + formatSize(op.Size)
+			}
+			line = colorize(label[1], fmt.Sprintf("%-9s", label[0])) + " " + shellQuote(op.From) + " (" + kind + ")"
+			counts[op.Type]++
+		case op.Type == "import":
+			line = colorize(label[1], fmt.Sprintf("%-9s", label[0])) + " " + shellQuote(op.To) + " <- " + shellQuote(importLabel(op)) + " (" + formatSize(op.Size) + ")"
+			counts[op.Type]++
+		case op.Type == "symlink" || op.Type == "hardlink":
+			line = colorize(label[1], fmt.Sprintf("%-9s", label[0])) + " " + shellQuote(op.To) + " -> " + shellQuote(op.From)
+			counts["ln"]++
+		default:
+			line = colorize(label[1], fmt.Sprintf("%-9s", label[0])) + " " + shellQuote(op.From) + " -> " + shellQuote(op.To)
+			counts[op.Type]++
+		}
+		if op.Reason != "" && !locked[i] {
+			line += colorize(colorDim, "  # "+printable(op.Reason))
+		}
+		if needsReview(op) && !locked[i] {
+			line += colorize(colorYellow, fmt.Sprintf("  [confidence %.2f]", confidence(op)))
+			counts["review"]++
+		}
+		if kind, detail := nameProblem(destination(op), rules); kind != "" {
+			line += colorize(colorRed, "  ["+printable(detail)+"]")
+			counts[kind]++
+		}
+
+		folder := topFolder(opPath(op))
+		if _, seen := lines[folder]; !seen {
+			folders = append(folders, folder)
+		}
+		lines[folder] = append(lines[folder], line)
+	}
+
+	sort.Strings(folders)
+	for _, folder := range folders {
+		fmt.Printf("%s (%d)\n", colorize(colorBold, shellQuote(folder)+"/"), len(lines[folder]))
+		for _, line := range lines[folder] {
+			fmt.Println("  " + line)
+		}
+	}
+
+	fmt.Println(strings.Repeat("-", 60))
+	fmt.Printf(tr("Summary: %d moves, %d copies, %d deletes, %d links, %d missing\n"),
+		counts["mv"], counts["cp"], counts["rm"], counts["ln"], counts["missing"]+counts["update"])
+	printCategoryBreakdown(ops)
+	if counts["placeholder"] > 0 {
+		fmt.Printf(tr("Placeholders: %d missing files get stubs until their data is copied\n"), counts["placeholder"])
+	}
+	if counts["import"] > 0 {
+		fmt.Printf(tr("Imports: %d files are copied in from the source\n"), counts["import"])
+	}
+	if counts["review"] > 0 {
+		fmt.Println(colorize(colorYellow, fmt.Sprintf(tr("Low confidence: %d operations below -review-below %.2f, check them before confirming"), counts["review"], reviewBelow)))
+	}
+	if len(locked) > 0 {
+		fmt.Println(colorize(colorYellow, fmt.Sprintf(tr("Deferred: %d operations on files in use by other applications"), len(locked))))
+	}
+	if counts["illegal-name"] > 0 {
+		fmt.Println(colorize(colorRed, fmt.Sprintf(tr("Names: %d operations have paths the target's filesystem doesn't allow, they will fail"), counts["illegal-name"])))
+	}
+	if counts["path-too-long"] > 0 {
+		fmt.Println(colorize(colorYellow, fmt.Sprintf(tr("Long paths: %d destinations are longer than MAX_PATH"), counts["path-too-long"])))
+	}
+	if deleteOrder != "interleaved" && counts["rm"] > 0 {
+		fmt.Printf(tr("Deletes run %s\n"), deleteOrder)
+	}
+	if executionOrder != "plan" {
+		fmt.Printf(tr("Order: %s\n"), executionOrder)
+	}
+	if checkpointEvery > 0 && len(ops) > checkpointEvery {
+		fmt.Printf(tr("Checkpoints: pauses every %d operations to ask whether to go on\n"), checkpointEvery)
+	}
+	if b, ok := inodeBudget(ops); ok && b.Needed > 0 {
+		color := colorDim
+		if !b.fits() {
+			color = colorRed
+		}
+		fmt.Println(colorize(color, fmt.Sprintf(tr("Inodes: %d needed, %d free on the target's filesystem"), b.Needed, b.Free)))
+	}
+	printTimeEstimate(ops)
+	printTransferEstimate(ops)
+	// With -confirm-checksum it has to come from the browser
+	if !confirmChecksum {
+		fmt.Printf(tr("Checksum: %s\n"), checksumHex)
+	}
+	fmt.Println(strings.Repeat("-", 60))
+
+	return fmt.Sprintf("%d moves, %d copies, %d deletes, %d links", counts["mv"], counts["cp"], counts["rm"], counts["ln"])
+}
+
+// confirmPrompt asks whether to execute the plan
+func confirmPrompt(reader *bufio.Reader) bool {
+	fmt.Print(tr("Execute this plan? [y/N]: "))
+	response, _ := reader.ReadString('\n')
+	return isYes(response)
+}
+
+// confirmChecksum is -confirm-checksum: the terminal asks for the start of
+// the plan's checksum instead of y, so whoever confirms has to look at the
+// checksum the browser shows for the plan it sent
+var confirmChecksum bool
+
+// checksumPrefixLen is how much of the checksum -confirm-checksum asks for
+const checksumPrefixLen = 8
+
+// checksumPrompt asks for the first characters of the checksum and reports
+// whether they were typed right
+func checksumPrompt(reader *bufio.Reader, checksumHex string) bool {
+	fmt.Printf(tr("To execute this plan, type the first %d characters of its checksum: "), checksumPrefixLen)
+	response, _ := reader.ReadString('\n')
+	response = strings.ToLower(strings.TrimSpace(response))
+	if response == "" {
+		return false
+	}
+	if response != checksumHex[:checksumPrefixLen] {
+		fmt.Println(colorize(colorRed, tr("That is not the checksum of this plan.")))
+		return false
+	}
+	return true
+}
+
+// applyTarget is a directory a plan executes on, with what executing it
+// keeps track of. The execution path works on it instead of targetDir, so
+// apply and mimic can run a plan on several targets at the same time.
+type applyTarget struct {
+	dir       string
+	label     string // Starts its terminal lines while several targets run
+	backupRun string // Timestamp folder of its -backup-dir backups
+}
+
+// currentTarget is the target of the server, or of apply and mimic with a
+// single target directory
+func currentTarget() *applyTarget {
+	return &applyTarget{dir: targetDir}
+}
+
+// printf prints to the terminal like fmt.Printf, with the target's label
+// in front of each line
+func (t *applyTarget) printf(format string, args ...interface{}) {
+	t.fprintf(os.Stdout, format, args...)
+}
+
+// fprintf is printf to w. The text goes out in one write, so the lines of
+// targets running at the same time don't mix.
+func (t *applyTarget) fprintf(w io.Writer, format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	if t.label != "" {
+		lines := strings.SplitAfter(text, "\n")
+		for i, line := range lines {
+			if strings.TrimSpace(line) != "" {
+				lines[i] = t.label + line
+			}
+		}
+		text = strings.Join(lines, "")
+	}
+	fmt.Fprint(w, text)
+}
+
+// executePlan runs the operations, skipping the locked ones, and returns
+// the errors, the deferred operations, the backups of replaced files and the
+// plan that undoes what was done (see undoOperation)
+func (t *applyTarget) executePlan(ops []Operation, locked map[int]bool) ([]string, []Operation, []Backup, *UndoPlan) {
+	t.printf("\n%s\n", tr("Executing..."))
+	applyRuns.Add(1)
+	errors := []string{}
+	deferred := []Operation{}
+	var backups []Backup
+	t.backupRun = ""
+	samples := make(map[string]*opTiming)
+	undo := &UndoPlan{Version: planVersion, Operations: []Operation{}}
+	rules := namingRulesOf(t.dir)
+	var denied []deniedOp
+	denials, stopped := 0, false
+
+	fail := func(op Operation, err error) {
+		errMsg := fmt.Sprintf("%s %s: %v", op.Type, op.From, err)
+		t.fprintf(os.Stderr, "  %s %s %s: %v\n", colorize(colorRed, "ERROR:"), op.Type, shellQuote(op.From), err)
+		errors = append(errors, errMsg)
+		applyErrors.Add(1)
+	}
+	succeed := func(op Operation, replaced bool, backup string) {
+		applyOps.Add(1)
+		t.printf("  %s %s %s\n", colorize(colorGreen, "OK:"), op.Type, shellQuote(op.From))
+		inverse, complete := undoOperation(t.dir, op, replaced, backup)
+		undo.Operations = append(inverse, undo.Operations...)
+		if !complete {
+			undo.Incomplete = append(undo.Incomplete, op)
+		}
+	}
+
+	for i, op := range ops {
+		if executeWhile != nil && !executeWhile(i) {
+			break
+		}
+		if askCheckpoint != nil && checkpointEvery > 0 && i > 0 && i%checkpointEvery == 0 {
+			// A checkpoint: ask whether to go on, stop or take it all back
+			if action := askCheckpoint(i, len(ops)); action != "continue" {
+				stop := fmt.Sprintf("aborted at the checkpoint after %d of %d operations, the rest was not run", i, len(ops))
+				if action == "rollback" {
+					for _, err := range t.rollBack(undo) {
+						errors = append(errors, "roll back: "+err)
+					}
+					stop = fmt.Sprintf("rolled back at the checkpoint after %d of %d operations", i, len(ops))
+					undo = &UndoPlan{Version: planVersion, Operations: []Operation{}, Incomplete: undo.Incomplete}
+				}
+				t.printf("%s\n", colorize(colorYellow, stop))
+				errors = append(errors, stop)
+				stopped = true
+				break
+			}
+		}
+		if locked[i] {
+			deferred = append(deferred, op)
+			applyDeferred.Add(1)
+			continue
+		}
+		err := t.waitForSpace(op.To, t.spaceNeeded(op))
+		var backup string
+		_, statErr := os.Lstat(filepath.Join(t.dir, op.To))
+		replaced := op.To != "" && statErr == nil
+		start := time.Now()
+		if err != nil {
+			// Not enough space for it, not even after waiting
+		} else if kind, detail := nameProblem(destination(op), rules); kind == "illegal-name" {
+			// The filesystem's own error for it says little
+			err = fmt.Errorf("%s", detail)
+		} else if op.Type == "mv" || op.Type == "cp" || op.Type == "import" || op.Type == "symlink" || op.Type == "hardlink" {
+			// On a case-insensitive target this would overwrite another file
+			if twin := caseTwin(t.dir, op.To); twin != "" && twin != op.From {
+				err = fmt.Errorf("%s differs only in case from %s, which it would overwrite on this case-insensitive target", op.To, twin)
+			}
+		}
+		if err == nil && (op.Type == "mv" || op.Type == "cp") {
+			// Keep what the move or copy would overwrite, unless it fails anyway
+			if _, err = os.Stat(filepath.Join(t.dir, op.From)); err == nil {
+				backup, err = t.backupExisting(op.To)
+			}
+		}
+		switch {
+		case err != nil:
+			// Not executed: no space for it, the source is gone, the
+			// destination couldn't be backed up or is another file under a
+			// different case
+		case op.Type == "missing" || op.Type == "update":
+			// Nothing to do for missing or outdated files, data comes from the source
+			continue
+		default:
+			var imported string
+			imported, err = t.runOperation(op)
+			if err != nil && isAccessDenied(err) {
+				// Likely a scanner that opened the file just written
+				if denials++; denials == deniedHintAfter {
+					t.printf("%s\n", colorize(colorYellow, tr("Several operations were denied access, likely by an antivirus scanner (Windows Defender) or the Search indexer opening new files. They are retried with growing pauses; excluding the target from real-time scanning and indexing while the plan runs avoids this.")))
+				}
+				imported, err = t.retryDenied(op)
+				start = time.Time{} // The pauses would skew the timings
+			}
+			if imported != "" {
+				backup = imported
+			}
+		}
+		if backup != "" {
+			backups = append(backups, Backup{Path: op.To, Backup: backup})
+		}
+		switch {
+		case err != nil && isAccessDenied(err):
+			// Tried once more after the rest of the plan, then deferred
+			t.printf("  %s %s %s\n", colorize(colorYellow, "DENIED:"), op.Type, shellQuote(op.From))
+			denied = append(denied, deniedOp{op: op, replaced: replaced, backup: backup})
+		case err != nil:
+			fail(op, err)
+		default:
+			if !start.IsZero() {
+				t.recordSample(samples, op, time.Since(start))
+			}
+			succeed(op, replaced, backup)
+		}
+	}
+	if len(denied) > 0 && !stopped {
+		t.printf("%s\n", colorize(colorYellow, fmt.Sprintf(tr("Retrying %d operations that were denied access..."), len(denied))))
+		for _, d := range denied {
+			imported, err := t.retryDenied(d.op)
+			if imported != "" {
+				backups = append(backups, Backup{Path: d.op.To, Backup: imported})
+				d.backup = imported
+			}
+			switch {
+			case err != nil && isAccessDenied(err):
+				deferred = append(deferred, d.op)
+				applyDeferred.Add(1)
+			case err != nil:
+				fail(d.op, err)
+			default:
+				succeed(d.op, d.replaced, d.backup)
+			}
+		}
+	} else {
+		for _, d := range denied {
+			deferred = append(deferred, d.op)
+			applyDeferred.Add(1)
+		}
+	}
+	if len(samples) > 0 {
+		recordTimings(samples)
+	}
+
+	t.printf("\n%s\n", tr("Done!"))
+	return errors, deferred, backups, undo
+}
+
+// runOperation executes one operation and returns the backup of the file
+// an import replaced, if one was kept
+func (t *applyTarget) runOperation(op Operation) (string, error) {
+	switch op.Type {
+	case "mv":
+		return "", t.executeMove(op.From, op.To)
+	case "cp":
+		return "", t.executeCopy(op.From, op.To)
+	case "rm":
+		return "", t.executeDelete(op.From)
+	case "symlink", "hardlink":
+		return "", t.executeLink(op.From, op.To, op.Type == "hardlink")
+	case "placeholder":
+		return "", t.executePlaceholder(op)
+	case "import":
+		return t.executeImport(op)
+	}
+	return "", nil
+}
+
+// recordSample adds a successful operation's duration to this run's timings
+func (t *applyTarget) recordSample(samples map[string]*opTiming, op Operation, d time.Duration) {
+	kind := timingKind(op.Type)
+	s := samples[kind]
+	if s == nil {
+		s = &opTiming{}
+		samples[kind] = s
+	}
+	s.Count++
+	s.Seconds += d.Seconds()
+	if kind == "cp" {
+		if info, err := os.Stat(filepath.Join(t.dir, op.To)); err == nil {
+			s.Bytes += info.Size()
+		}
+	}
+}
+
+// writeManifestAfter writes the manifest for the rescanned catalog, unless
+// the plan had errors
+func writeManifestAfter(ops []Operation, errors []string) {
+	if len(errors) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: not writing %s, plan had errors\n", manifestName)
+	} else if err := writeManifest(ops); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not write %s: %v\n", manifestName, err)
+	}
+}
+
+func (t *applyTarget) executeMove(from, to string) error {
+	fromPath := filepath.Join(t.dir, from)
+	toPath := filepath.Join(t.dir, to)
+
+	// Ensure destination directory exists
+	toDir := filepath.Dir(toPath)
+	if err := os.MkdirAll(toDir, 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(fromPath, toPath)
+}
+
+// openRegular opens a file to copy from, refusing anything but a regular
+// file (or a symlink to one) before opening it: opening a FIFO or a device
+// named in a plan would block the apply
+func openRegular(path string) (*os.File, os.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		info, err = os.Stat(path)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	// It may have been swapped for something else in between
+	if opened, err := f.Stat(); err != nil || !os.SameFile(info, opened) {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s changed while it was opened", path)
+	}
+	return f, info, nil
+}
+
+func (t *applyTarget) executeCopy(from, to string) error {
+	fromPath := filepath.Join(t.dir, from)
+	toPath := filepath.Join(t.dir, to)
+
+	// Ensure destination directory exists
+	toDir := filepath.Dir(toPath)
+	if err := os.MkdirAll(toDir, 0755); err != nil {
+		return err
+	}
+
+	src, info, err := openRegular(fromPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// With -stage-dir, a file copied before is cloned from the cache
+	key := stageKey(from, info)
+	if entry := stagedPath(stagedCopies[key]); entry != "" {
+		_, err := cloneFromStage(entry, toPath)
+		return err
+	}
+
+	dst, err := os.Create(toPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	var in io.Reader = src
+	h := sha256.New()
+	if stageDir != "" {
+		in = io.TeeReader(src, h)
+	}
+	progress := t.newProgressReader(in, to, info.Size())
+	_, err = io.Copy(dst, progress)
+	progress.finish()
+	if err != nil {
+		return err
+	}
+
+	// Copy file mode
+	os.Chmod(toPath, info.Mode())
+
+	if stageDir != "" && info.Size() >= stageMinSize {
+		sum := hex.EncodeToString(h.Sum(nil))
+		stagedCopies[key] = sum
+		stageFile(sum, toPath)
+	}
+	return nil
+}
+
+func (t *applyTarget) executeDelete(path string) error {
+	fullPath := filepath.Join(t.dir, path)
+	return os.Remove(fullPath)
+}
+
+// executeLink replaces the duplicate at `to` (or creates it) with a link to
+// the canonical copy at `from`. The link is created next to the destination
+// and renamed over it, so a failure never leaves the duplicate missing.
+func (t *applyTarget) executeLink(from, to string, hard bool) error {
+	fromPath := filepath.Join(t.dir, from)
+	toPath := filepath.Join(t.dir, to)
+
+	srcInfo, err := os.Stat(fromPath)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(toPath); err == nil {
+		if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("%s is not a regular file", to)
+		}
+		if info.Mode().IsRegular() && info.Size() != srcInfo.Size() {
+			return fmt.Errorf("%s differs in size from %s", to, from)
+		}
+	}
+
+	// Ensure destination directory exists
+	toDir := filepath.Dir(toPath)
+	if err := os.MkdirAll(toDir, 0755); err != nil {
+		return err
+	}
+
+	tmpPath := toPath + ".dir-mimic-link"
+	os.Remove(tmpPath)
+	if hard {
+		err = os.Link(fromPath, tmpPath)
+	} else {
+		var rel string
+		rel, err = filepath.Rel(toDir, fromPath)
+		if err == nil {
+			err = os.Symlink(rel, tmpPath)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, toPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
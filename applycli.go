@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+// runApplyCommand implements `dir-mimic apply <plan.json|-> <dir>`: execute
+// a plan file, or one piped in on stdin, after terminal confirmation
+func runApplyCommand(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "Execute without asking for confirmation")
+	simulate := fs.Bool("simulate", false, "Run the plan against an in-memory model of the target and report ordering problems, without changing anything")
+	manifestFlag := fs.Bool("manifest", false, "Write a "+manifestName+" manifest of the target after a successful apply")
+	noDefaultIgnores := fs.Bool("no-default-ignores", false, "Disable built-in ignore patterns")
+	extraIgnores := fs.String("ignore", "", "Extra ignore patterns (comma-separated, matched against filename)")
+	sanitize := fs.Bool("sanitize-names", false, "Rename destinations the target's filesystem doesn't allow (e.g. \"a:b\" on exFAT) to names it does")
+	undoFile := fs.String("undo-file", "", "Write a plan that takes back what was done to this file")
+	fs.Var(&importHosts, "import-host", "Allow imports from URLs on this host (host or host:port, repeatable)")
+	sourceDirFlag := fs.String("source-dir", "", "Copy missing and updated files in from the source's files in this directory")
+	snapshot := fs.String("snapshot", "", "Snapshot the target before executing: btrfs, zfs or apfs")
+	backupDirFlag := fs.String("backup-dir", "", "Keep files that moves and copies would overwrite in this directory")
+	backupSuffixFlag := fs.String("backup-suffix", "", "Keep files that moves and copies would overwrite next to them with this suffix, e.g. .bak")
+	stageDirFlag := fs.String("stage-dir", "", "Cache copied and imported files here by SHA-256 and link repeated copies from it (on the target's filesystem)")
+	newer := fs.String("exclude-newer", "", "Never delete or overwrite files modified within this age, e.g. 7d or 12h")
+	reserve := fs.String("reserve", "", "Pause while a copy would leave less than this free on its filesystem, e.g. 10G")
+	fs.Var(&libraryServers, "library-scan", "Ask this media server to rescan the changed folders afterwards: plex, jellyfin or emby with url=, token= and root= options (repeatable)")
+	checkpoint := fs.Int("checkpoint-every", 0, "Pause after every N operations and ask whether to continue, abort or roll back")
+	order := fs.String("delete-order", deleteOrder, "When deletes run: interleaved (plan order), first or last")
+	execOrder := fs.String("order", executionOrder, "Order of operations: plan, small-first (renames and small copies first), large-first or by-folder (one folder at a time)")
+	jsonFlag := fs.Bool("json", false, "Print a summary as JSON on stdout, the terminal output going to stderr")
+	noColor := fs.Bool("no-color", false, "Don't use colors in terminal output (also disabled by NO_COLOR)")
+	langFlag := fs.String("lang", "", "Language of terminal messages and the web UI: en, de or fi (default from LANG)")
+	configFile := fs.String("config", "", "Config file with named profiles")
+	profile := fs.String("profile", "", "Take flags not given on the command line from this profile")
+	fs.Parse(args)
+	if *jsonFlag {
+		setupJSONOutput()
+	}
+	if err := setupProfile(fs, *configFile, *profile, true); err != nil {
+		cliFail("%v", err)
+	}
+	if err := setLang(*langFlag); err != nil {
+		cliFail("%v", err)
+	}
+	if *noColor {
+		useColor = false
+	}
+	if deleteOrder = *order; !containsString(deleteOrders, deleteOrder) {
+		cliFail("-delete-order must be interleaved, first or last")
+	}
+	if executionOrder = *execOrder; !containsString(executionOrders, executionOrder) {
+		cliFail("-order must be plan, small-first, large-first or by-folder")
+	}
+	if checkpointEvery = *checkpoint; checkpointEvery < 0 {
+		cliFail("-checkpoint-every must not be negative")
+	}
+	if checkpointEvery > 0 && *yes {
+		cliFail("-checkpoint-every needs someone to ask, it can't be combined with -yes")
+	}
+	if *newer != "" {
+		var err error
+		if excludeNewer, err = parseAge(*newer); err != nil {
+			cliFail("-exclude-newer: %v", err)
+		}
+	}
+	if *reserve != "" {
+		var err error
+		if diskReserve, err = parseSize(*reserve); err != nil {
+			cliFail("-reserve: %v", err)
+		}
+	}
+	snapshotKind = *snapshot
+	if !validSnapshotKind(snapshotKind) {
+		cliFail("-snapshot must be btrfs, zfs or apfs")
+	}
+
+	if fs.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: dir-mimic apply [-profile name] [-config file] [-yes] [-simulate] [-sanitize-names] [-manifest] [-no-color] [-lang code] [-snapshot fs] [-source-dir dir] [-import-host host]... [-undo-file file] [-delete-order order] [-order order] [-exclude-newer age] [-reserve size] [-checkpoint-every n] [-library-scan server]... [-backup-dir dir | -backup-suffix s] [-stage-dir dir] [-json] [-no-default-ignores] [-ignore patterns] <plan.json|-> <directory>...\n")
+		cliFail("a plan and at least one target directory are required")
+	}
+
+	ignorePatterns = buildIgnorePatterns(*noDefaultIgnores, *extraIgnores)
+
+	// Several directories get the same plan, e.g. a disk and its mirror
+	targets, err := resolveTargets(fs.Args()[1:])
+	if err != nil {
+		cliFail("%v", err)
+	}
+	if err := checkMultiTarget(targets, *stageDirFlag, *backupDirFlag, *undoFile); err != nil {
+		cliFail("%v", err)
+	}
+	targetDir = targets[0]
+	if err := setupBackups(*backupDirFlag, *backupSuffixFlag); err != nil {
+		cliFail("%v", err)
+	}
+	if err := setupStageDir(*stageDirFlag); err != nil {
+		cliFail("%v", err)
+	}
+	if err := setupSourceDir(*sourceDirFlag); err != nil {
+		cliFail("%v", err)
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			cliFail("%v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	// A gzipped plan (plan.json.gz) is taken as it is
+	buffered := bufio.NewReader(in)
+	in = buffered
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(buffered)
+		if err != nil {
+			cliFail("invalid plan: %v", err)
+		}
+		in = zr
+	}
+	plan, checksumHex, err := decodePlan(in)
+	if err != nil {
+		cliFail("invalid plan: %v", err)
+	}
+
+	plan.Operations = importFromSource(plan.Operations)
+	if *sanitize {
+		plan.Operations = sanitizeNames(plan.Operations)
+	}
+	plan.Operations = orderOperations(plan.Operations)
+	plan.Operations = skipNeverTouched(plan.Operations)
+	summary := newRunSummary(plan.Operations, checksumHex)
+	if *simulate {
+		failed := false
+		for _, dir := range targets {
+			scan, err := scanDirectory(dir, false)
+			if err != nil {
+				cliFail("scanning %s: %v", dir, err)
+			}
+			if len(targets) > 1 {
+				fmt.Println(colorize(colorBold, fmt.Sprintf(tr("Target: %s"), dir)))
+			}
+			result := simulatePlan(scan.Files, plan.Operations)
+			printSimulation(result, len(plan.Operations))
+			failed = failed || len(result.Issues) > 0
+		}
+		// Ordering problems are what stands between the plan and the target
+		if failed {
+			summary.exit(exitDifferences)
+		}
+		summary.exit(exitInSync)
+	}
+	runs, err := prepareTargets(targets, plan.Operations, nil)
+	if err != nil {
+		cliFail("%v", err)
+	}
+	if len(runs) == 1 {
+		printProtected(runs[0].protected)
+	}
+	// The lint checks the plan against what the target holds
+	catalog = runs[0].files
+	printPlan(runs[0].ops, runs[0].locked, checksumHex)
+	printTargets(runs)
+	if err := checkTargetInodes(runs); err != nil {
+		cliFail("%v", err)
+	}
+
+	if !*yes {
+		// stdin may be the plan itself, so ask on the terminal
+		tty, err := openTerminal()
+		if err != nil {
+			cliFail("no terminal to confirm on (%v), use -yes", err)
+		}
+		confirmed := confirmPrompt(bufio.NewReader(tty))
+		tty.Close()
+		if !confirmed {
+			fmt.Println(tr("Aborted."))
+			summary.exit(exitAborted)
+		}
+	}
+
+	if checkpointEvery > 0 {
+		askCheckpoint = func(done, total int) string {
+			tty, err := openTerminal()
+			if err != nil {
+				return "abort"
+			}
+			defer tty.Close()
+			return checkpointPrompt(bufio.NewReader(tty), done, total)
+		}
+	}
+	results := executeOnTargets(runs, func(run targetRun, errors []string) {
+		if *manifestFlag {
+			scan, err := scanDirectory(targetDir, false)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: could not rescan: %v\n", err)
+			} else {
+				catalog = scan.Files
+				writeManifestAfter(run.ops, errors)
+			}
+		}
+		notifyLibraries(run.ops)
+	})
+	code := summary.addResults(results)
+	if *undoFile != "" && results[0].undo != nil {
+		if err := writeUndoPlan(*undoFile, results[0].undo); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not write the undo plan: %v\n", err)
+			summary.Error = "could not write the undo plan: " + err.Error()
+			code = exitError
+		}
+	}
+	summary.exit(code)
+}
+
+// openTerminal opens the controlling terminal for reading
+func openTerminal() (*os.File, error) {
+	if runtime.GOOS == "windows" {
+		return os.Open("CONIN$")
+	}
+	return os.Open("/dev/tty")
+}
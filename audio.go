@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// audioHashing enables -audio-hash: music files get a sample hash of just
+// their audio data, so retagged copies still match
+var audioHashing bool
+
+var errNoAudio = errors.New("no audio stream found")
+
+// isAudio reports whether audioStream can find the audio in the file
+func isAudio(name string) bool {
+	switch strings.ToLower(strings.TrimPrefix(filepath.Ext(name), ".")) {
+	case "mp3", "flac":
+		return true
+	}
+	return false
+}
+
+// computeAudioHash is computeSampleHash over the audio stream only, leaving
+// out ID3, APE and FLAC metadata that tag editors rewrite
+func computeAudioHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	start, end, err := audioStream(f)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha1.New()
+	if end-start <= 2*65536 {
+		_, err = io.Copy(h, io.NewSectionReader(f, start, end-start))
+	} else {
+		// First and last 64KB of the audio, like the sample hash
+		_, err = io.Copy(h, io.NewSectionReader(f, start, 65536))
+		if err == nil {
+			_, err = io.Copy(h, io.NewSectionReader(f, end-65536, 65536))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// audioStream returns the byte range of the audio data in an MP3 or FLAC file
+func audioStream(f *os.File) (start, end int64, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	end = info.Size()
+
+	// ID3v2 at the start (MP3, sometimes FLAC): 10-byte header, syncsafe size
+	var header [10]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		return 0, 0, errNoAudio
+	}
+	if string(header[:3]) == "ID3" {
+		size := int64(header[6])<<21 | int64(header[7])<<14 | int64(header[8])<<7 | int64(header[9])
+		start = 10 + size
+		if header[5]&0x10 != 0 {
+			start += 10 // Footer
+		}
+	}
+
+	// FLAC: skip the metadata blocks (stream info, Vorbis comments, pictures)
+	var magic [4]byte
+	if _, err := f.ReadAt(magic[:], start); err != nil {
+		return 0, 0, errNoAudio
+	}
+	if string(magic[:]) == "fLaC" {
+		pos := start + 4
+		for {
+			var block [4]byte
+			if _, err := f.ReadAt(block[:], pos); err != nil {
+				return 0, 0, errNoAudio
+			}
+			pos += 4 + (int64(block[1])<<16 | int64(block[2])<<8 | int64(block[3]))
+			if block[0]&0x80 != 0 {
+				break // Last metadata block
+			}
+		}
+		if pos >= end {
+			return 0, 0, errNoAudio
+		}
+		return pos, end, nil
+	}
+
+	// MP3: ID3v1 and APEv2 tags at the end
+	var tail [128]byte
+	if end-start >= 128 {
+		if _, err := f.ReadAt(tail[:], end-128); err == nil && string(tail[:3]) == "TAG" {
+			end -= 128
+		}
+	}
+	var footer [32]byte
+	if end-start >= 32 {
+		if _, err := f.ReadAt(footer[:], end-32); err == nil && bytes.HasPrefix(footer[:], []byte("APETAGEX")) {
+			size := int64(binary.LittleEndian.Uint32(footer[12:]))
+			if binary.LittleEndian.Uint32(footer[20:])&(1<<31) != 0 {
+				size += 32 // Header
+			}
+			end -= size
+		}
+	}
+	if end <= start {
+		return 0, 0, errNoAudio
+	}
+	return start, end, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// role is the access level granted by an auth token
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	roleOperator
+)
+
+var (
+	viewerToken   string // -viewer-token: catalog and diffs only
+	operatorToken string // -operator-token: may also change the target
+)
+
+// cidrList is the repeatable -allow-cidr flag. Bare addresses are accepted
+// as single-host networks.
+type cidrList []*net.IPNet
+
+func (l *cidrList) String() string {
+	parts := make([]string, len(*l))
+	for i, n := range *l {
+		parts[i] = n.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *cidrList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return fmt.Errorf("invalid address %q", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			*l = append(*l, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+func (l cidrList) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	allowedNets    cidrList // -allow-cidr allowlist, empty = allow everyone
+	trustedProxies cidrList // -trusted-proxy: their X-Forwarded-For is believed
+)
+
+// clientIP returns the address of the client behind a request, nil if it
+// can't be parsed. A request from a -trusted-proxy comes from the last
+// X-Forwarded-For address that isn't one of the trusted proxies itself, or
+// from the proxy's host when it has no such header; anyone else could set
+// the header to anything.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if ip == nil || len(forwarded) == 0 || !trustedProxies.contains(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return nil // Mangled, so nobody knows who sent it
+		}
+		if ip = hop; !trustedProxies.contains(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// clientName is the client's address for logs, the connection's if it can't
+// be parsed
+func clientName(r *http.Request) string {
+	if ip := clientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// clientAllowed reports whether the request's client may use the server.
+// Loopback is always allowed so the local operator can't be locked out;
+// behind a proxy on the same host that means everyone, unless the proxy is
+// a -trusted-proxy.
+func clientAllowed(r *http.Request) bool {
+	if len(allowedNets) == 0 {
+		return true
+	}
+	ip := clientIP(r)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || allowedNets.contains(ip)
+}
+
+// allowlistMiddleware rejects requests from addresses outside -allow-cidr
+func allowlistMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !clientAllowed(r) {
+			fmt.Fprintf(os.Stderr, "Rejected request from %s: not in -allow-cidr\n", clientName(r))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenMatches compares tokens in constant time
+func tokenMatches(given, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(given), []byte(want)) == 1
+}
+
+// requestRole returns the role granted by the request's token, given as
+// "Authorization: Bearer <token>" or as ?token= (EventSource can't set headers)
+func requestRole(r *http.Request) role {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	switch {
+	case tokenMatches(token, operatorToken):
+		return roleOperator
+	case tokenMatches(token, viewerToken):
+		return roleViewer
+	}
+	return roleNone
+}
+
+// requireRole wraps a handler so it only runs for requests with at least the
+// given role. Viewer endpoints are open unless -viewer-token is set, operator
+// endpoints unless -operator-token is set.
+func requireRole(min role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			setCORSHeaders(w)
+			return
+		}
+
+		needed := min
+		if (min == roleViewer && viewerToken == "") || (min == roleOperator && operatorToken == "") {
+			needed = roleNone
+		}
+
+		got := requestRole(r)
+		if l := requestListener(r); l != nil {
+			// A -listen address may allow less, or need no token
+			if min > l.maxRole {
+				setCORSHeaders(w)
+				http.Error(w, "Read-only on this address", http.StatusForbidden)
+				return
+			}
+			if l.open {
+				got = l.maxRole
+			}
+		}
+		if got < needed {
+			setCORSHeaders(w)
+			if got == roleNone {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			} else {
+				http.Error(w, "Operator token required", http.StatusForbidden)
+			}
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// -backup-dir and -backup-suffix: files an operation would replace (the
+// destination of a move, copy or link) are kept instead of overwritten
+var (
+	backupDir    string // Backups go to backupDir/<apply time>/<path>
+	backupSuffix string // Or next to the file, e.g. photo.jpg.bak
+)
+
+// Backup records where a replaced file was kept
+type Backup struct {
+	Path   string `json:"path"`
+	Backup string `json:"backup"`
+}
+
+// setupBackups validates the backup flags. Suffix backups stay in the
+// target, so they are ignored like the manifest is.
+func setupBackups(dir, suffix string) error {
+	if dir != "" && suffix != "" {
+		return fmt.Errorf("use either -backup-dir or -backup-suffix, not both")
+	}
+	if dir != "" {
+		abs, err := checkOutsideTarget("-backup-dir", dir)
+		if err != nil {
+			return err
+		}
+		backupDir = abs
+	}
+	if suffix != "" {
+		backupSuffix = suffix
+		ignorePatterns = append(ignorePatterns, "*"+suffix)
+	}
+	return nil
+}
+
+// backupExisting moves the file at rel out of the way before an operation
+// replaces it. It returns where the file went, or "" if there was nothing
+// to keep or backups are off.
+func (t *applyTarget) backupExisting(rel string) (string, error) {
+	if backupDir == "" && backupSuffix == "" {
+		return "", nil
+	}
+	full := filepath.Join(t.dir, rel)
+	info, err := os.Lstat(full)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", nil // The operation fails on its own
+	}
+
+	var dest string
+	if backupDir != "" {
+		if t.backupRun == "" {
+			t.backupRun = time.Now().Format("20060102-150405")
+		}
+		dest = filepath.Join(backupDir, t.backupRun, rel)
+	} else {
+		dest = full + backupSuffix
+	}
+	dest = unusedPath(dest)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(full, dest); err != nil {
+		// The backup directory may be on another filesystem
+		if backupDir == "" || !info.Mode().IsRegular() {
+			return "", err
+		}
+		if err := copyFileTo(full, dest, info.Mode()); err != nil {
+			os.Remove(dest)
+			return "", err
+		}
+		if err := os.Remove(full); err != nil {
+			return "", err
+		}
+	}
+	t.printf("  %s %s -> %s\n", colorize(colorYellow, "BACKUP:"), shellQuote(rel), shellQuote(dest))
+	return dest, nil
+}
+
+// unusedPath returns p, or p with a counter before its suffix (a.jpg.1.bak)
+// if p is taken
+func unusedPath(p string) string {
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		return p
+	}
+	base, ext := p, filepath.Ext(p)
+	if backupSuffix != "" {
+		base, ext = p[:len(p)-len(backupSuffix)], backupSuffix
+	}
+	for i := 1; ; i++ {
+		candidate := base + "." + strconv.Itoa(i) + ext
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// copyFileTo copies a file's contents and mode to a new path
+func copyFileTo(from, to string, mode os.FileMode) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
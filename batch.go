@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// defaultBatchSize is the batch size when /apply/batch gets no ?size=
+const defaultBatchSize = 100
+
+// batchRun is the plan /apply/batch confirmed and runs a batch at a time.
+// While it is set the apply state is applyBatched, so no other plan runs
+// until it is done or stopped.
+var batchRun struct {
+	sync.Mutex
+	plan     *confirmedPlan
+	next     int // Index of the first operation not run yet
+	errors   []string
+	undo     *UndoPlan // Takes back all batches run so far
+	snapshot string
+}
+
+// BatchStatus describes the batched plan in /apply/batch responses
+type BatchStatus struct {
+	Checksum string `json:"checksum"`
+	Done     int    `json:"done"`  // Operations run, including failed and deferred ones
+	Total    int    `json:"total"` // Operations in the plan
+	Errors   int    `json:"errors"`
+}
+
+// batchStatus returns how far the batched plan is; the caller holds the
+// lock
+func batchStatus() BatchStatus {
+	return BatchStatus{
+		Checksum: batchRun.plan.checksum,
+		Done:     batchRun.next,
+		Total:    len(batchRun.plan.ops),
+		Errors:   len(batchRun.errors),
+	}
+}
+
+// batchSize reads ?size=, the number of operations to run next
+func batchSize(r *http.Request) (int, bool) {
+	raw := r.URL.Query().Get("size")
+	if raw == "" {
+		return defaultBatchSize, true
+	}
+	n, err := strconv.Atoi(raw)
+	return n, err == nil && n > 0
+}
+
+// handleApplyBatch takes a plan like /apply (POST, ?size=N), has it
+// confirmed as a whole and runs its first N operations; /apply/batch/next
+// runs the following ones. GET returns how far the plan is, DELETE drops
+// the operations not run yet.
+func handleApplyBatch(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		batchRun.Lock()
+		defer batchRun.Unlock()
+		if batchRun.plan == nil {
+			http.Error(w, "No plan is running in batches", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(batchStatus())
+	case http.MethodPost:
+		size, ok := batchSize(r)
+		if !ok {
+			http.Error(w, "size must be a positive number", http.StatusBadRequest)
+			return
+		}
+		if outsideWindow() {
+			http.Error(w, "Outside the apply window "+window.String(), http.StatusConflict)
+			return
+		}
+		plan := confirmPlan(w, r, size)
+		if plan == nil {
+			return
+		}
+		batchRun.Lock()
+		defer batchRun.Unlock()
+		batchRun.plan, batchRun.next, batchRun.errors = plan, 0, []string{}
+		batchRun.undo = &UndoPlan{Version: planVersion, Operations: []Operation{}}
+
+		setApplyPhase(applyExecuting)
+		snapshot, ok := currentTarget().snapshotBeforeApply()
+		if !ok {
+			batchRun.plan = nil
+			setApplyPhase(applyIdle)
+			http.Error(w, "Could not snapshot the target, plan not executed", http.StatusInternalServerError)
+			return
+		}
+		batchRun.snapshot = snapshot
+		runBatch(w, r, size)
+	case http.MethodDelete:
+		batchRun.Lock()
+		defer batchRun.Unlock()
+		if batchRun.plan == nil {
+			http.Error(w, "No plan is running in batches", http.StatusNotFound)
+			return
+		}
+		status := batchStatus()
+		fmt.Printf(tr("Stopped after %d of %d operations, the rest will not run\n"), status.Done, status.Total)
+		batchRun.plan = nil
+		setApplyPhase(applyIdle)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "stopped",
+			"batch":  status,
+			"undo":   batchRun.undo,
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleApplyBatchNext runs the next ?size= operations of the batched plan
+func handleApplyBatchNext(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	size, ok := batchSize(r)
+	if !ok {
+		http.Error(w, "size must be a positive number", http.StatusBadRequest)
+		return
+	}
+	if outsideWindow() {
+		http.Error(w, "Outside the apply window "+window.String(), http.StatusConflict)
+		return
+	}
+
+	batchRun.Lock()
+	defer batchRun.Unlock()
+	if batchRun.plan == nil {
+		http.Error(w, "No plan is running in batches", http.StatusNotFound)
+		return
+	}
+	// Whoever continues should be looking at the same plan
+	if sum := r.URL.Query().Get("checksum"); sum != "" && sum != batchRun.plan.checksum {
+		http.Error(w, "The plan running in batches is "+batchRun.plan.checksum+", not "+sum, http.StatusConflict)
+		return
+	}
+	setApplyPhase(applyExecuting)
+	runBatch(w, r, size)
+}
+
+// runBatch executes the next size operations of the batched plan, rescans
+// and writes the outcome. After the last batch the apply state is released,
+// otherwise it goes back to applyBatched. The caller holds batchRun's lock.
+func runBatch(w http.ResponseWriter, r *http.Request, size int) {
+	plan := batchRun.plan
+	from := batchRun.next
+	to := min(from+size, len(plan.ops))
+	fmt.Printf(tr("Batch: operations %d-%d of %d\n"), from+1, to, len(plan.ops))
+
+	// Files may have been closed, or opened, since the plan was confirmed
+	ops := plan.ops[from:to]
+	askCheckpoint = serverCheckpoint(r, plan.checksum)
+	errors, deferred, backups, undo := currentTarget().executePlan(ops, findLockedOps(ops))
+	askCheckpoint = nil
+	batchRun.next = to
+	batchRun.errors = append(batchRun.errors, errors...)
+	batchRun.undo.Operations = append(undo.Operations, batchRun.undo.Operations...)
+	batchRun.undo.Incomplete = append(batchRun.undo.Incomplete, undo.Incomplete...)
+
+	rescanned := rescanAfterApply()
+	notifyLibraries(ops)
+	status := batchStatus()
+	result := map[string]interface{}{
+		"status":   "paused",
+		"batch":    status,
+		"errors":   errors,
+		"deferred": deferred,
+	}
+	if to == len(plan.ops) {
+		result["status"] = "completed"
+		if rescanned && writeManifestOn {
+			writeManifestAfter(plan.ops, batchRun.errors)
+		}
+		if len(plan.protected) > 0 {
+			result["protected"] = plan.protected
+		}
+		if len(plan.deletes) > 0 {
+			result["skippedDeletes"] = plan.deletes
+		}
+		batchRun.plan = nil
+		setApplyPhase(applyIdle)
+	} else {
+		fmt.Printf(tr("Paused after %d of %d operations, waiting for the next batch\n"), status.Done, status.Total)
+		setApplyPhase(applyBatched)
+	}
+	if from == 0 && batchRun.snapshot != "" {
+		result["snapshot"] = batchRun.snapshot
+	}
+	if len(backups) > 0 {
+		result["backups"] = backups
+	}
+	if len(batchRun.undo.Operations) > 0 {
+		result["undo"] = batchRun.undo
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// On a case-insensitive target (macOS and Windows defaults, exFAT, SMB
+// shares) Foo.jpg and foo.jpg are one file, so putting one where the other
+// is overwrites it. Plans come from a source that may well be case-sensitive.
+var caseProbe struct {
+	sync.Mutex
+	insensitive map[string]bool // Per target directory
+}
+
+// targetCaseInsensitive reports whether the target dir folds case. It looks
+// up an entry of the target under another case, without writing anything,
+// and is remembered per target directory.
+func targetCaseInsensitive(dir string) bool {
+	caseProbe.Lock()
+	defer caseProbe.Unlock()
+	if insensitive, ok := caseProbe.insensitive[dir]; ok {
+		return insensitive
+	}
+	if caseProbe.insensitive == nil {
+		caseProbe.insensitive = make(map[string]bool)
+	}
+	insensitive := false
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		name := e.Name()
+		swapped := strings.ToUpper(name)
+		if swapped == name {
+			swapped = strings.ToLower(name)
+		}
+		if swapped == name {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		other, err := os.Lstat(filepath.Join(dir, swapped))
+		insensitive = err == nil && os.SameFile(info, other)
+		break
+	}
+	caseProbe.insensitive[dir] = insensitive
+	return insensitive
+}
+
+// caseTwin returns the file that a case-insensitive target would take rel
+// for: one in the same folder whose name differs from rel's only in case.
+// It is "" when there is none, or the target tells case apart.
+func caseTwin(target, rel string) string {
+	if !targetCaseInsensitive(target) {
+		return ""
+	}
+	dir, name := filepath.Split(filepath.FromSlash(rel))
+	entries, err := os.ReadDir(filepath.Join(target, dir))
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		if e.Name() != name && strings.EqualFold(e.Name(), name) {
+			return filepath.ToSlash(filepath.Join(dir, e.Name()))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// catalogHistoryLimit is how many catalog updates /catalog/changes can
+// replay; clients further behind must refetch the full catalog
+const catalogHistoryLimit = 64
+
+// catalogChange is the difference between two consecutive catalogs
+type catalogChange struct {
+	seq      int64
+	added    map[string]FileEntry
+	modified map[string]FileEntry
+	removed  map[string]bool
+}
+
+var (
+	catalogMu      sync.RWMutex
+	catalogSeq     int64
+	catalogHistory []catalogChange
+	catalogScanned time.Time       // When the current catalog's scan finished
+	catalogPaths   map[string]bool // The catalog's paths, separated by /
+)
+
+// setCatalog installs a fresh scan result as the server catalog, bumps the
+// sequence number, records what changed and notifies connected browsers
+func setCatalog(scan *ScanResult) {
+	catalogMu.Lock()
+	old := catalog
+	catalog, specialFiles, inaccessible, scanWarnings = scan.Files, scan.Special, scan.Inaccessible, scan.Warnings
+	catalogPaths = make(map[string]bool, len(catalog))
+	for _, e := range catalog {
+		catalogPaths[filepath.ToSlash(e.Path)] = true
+	}
+	mountPoints = scan.Mounts
+	catalogSeq++
+	catalogScanned = time.Now()
+	change := diffCatalogs(old, catalog)
+	change.seq = catalogSeq
+	catalogHistory = append(catalogHistory, change)
+	if len(catalogHistory) > catalogHistoryLimit {
+		catalogHistory = catalogHistory[len(catalogHistory)-catalogHistoryLimit:]
+	}
+	seq := catalogSeq
+	catalogMu.Unlock()
+
+	if seq > 1 {
+		events.publish(Event{Type: "catalog-changed", Data: map[string]interface{}{
+			"seq":      seq,
+			"added":    len(change.added),
+			"modified": len(change.modified),
+			"removed":  len(change.removed),
+		}})
+	}
+}
+
+// diffCatalogs compares two catalogs by path
+func diffCatalogs(old, cur []FileEntry) catalogChange {
+	change := catalogChange{
+		added:    make(map[string]FileEntry),
+		modified: make(map[string]FileEntry),
+		removed:  make(map[string]bool),
+	}
+	before := make(map[string]FileEntry, len(old))
+	for _, e := range old {
+		before[e.Path] = e
+	}
+	for _, e := range cur {
+		prev, ok := before[e.Path]
+		switch {
+		case !ok:
+			change.added[e.Path] = e
+		case prev != e:
+			change.modified[e.Path] = e
+		}
+		delete(before, e.Path)
+	}
+	for path := range before {
+		change.removed[path] = true
+	}
+	return change
+}
+
+// CatalogChanges is the net change since a given sequence number. Reset
+// means the history no longer reaches back that far: refetch /catalog.
+type CatalogChanges struct {
+	Seq            int64           `json:"seq"`
+	Reset          bool            `json:"reset,omitempty"`
+	Added          []FileEntry     `json:"added"`
+	Modified       []FileEntry     `json:"modified"`
+	Removed        []string        `json:"removed"`
+	FileCount      int             `json:"fileCount"`
+	FolderCount    int             `json:"folderCount"`
+	TotalSize      int64           `json:"totalSize"`
+	DiskSize       int64           `json:"diskSize"`
+	HardlinkGroups []HardlinkGroup `json:"hardlinkGroups,omitempty"`
+	SpecialFiles   []SpecialFile   `json:"specialFiles,omitempty"`
+	Inaccessible   []ScanError     `json:"inaccessible,omitempty"`
+	Warnings       []ScanWarning   `json:"warnings,omitempty"`
+	Mounts         []string        `json:"mounts,omitempty"`
+}
+
+// catalogChangesSince merges the recorded changes after seq into one net
+// change per path. Must be called with catalogMu held.
+func catalogChangesSince(since int64) *CatalogChanges {
+	resp := &CatalogChanges{Seq: catalogSeq, Added: []FileEntry{}, Modified: []FileEntry{}, Removed: []string{}}
+	if since >= catalogSeq {
+		return resp
+	}
+	if since < 1 || len(catalogHistory) == 0 || catalogHistory[0].seq > since+1 {
+		resp.Reset = true
+		return resp
+	}
+
+	// existed: whether the path was in the catalog at `since`
+	existed := make(map[string]bool)
+	final := make(map[string]*FileEntry)
+	for _, c := range catalogHistory {
+		if c.seq <= since {
+			continue
+		}
+		for path, e := range c.added {
+			if _, seen := final[path]; !seen {
+				existed[path] = false
+			}
+			e := e
+			final[path] = &e
+		}
+		for path, e := range c.modified {
+			if _, seen := final[path]; !seen {
+				existed[path] = true
+			}
+			e := e
+			final[path] = &e
+		}
+		for path := range c.removed {
+			if _, seen := final[path]; !seen {
+				existed[path] = true
+			}
+			final[path] = nil
+		}
+	}
+
+	for path, e := range final {
+		switch {
+		case e == nil && existed[path]:
+			resp.Removed = append(resp.Removed, path)
+		case e != nil && existed[path]:
+			resp.Modified = append(resp.Modified, *e)
+		case e != nil:
+			resp.Added = append(resp.Added, *e)
+		}
+	}
+	sort.Slice(resp.Added, func(i, j int) bool { return resp.Added[i].Path < resp.Added[j].Path })
+	sort.Slice(resp.Modified, func(i, j int) bool { return resp.Modified[i].Path < resp.Modified[j].Path })
+	sort.Strings(resp.Removed)
+	return resp
+}
+
+// catalogStats counts the folders and bytes in a catalog
+func catalogStats(entries []FileEntry) (folderCount int, totalSize int64) {
+	folders := make(map[string]bool)
+	for _, entry := range entries {
+		totalSize += entry.Size
+		// Count the file's folder and all its parents
+		for dir := filepath.Dir(entry.Path); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+			folders[dir] = true
+		}
+	}
+	return len(folders), totalSize
+}
+
+// HardlinkGroup is a file with several names in the catalog: one copy on
+// disk, so moving or deleting one name frees no space
+type HardlinkGroup struct {
+	Size  int64    `json:"size"`
+	Paths []string `json:"paths"`
+}
+
+// hardlinkGroups finds catalog entries sharing a device and inode
+func hardlinkGroups(entries []FileEntry) []HardlinkGroup {
+	type fileKey struct{ dev, ino uint64 }
+	byKey := make(map[fileKey]*HardlinkGroup)
+	var keys []fileKey
+	for _, e := range entries {
+		if e.Ino == 0 {
+			continue
+		}
+		k := fileKey{e.Dev, e.Ino}
+		g, ok := byKey[k]
+		if !ok {
+			g = &HardlinkGroup{Size: e.Size}
+			byKey[k] = g
+			keys = append(keys, k)
+		}
+		g.Paths = append(g.Paths, e.Path)
+	}
+
+	var groups []HardlinkGroup
+	for _, k := range keys {
+		// Other names may be outside the catalog (ignored, filtered, elsewhere)
+		if g := byKey[k]; len(g.Paths) > 1 {
+			groups = append(groups, *g)
+		}
+	}
+	return groups
+}
+
+// diskSize subtracts the extra names of hardlinked files from a total size
+func diskSize(totalSize int64, groups []HardlinkGroup) int64 {
+	for _, g := range groups {
+		totalSize -= g.Size * int64(len(g.Paths)-1)
+	}
+	return totalSize
+}
+
+// handleCatalogChanges returns what changed in the catalog since ?since=N
+func handleCatalogChanges(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		http.Error(w, "since must be a catalog sequence number", http.StatusBadRequest)
+		return
+	}
+
+	catalogMu.RLock()
+	resp := catalogChangesSince(since)
+	resp.FileCount = len(catalog)
+	resp.FolderCount, resp.TotalSize = catalogStats(catalog)
+	resp.HardlinkGroups = hardlinkGroups(catalog)
+	resp.DiskSize = diskSize(resp.TotalSize, resp.HardlinkGroups)
+	resp.SpecialFiles, resp.Inaccessible, resp.Warnings = specialFiles, inaccessible, scanWarnings
+	resp.Mounts = mountPoints
+	catalogMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleRescan rescans the target on request, e.g. after files were changed
+// outside dir-mimic. Connected browsers learn about it via catalog-changed.
+func handleRescan(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// A plan being executed rescans when it's done
+	if phase := currentApplyPhase(); phase == applyExecuting {
+		http.Error(w, "A plan is "+phase.String(), http.StatusConflict)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Rescanning directory...\n")
+	scan, err := scanDirectory(targetDir, useHashing)
+	if err != nil {
+		http.Error(w, "Rescan failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setCatalog(scan)
+
+	catalogMu.RLock()
+	resp := map[string]interface{}{"seq": catalogSeq, "fileCount": len(catalog)}
+	catalogMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// currentCatalogSeq returns the catalog sequence number
+func currentCatalogSeq() int64 {
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	return catalogSeq
+}
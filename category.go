@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// categories are what the plan summary breaks bytes down by, so a plan about
+// to delete 200GB of video rather than some sidecar files stands out. The
+// web UI has the same lists.
+var categories = []string{"video", "audio", "images", "other"}
+
+var categoryExts = map[string]string{}
+
+func init() {
+	for category, exts := range map[string]string{
+		"video":  "mp4 mkv avi mov wmv m4v mpg mpeg webm flv ts m2ts mts 3gp vob",
+		"audio":  "mp3 flac wav aac m4a ogg opus wma aiff aif ape",
+		"images": "jpg jpeg png gif bmp tif tiff webp heic heif dng nef cr2 cr3 arw orf rw2 pef raf svg",
+	} {
+		for _, ext := range strings.Fields(exts) {
+			categoryExts[ext] = category
+		}
+	}
+}
+
+// fileCategory returns the category of a file by its extension
+func fileCategory(name string) string {
+	if c, ok := categoryExts[strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))]; ok {
+		return c
+	}
+	return "other"
+}
+
+// categoryBytes sums the bytes moved, copied and deleted per category. Sizes
+// not in the plan are taken from the files, which the plan hasn't touched
+// yet.
+func categoryBytes(ops []Operation) map[string]map[string]int64 {
+	bytes := make(map[string]map[string]int64)
+	for _, op := range ops {
+		if op.Type != "mv" && op.Type != "cp" && op.Type != "rm" {
+			continue
+		}
+		size := op.Size
+		if size == 0 {
+			if info, err := os.Lstat(filepath.Join(targetDir, op.From)); err == nil && info.Mode().IsRegular() {
+				size = info.Size()
+			}
+		}
+		if size == 0 {
+			continue
+		}
+		c := fileCategory(op.From)
+		if bytes[c] == nil {
+			bytes[c] = make(map[string]int64)
+		}
+		bytes[c][op.Type] += size
+	}
+	return bytes
+}
+
+// printCategoryBreakdown shows categoryBytes as a table, leaving out
+// categories the plan doesn't touch
+func printCategoryBreakdown(ops []Operation) {
+	bytes := categoryBytes(ops)
+	if len(bytes) == 0 {
+		return
+	}
+	cell := func(n int64) string {
+		if n == 0 {
+			return "-"
+		}
+		return formatSize(n)
+	}
+	fmt.Printf("  %-8s %12s %12s %12s\n", "", tr("moved"), tr("copied"), tr("deleted"))
+	for _, c := range categories {
+		if b := bytes[c]; b != nil {
+			fmt.Printf("  %-8s %12s %12s %12s\n", tr(c), cell(b["mv"]), cell(b["cp"]), cell(b["rm"]))
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// checkpointEvery is -checkpoint-every: executePlan pauses after every N
+// operations and asks whether to go on, 0 never pauses
+var checkpointEvery int
+
+// askCheckpoint asks whoever confirmed the running plan what to do at a
+// checkpoint: "continue", "abort" or "rollback". It is set for the plan
+// being executed; nil runs the plan through without pausing.
+var askCheckpoint func(done, total int) string
+
+// checkpointPrompt asks at a checkpoint on the terminal. Anything but an
+// answer to go on or roll back aborts.
+func checkpointPrompt(reader *bufio.Reader, done, total int) string {
+	fmt.Printf(tr("Checkpoint: %d of %d operations done. Continue, abort, or roll back what was done? [c/A/r]: "), done, total)
+	response, _ := reader.ReadString('\n')
+	switch answer := strings.ToLower(strings.TrimSpace(response)); {
+	case answer == "c" || isYes(answer):
+		return "continue"
+	case answer == "r":
+		return "rollback"
+	}
+	return "abort"
+}
+
+// serverCheckpoint asks at checkpoints of a plan applied through the server,
+// where the plan was confirmed: in the web UI with -no-terminal-confirm,
+// otherwise on the terminal
+func serverCheckpoint(r *http.Request, checksum string) func(done, total int) string {
+	if checkpointEvery == 0 {
+		return nil
+	}
+	return func(done, total int) string {
+		if noTerminalConfirm {
+			summary := fmt.Sprintf("Checkpoint: %d of %d operations done", done, total)
+			return waitForWebDecision(r, &pendingConfirm{Checksum: checksum, Summary: summary, Checkpoint: true})
+		}
+		return checkpointPrompt(bufio.NewReader(os.Stdin), done, total)
+	}
+}
+
+// rollBack executes the undo plan of what a plan did before it was stopped
+// at a checkpoint, and returns its errors
+func (t *applyTarget) rollBack(undo *UndoPlan) []string {
+	t.printf("%s\n", colorize(colorYellow, fmt.Sprintf(tr("Rolling back %d operations..."), len(undo.Operations))))
+	ask := askCheckpoint
+	askCheckpoint = nil
+	defer func() { askCheckpoint = ask }()
+	errors, _, _, _ := t.executePlan(undo.Operations, nil)
+	return errors
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Exit codes of apply, mimic, verify and verify-content, for wrapper scripts
+// and monitoring to act on
+const (
+	exitInSync      = 0 // Nothing differs, or the plan ran without errors
+	exitDifferences = 1 // Differences found, or left over after the plan
+	exitError       = 2 // Invalid usage or input, or operations that failed
+	exitAborted     = 3 // The plan wasn't confirmed
+)
+
+// exitStatuses names the exit codes in the -json summary
+var exitStatuses = map[int]string{
+	exitInSync:      "in-sync",
+	exitDifferences: "differences",
+	exitError:       "error",
+	exitAborted:     "aborted",
+}
+
+// RunSummary is printed to stdout by apply and mimic with -json; the
+// terminal output goes to stderr instead
+type RunSummary struct {
+	Status     string          `json:"status"` // in-sync, differences, error or aborted
+	ExitCode   int             `json:"exitCode"`
+	Error      string          `json:"error,omitempty"`
+	Checksum   string          `json:"checksum,omitempty"`
+	Executed   bool            `json:"executed"`
+	Counts     map[string]int  `json:"counts"`
+	Operations []Operation     `json:"operations"`
+	Targets    []TargetSummary `json:"targets,omitempty"` // Once executed
+}
+
+// TargetSummary is how the plan went on one target directory
+type TargetSummary struct {
+	Directory string      `json:"directory"`
+	Skipped   bool        `json:"skipped,omitempty"` // Its snapshot failed, nothing was done
+	Errors    []string    `json:"errors"`
+	Deferred  []Operation `json:"deferred"` // Left out because the files were in use
+}
+
+// jsonOut is the real stdout while -json sends everything else to stderr,
+// nil without -json
+var jsonOut *os.File
+
+// setupJSONOutput keeps stdout for the -json summary
+func setupJSONOutput() {
+	jsonOut = os.Stdout
+	os.Stdout = os.Stderr
+}
+
+// newRunSummary starts the summary of a plan
+func newRunSummary(ops []Operation, checksum string) *RunSummary {
+	s := &RunSummary{Checksum: checksum, Counts: make(map[string]int), Operations: []Operation{}}
+	for _, op := range ops {
+		s.Counts[opCategory(op)]++
+		s.Operations = append(s.Operations, op)
+	}
+	return s
+}
+
+// planCode is the exit code of a plan that isn't executed: in sync when it
+// has nothing but special files, which no plan can change
+func planCode(ops []Operation) int {
+	for _, op := range ops {
+		if op.Type != "special" {
+			return exitDifferences
+		}
+	}
+	return exitInSync
+}
+
+// addResults records how the plan went on each target and returns the exit
+// code: an error if a target failed or was skipped, differences if files
+// were in use or the plan leaves missing and updated files behind
+func (s *RunSummary) addResults(results []targetResult) int {
+	s.Executed = true
+	code := exitInSync
+	for _, r := range results {
+		t := TargetSummary{Directory: r.dir, Skipped: r.skipped, Errors: r.errors, Deferred: r.deferred}
+		if t.Errors == nil {
+			t.Errors = []string{}
+		}
+		if t.Deferred == nil {
+			t.Deferred = []Operation{}
+		}
+		s.Targets = append(s.Targets, t)
+		switch {
+		case r.skipped || len(r.errors) > 0:
+			code = exitError
+		case len(r.deferred) > 0 && code == exitInSync:
+			code = exitDifferences
+		}
+	}
+	if code == exitInSync {
+		for _, op := range s.Operations {
+			if _, ok := opLabels[op.Type]; !ok && op.Type != "special" {
+				return exitDifferences
+			}
+		}
+	}
+	return code
+}
+
+// exit ends apply or mimic with code, printing the summary with -json
+func (s *RunSummary) exit(code int) {
+	if jsonOut != nil {
+		s.Status, s.ExitCode = exitStatuses[code], code
+		enc := json.NewEncoder(jsonOut)
+		enc.SetIndent("", "  ")
+		enc.Encode(s)
+	}
+	os.Exit(code)
+}
+
+// cliFail ends apply or mimic on an error, before or instead of executing
+func cliFail(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
+	s := newRunSummary(nil, "")
+	s.Error = msg
+	s.exit(exitError)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// cloneDir is -clone-dir: where the planned layout is built from hardlinks
+// to the target's files. Unlike the preview it is a real directory tree
+// that can be used (and swapped in for the target) while the old layout
+// stays untouched.
+var cloneDir string
+
+// checkCloneDir makes sure hardlinks from the target into dir can work:
+// outside the target and on the same filesystem
+func checkCloneDir(dir string) (string, error) {
+	abs, err := checkOutsideTarget("-clone-dir", dir)
+	if err != nil {
+		return "", err
+	}
+	targetInfo, err := os.Stat(targetDir)
+	if err != nil {
+		return "", err
+	}
+	// The clone dir itself may not exist yet, its parent has to
+	parentInfo, err := os.Stat(existingParent(filepath.Join(abs, "x")))
+	if err != nil {
+		return "", err
+	}
+	targetDev, ok1 := deviceID(targetInfo)
+	parentDev, ok2 := deviceID(parentInfo)
+	if ok1 && ok2 && targetDev != parentDev {
+		return "", fmt.Errorf("-clone-dir must be on the same filesystem as the target, hardlinks can't cross filesystems")
+	}
+	return abs, nil
+}
+
+// buildClone lays out the target as it would look after ops in cloneDir,
+// each file a hardlink to its current copy, and returns the number of
+// files. Nothing in the target changes: moved and copied files are linked
+// at their new paths, deleted ones are left out, missing ones don't exist
+// yet. The directory must be empty or absent, so a clone that is in use is
+// never overwritten.
+func buildClone(ops []Operation) (int, error) {
+	entries, err := os.ReadDir(cloneDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if len(entries) > 0 {
+		return 0, fmt.Errorf("%s is not empty, remove the previous clone first", cloneDir)
+	}
+
+	layout := plannedLayout(ops)
+	for future, current := range layout {
+		dst := filepath.Join(cloneDir, filepath.FromSlash(future))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return 0, err
+		}
+		if err := os.Link(filepath.Join(targetDir, filepath.FromSlash(current)), dst); err != nil {
+			return 0, err
+		}
+	}
+	return len(layout), nil
+}
+
+// handleClone builds the hardlink clone for a posted plan
+func handleClone(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cloneDir == "" {
+		http.Error(w, "No clone directory configured", http.StatusNotFound)
+		return
+	}
+
+	plan, _, err := decodePlan(requestBody(w, r, maxPlanBytes))
+	if err != nil {
+		planError(w, err)
+		return
+	}
+
+	catalogMu.RLock()
+	files, err := buildClone(plan.Operations)
+	catalogMu.RUnlock()
+	if err != nil {
+		http.Error(w, "Failed to build clone: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Planned layout cloned to %s with hardlinks (%d files)\n", cloneDir, files)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "path": cloneDir, "files": files})
+}
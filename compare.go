@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rootList collects -compare-root, which may be given several times
+type rootList []string
+
+func (l *rootList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *rootList) Set(value string) error {
+	abs, err := filepath.Abs(value)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", value)
+	}
+	*l = append(*l, abs)
+	return nil
+}
+
+// compareRoots are further directories the server catalogs, read-only, so
+// that /compare can diff them with each other or with the target, e.g. a
+// backup against the disk it backs up
+var compareRoots rootList
+
+// rootScans caches the catalogs of -compare-root directories, for
+// sourceCacheTTL like the source catalog of /tree
+var rootScans struct {
+	sync.Mutex
+	scans   map[string]*ScanResult
+	scanned map[string]time.Time
+}
+
+// CompareResponse is a plan that would make root To look like root From,
+// in the format /apply takes. Nothing is executed: To may not even be the
+// target.
+type CompareResponse struct {
+	Plan
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Match bool   `json:"match"` // No operations besides special files
+}
+
+// rootCatalog returns the catalog of the target or of a -compare-root
+func rootCatalog(root string) (*ScanResult, error) {
+	if root == targetDir {
+		catalogMu.RLock()
+		defer catalogMu.RUnlock()
+		return &ScanResult{Files: catalog, Special: specialFiles, Mounts: mountPoints}, nil
+	}
+	rootScans.Lock()
+	defer rootScans.Unlock()
+	if rootScans.scans == nil {
+		rootScans.scans = make(map[string]*ScanResult)
+		rootScans.scanned = make(map[string]time.Time)
+	}
+	if time.Since(rootScans.scanned[root]) > sourceCacheTTL {
+		scan, err := scanDirectory(root, useHashing)
+		if err != nil {
+			return nil, err
+		}
+		rootScans.scans[root], rootScans.scanned[root] = scan, time.Now()
+	}
+	return rootScans.scans[root], nil
+}
+
+// handleCompare diffs two of the server's roots (the target and the
+// -compare-root directories) on the server: ?from= is the layout wanted,
+// ?to= the root the plan is for, mode= as for /tree. It changes nothing.
+func handleCompare(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	if from == "" || to == "" {
+		http.Error(w, "from and to are required", http.StatusBadRequest)
+		return
+	}
+	if from == to {
+		http.Error(w, "from and to are the same root", http.StatusBadRequest)
+		return
+	}
+	mode := q.Get("mode")
+	if mode == "" {
+		mode = diffMode
+	}
+	if mode != "relocate" && mode != "strict" && mode != "content" {
+		http.Error(w, "mode must be relocate, strict or content", http.StatusBadRequest)
+		return
+	}
+
+	for _, root := range []string{from, to} {
+		if root != targetDir && !containsString(compareRoots, root) {
+			http.Error(w, root+" is neither the target nor a -compare-root", http.StatusNotFound)
+			return
+		}
+	}
+
+	source, err := rootCatalog(from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	target, err := rootCatalog(to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ops := computePlan(source.Files, target.Files, target.Special, target.Mounts, mode)
+	match := true
+	for _, op := range ops {
+		if op.Type != "special" {
+			match = false
+			break
+		}
+	}
+	if ops == nil {
+		ops = []Operation{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CompareResponse{
+		Plan:  Plan{Version: planVersion, Operations: ops},
+		From:  from,
+		To:    to,
+		Match: match,
+	})
+}
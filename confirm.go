@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webConfirmTimeout is how long a plan waits for the second (web) confirmation
+const webConfirmTimeout = 10 * time.Minute
+
+// pendingConfirm is a plan confirmed in the terminal that still needs a
+// confirmation from the web UI (-dual-confirm), or a checkpoint of a running
+// plan (-checkpoint-every)
+type pendingConfirm struct {
+	Checksum   string `json:"checksum"`
+	Summary    string `json:"summary"`
+	Checkpoint bool   `json:"checkpoint,omitempty"` // Can also be rolled back
+	decision   chan string
+}
+
+var (
+	confirmMu sync.Mutex
+	pending   *pendingConfirm
+)
+
+// waitForWebConfirm announces the plan to all connected browsers and blocks
+// until one of them approves or rejects it, the timeout passes, or the
+// submitting request goes away
+func waitForWebConfirm(r *http.Request, checksum, summary string) bool {
+	return waitForWebDecision(r, &pendingConfirm{Checksum: checksum, Summary: summary}) == "continue"
+}
+
+// waitForWebDecision announces p to all connected browsers and returns what
+// one of them decided: "continue", "abort", or for checkpoints "rollback".
+// It is "abort" when the timeout passes or the submitting request goes away.
+func waitForWebDecision(r *http.Request, p *pendingConfirm) string {
+	p.decision = make(chan string, 1)
+	confirmMu.Lock()
+	pending = p
+	confirmMu.Unlock()
+	defer func() {
+		confirmMu.Lock()
+		if pending == p {
+			pending = nil
+		}
+		confirmMu.Unlock()
+		events.publish(Event{Type: "confirm-done", Data: map[string]string{"checksum": p.Checksum}})
+	}()
+
+	fmt.Println(tr("Waiting for confirmation in the web UI..."))
+	events.publish(Event{Type: "confirm-required", Data: p})
+
+	select {
+	case decision := <-p.decision:
+		return decision
+	case <-time.After(webConfirmTimeout):
+		fmt.Println(tr("Timed out waiting for web confirmation."))
+		return "abort"
+	case <-r.Context().Done():
+		return "abort"
+	}
+}
+
+// handleConfirmPending returns the plan waiting for web confirmation, if any,
+// for browsers that connect after it was announced
+func handleConfirmPending(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	confirmMu.Lock()
+	p := pending
+	confirmMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"pending": p})
+}
+
+// handleConfirm records the web UI's decision on the pending plan or
+// checkpoint. The checksum must match, so a decision can't land on a
+// different plan.
+func handleConfirm(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Checksum string `json:"checksum"`
+		Approve  bool   `json:"approve"`
+		Rollback bool   `json:"rollback"` // Checkpoints: take back what was done
+	}
+	if err := json.NewDecoder(requestBody(w, r, maxPlanBytes)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	confirmMu.Lock()
+	p := pending
+	if p != nil && p.Checksum == req.Checksum {
+		pending = nil
+	}
+	confirmMu.Unlock()
+
+	if p == nil || p.Checksum != req.Checksum {
+		http.Error(w, "No pending plan with this checksum", http.StatusConflict)
+		return
+	}
+	decision := "abort"
+	if req.Approve {
+		decision = "continue"
+	} else if req.Rollback && p.Checkpoint {
+		decision = "rollback"
+	}
+	p.decision <- decision
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"approved": req.Approve, "decision": decision})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// conflictStrategy is -conflict: what strict mode does with a file that
+// exists on both sides with different content
+var conflictStrategy = "source"
+
+// conflictStrategies are the -conflict values. "source" reports the file
+// as needing an update from the source; "ask" leaves each one to the UI.
+var conflictStrategies = []string{"source", "newer", "larger", "keep-both", "ask"}
+
+// resolveConflict returns "source" (update from the source), "target" (keep
+// the target's version) or "both" (rename the target's version aside so the
+// source's can be copied next to it), or "" if the user has to decide
+func resolveConflict(src, dst FileEntry) string {
+	switch conflictStrategy {
+	case "newer":
+		if src.MTime > dst.MTime {
+			return "source"
+		}
+		return "target"
+	case "larger":
+		if src.Size > dst.Size {
+			return "source"
+		}
+		return "target"
+	case "keep-both":
+		return "both"
+	case "ask":
+		return ""
+	}
+	return "source"
+}
+
+// conflictName is where keep-both puts the target's version of a file:
+// "a/photo.jpg" becomes "a/photo (target).jpg", or "(target 2)" and so on
+// if taken
+func conflictName(p string, taken func(string) bool) string {
+	ext := path.Ext(p)
+	if strings.HasPrefix(path.Base(p), ".") && ext == path.Base(p) {
+		ext = "" // Dotfile without extension
+	}
+	base := strings.TrimSuffix(p, ext)
+	name := base + " (target)" + ext
+	for i := 2; taken(name); i++ {
+		name = base + " (target " + strconv.Itoa(i) + ")" + ext
+	}
+	return name
+}
+
+// conflictReason explains a conflict's operations
+func conflictReason(src, dst FileEntry, resolution string) string {
+	reason := "same path, different hash"
+	if src.Size != dst.Size {
+		reason = "same path, " + formatSize(src.Size) + " in the source vs " + formatSize(dst.Size) + " here"
+	}
+	switch resolution {
+	case "both":
+		return reason + ": keeping both (-conflict " + conflictStrategy + ")"
+	case "":
+		return reason + ": undecided (-conflict ask)"
+	}
+	return reason + ": source version wins (-conflict " + conflictStrategy + ")"
+}
+
+// conflictOps returns the operations for a same-path conflict resolved
+// one way or the other
+func conflictOps(src FileEntry, resolution string, taken func(string) bool) []Operation {
+	switch resolution {
+	case "target":
+		return nil
+	case "both":
+		return []Operation{
+			{Type: "mv", From: src.Path, To: conflictName(src.Path, taken)},
+			{Type: "missing", From: src.Path, Size: src.Size},
+		}
+	}
+	return []Operation{{Type: "update", From: src.Path, Size: src.Size}}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// containerMode is -container: bind right away and scan in the background,
+// log requests to stdout as JSON, and confirm plans in the web UI when
+// there's no terminal
+var containerMode bool
+
+// noTerminalConfirm is -no-terminal-confirm: plans are confirmed in the web
+// UI instead of on stdin
+var noTerminalConfirm bool
+
+// assumeYes is -assume-yes: plans are executed without asking
+var assumeYes bool
+
+// terminalConfirm is set at startup when plans can be confirmed on stdin
+var terminalConfirm bool
+
+// errNoTerminal explains why /apply is refused when nobody can answer the prompt
+const errNoTerminal = "stdin is not a terminal, so the plan can't be confirmed there. " +
+	"Restart dir-mimic with -no-terminal-confirm to confirm in the web UI, or -assume-yes with -operator-token to skip confirmation"
+
+// envPrefix is prepended to flag names to get their environment variables:
+// -operator-token can be set with DIR_MIMIC_OPERATOR_TOKEN
+const envPrefix = "DIR_MIMIC_"
+
+// envName returns the environment variable for a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvDefaults sets flags from the environment before the command line
+// is parsed, so explicit flags still win. PORT (as set by most container
+// platforms) stands in for -p. Flags set here count as given, so a
+// -profile doesn't override them.
+func applyEnvDefaults(fs *flag.FlagSet) error {
+	var firstErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok && f.Name == "p" {
+			value, ok = os.LookupEnv("PORT")
+		}
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", envName(f.Name), err)
+		}
+	})
+	return firstErr
+}
+
+// setupContainerMode switches logging to JSON on stdout and, without a
+// terminal on stdin, confirmation to the web UI
+func setupContainerMode(level slog.Level) {
+	accessLog = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+	if !stdinIsTerminal() && !noTerminalConfirm {
+		noTerminalConfirm = true
+		fmt.Fprintf(os.Stderr, "No terminal on stdin, plans are confirmed in the web UI\n")
+	}
+}
+
+// initialScan scans the target and publishes the catalog. In container mode
+// it runs in the background; /catalog answers 503 until it's done.
+func initialScan() error {
+	fmt.Fprintf(os.Stderr, "Scanning directory: %s\n", targetDir)
+	scan, err := scanDirectory(targetDir, useHashing)
+	if err != nil {
+		return err
+	}
+	setCatalog(scan)
+	fmt.Fprintf(os.Stderr, "Found %d files\n", len(scan.Files))
+	if len(scan.Inaccessible) > 0 {
+		fmt.Fprintf(os.Stderr, "Could not read %d paths, the catalog is incomplete\n", len(scan.Inaccessible))
+	}
+	if len(scan.Warnings) > 0 {
+		fmt.Fprintf(os.Stderr, "%d scan warnings, see above\n", len(scan.Warnings))
+	}
+	if len(scan.Special) > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d special files (FIFOs, sockets, devices, non-file symlinks)\n", len(scan.Special))
+	}
+	return nil
+}
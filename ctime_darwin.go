@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// changeTime returns the file's ctime in nanoseconds, which changes with
+// every write and can't be set back like the mtime
+func changeTime(info os.FileInfo) (int64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return st.Ctimespec.Nano(), true
+}
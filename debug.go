@@ -0,0 +1,49 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// Scanner and apply internals, served on /debug/vars with -debug
+var (
+	scanRuns         = expvar.NewInt("scan_runs")
+	scanInProgress   = expvar.NewInt("scan_in_progress")
+	scanDirsVisited  = expvar.NewInt("scan_dirs_visited")
+	scanFilesVisited = expvar.NewInt("scan_files_visited")
+	scanFilesHashed  = expvar.NewInt("scan_files_hashed")
+	scanLastMillis   = expvar.NewInt("scan_last_duration_ms")
+	scanHashMillis   = expvar.NewInt("scan_hash_ms_total")
+
+	applyRuns        = expvar.NewInt("apply_runs")
+	applyOps         = expvar.NewInt("apply_ops_executed")
+	applyErrors      = expvar.NewInt("apply_errors")
+	applyDeferred    = expvar.NewInt("apply_deferred")
+	applyBytesCopy   = expvar.NewInt("apply_bytes_copied")
+	applyBytesImport = expvar.NewInt("apply_bytes_imported")
+)
+
+func init() {
+	expvar.Publish("catalog_files", expvar.Func(func() interface{} {
+		catalogMu.RLock()
+		defer catalogMu.RUnlock()
+		return len(catalog)
+	}))
+	expvar.Publish("event_clients", expvar.Func(func() interface{} {
+		events.mu.Lock()
+		defer events.mu.Unlock()
+		return len(events.clients)
+	}))
+}
+
+// registerDebugHandlers mounts pprof and expvar. They need the operator
+// token when one is set, since /debug/pprof/cmdline shows the command line.
+func registerDebugHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", requireRole(roleOperator, pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", requireRole(roleOperator, pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", requireRole(roleOperator, pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", requireRole(roleOperator, pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", requireRole(roleOperator, pprof.Trace))
+	mux.HandleFunc("/debug/vars", requireRole(roleOperator, expvar.Handler().ServeHTTP))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DuplicateGroup is a set of catalog entries with identical content
+type DuplicateGroup struct {
+	Size  int64
+	Paths []string // Relative paths, sorted; the first one is kept
+}
+
+// runDedupe implements `dir-mimic dedupe <dir>`: find identical files and
+// replace all but one copy of each with hardlinks
+func runDedupe(args []string) {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	auto := fs.Bool("auto", false, "Replace all duplicates without asking")
+	noDefaultIgnores := fs.Bool("no-default-ignores", false, "Disable built-in ignore patterns")
+	extraIgnores := fs.String("ignore", "", "Extra ignore patterns (comma-separated, matched against filename)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: dir-mimic dedupe [-auto] [-no-default-ignores] [-ignore patterns] <directory>\n")
+		os.Exit(1)
+	}
+
+	ignorePatterns = buildIgnorePatterns(*noDefaultIgnores, *extraIgnores)
+
+	var err error
+	targetDir, err = filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting absolute path: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Scanning directory: %s\n", targetDir)
+	scan, err := scanDirectory(targetDir, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error scanning directory: %v\n", err)
+		os.Exit(1)
+	}
+	entries := scan.Files
+	fmt.Fprintf(os.Stderr, "Found %d files, looking for duplicates...\n", len(entries))
+
+	groups := findDuplicates(targetDir, entries)
+	if len(groups) == 0 {
+		fmt.Println("No duplicates found.")
+		return
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	var reclaimed int64
+	linked, failed := 0, 0
+
+	target := currentTarget()
+	for _, group := range groups {
+		fmt.Printf("\n%d copies, %s each:\n", len(group.Paths), formatSize(group.Size))
+		fmt.Printf("  KEEP: %s\n", group.Paths[0])
+		for _, p := range group.Paths[1:] {
+			fmt.Printf("  LINK: %s\n", p)
+		}
+
+		if !*auto {
+			fmt.Print("Replace duplicates with hardlinks? [y/N/q]: ")
+			response, _ := reader.ReadString('\n')
+			response = strings.TrimSpace(strings.ToLower(response))
+			if response == "q" || response == "quit" {
+				break
+			}
+			if response != "y" && response != "yes" {
+				continue
+			}
+		}
+
+		for _, p := range group.Paths[1:] {
+			if err := target.executeLink(group.Paths[0], p, true); err != nil {
+				fmt.Fprintf(os.Stderr, "  ERROR: %s: %v\n", p, err)
+				failed++
+				continue
+			}
+			linked++
+			reclaimed += group.Size
+		}
+	}
+
+	fmt.Printf("\nDone! %d files replaced with hardlinks, %s reclaimed", linked, formatSize(reclaimed))
+	if failed > 0 {
+		fmt.Printf(", %d errors", failed)
+	}
+	fmt.Println()
+}
+
+// findDuplicates groups catalog entries by size, then sample hash, then full
+// hash, so only likely candidates are read completely. Files that are already
+// hardlinked to the group's first copy are left out.
+func findDuplicates(root string, entries []FileEntry) []DuplicateGroup {
+	bySize := make(map[int64][]FileEntry)
+	for _, e := range entries {
+		if e.Size > 0 {
+			bySize[e.Size] = append(bySize[e.Size], e)
+		}
+	}
+
+	// groupBy splits candidates by a hash function, dropping unique ones
+	groupBy := func(candidates []FileEntry, hashFn func(FileEntry) (string, error)) [][]FileEntry {
+		byHash := make(map[string][]FileEntry)
+		for _, e := range candidates {
+			h, err := hashFn(e)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: could not hash %s: %v\n", e.Path, err)
+				continue
+			}
+			byHash[h] = append(byHash[h], e)
+		}
+		var result [][]FileEntry
+		for _, g := range byHash {
+			if len(g) > 1 {
+				result = append(result, g)
+			}
+		}
+		return result
+	}
+
+	var groups []DuplicateGroup
+	for size, candidates := range bySize {
+		if len(candidates) < 2 {
+			continue
+		}
+		for _, sampled := range groupBy(candidates, func(e FileEntry) (string, error) {
+			return computeSampleHash(filepath.Join(root, e.Path), e.Size)
+		}) {
+			for _, identical := range groupBy(sampled, func(e FileEntry) (string, error) {
+				return computeFullHash(filepath.Join(root, e.Path))
+			}) {
+				paths := make([]string, 0, len(identical))
+				for _, e := range identical {
+					paths = append(paths, e.Path)
+				}
+				sort.Strings(paths)
+
+				// Skip copies that already share the first copy's inode
+				keep, err := os.Stat(filepath.Join(root, paths[0]))
+				if err != nil {
+					continue
+				}
+				group := DuplicateGroup{Size: size, Paths: paths[:1]}
+				for _, p := range paths[1:] {
+					info, err := os.Stat(filepath.Join(root, p))
+					if err == nil && !os.SameFile(keep, info) {
+						group.Paths = append(group.Paths, p)
+					}
+				}
+				if len(group.Paths) > 1 {
+					groups = append(groups, group)
+				}
+			}
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Paths[0] < groups[j].Paths[0]
+	})
+	return groups
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// computePlan is the Go counterpart of the UI's computeDiff: it compares a
+// source catalog with the server catalog in the given mode ("relocate",
+// "strict" or "content") and returns the operations, sorted by path. Dedupe
+// link choices are a UI matter and not applied here; -matcher-cmd is.
+// mounts are the target's mount points (ScanResult.Mounts), so copies are
+// made from a file on the destination's filesystem where there is one.
+func computePlan(sourceFiles, targetFiles []FileEntry, special []SpecialFile, mounts []string, mode string) []Operation {
+	// Hashes only take part in matching when both sides have them
+	useHash := anyHash(sourceFiles) && anyHash(targetFiles)
+	// Likewise photo capture times
+	useDates := anyTakenAt(sourceFiles) && anyTakenAt(targetFiles)
+	// and audio hashes
+	useAudio := anyAudioHash(sourceFiles) && anyAudioHash(targetFiles)
+
+	// Files the server's depth limit or filter leave out are not in its catalog either
+	var source []FileEntry
+	for _, e := range sourceFiles {
+		if (maxDepth == 0 || strings.Count(e.Path, "/")+1 <= maxDepth) && fileFilter.allows(path.Base(e.Path), e.Size) {
+			source = append(source, e)
+		}
+	}
+
+	var ops []Operation
+	if mode == "strict" {
+		ops = strictOps(source, targetFiles, useHash)
+	} else {
+		ops = relocateOps(source, targetFiles, mounts, useHash, useDates, useAudio, mode == "content")
+	}
+
+	if matcherAvailable() {
+		ops = applyMatcher(ops, source, targetFiles)
+	}
+
+	ops, _ = withoutNeverTouched(ops)
+
+	// Special files are reported, never touched
+	for _, s := range special {
+		ops = append(ops, Operation{Type: "special", From: s.Path, Reason: "not a regular file, skipped", Confidence: 1})
+	}
+
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].From < ops[j].From })
+	return ops
+}
+
+// copySource picks which of several identical target files to copy to
+// dest: one on the same filesystem, which the copy can reflink (btrfs, XFS)
+// or at least copy without crossing devices, otherwise the first
+func copySource(candidates []FileEntry, dest string, mounts []string) FileEntry {
+	want := mountPointOf(dest, mounts)
+	for _, c := range candidates {
+		if mountPointOf(c.Path, mounts) == want {
+			return c
+		}
+	}
+	return candidates[0]
+}
+
+// mountPointOf returns the innermost of mounts that p is below, "" for the
+// target's own filesystem
+func mountPointOf(p string, mounts []string) string {
+	best := ""
+	for _, m := range mounts {
+		if strings.HasPrefix(p, m+"/") && len(m) > len(best) {
+			best = m
+		}
+	}
+	return best
+}
+
+func anyHash(files []FileEntry) bool {
+	for _, e := range files {
+		if e.Hash != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func anyAudioHash(files []FileEntry) bool {
+	for _, e := range files {
+		if e.AudioHash != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func anyTakenAt(files []FileEntry) bool {
+	for _, e := range files {
+		if e.TakenAt != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// strictOps: target paths must equal source paths, conflicts are resolved
+// by -conflict
+func strictOps(source, target []FileEntry, useHash bool) []Operation {
+	var ops []Operation
+	destByPath := make(map[string]FileEntry, len(target))
+	for _, e := range target {
+		destByPath[e.Path] = e
+	}
+	sourcePaths := make(map[string]bool, len(source))
+	for _, src := range source {
+		sourcePaths[src.Path] = true
+	}
+	taken := func(p string) bool {
+		_, onTarget := destByPath[p]
+		return onTarget || sourcePaths[p]
+	}
+
+	for _, src := range source {
+		dst, ok := destByPath[src.Path]
+		switch {
+		case !ok:
+			ops = append(ops, Operation{Type: "missing", From: src.Path, Size: src.Size, Reason: "path not on the target", Confidence: 1})
+		case dst.Size != src.Size || (useHash && src.Hash != "" && dst.Hash != "" && src.Hash != dst.Hash):
+			resolution := resolveConflict(src, dst)
+			for _, op := range conflictOps(src, resolution, taken) {
+				op.Reason, op.Confidence = conflictReason(src, dst, resolution), 1
+				ops = append(ops, op)
+			}
+		}
+	}
+	for _, dst := range target {
+		if !sourcePaths[dst.Path] {
+			ops = append(ops, Operation{Type: "rm", From: dst.Path, Reason: "path not in the source", Confidence: 1})
+		}
+	}
+	return ops
+}
+
+// relocateOps matches files by name + size (+ hash), or by content alone,
+// and moves or copies them to where the source has them. With useAudio,
+// music files are matched by their audio alone; with useDates, photos by
+// capture time + size instead of name.
+func relocateOps(source, target []FileEntry, mounts []string, useHash, useDates, useAudio, contentOnly bool) []Operation {
+	altKey := func(e FileEntry) string {
+		switch {
+		case useAudio && e.AudioHash != "":
+			return "~" + e.AudioHash
+		case useDates && !contentOnly && e.TakenAt != "":
+			return "@" + e.TakenAt + "|" + strconv.FormatInt(e.Size, 10)
+		}
+		return ""
+	}
+	makeKey := func(e FileEntry) string {
+		if key := altKey(e); key != "" {
+			return key
+		}
+		name := ""
+		if !contentOnly {
+			name = path.Base(e.Path)
+		}
+		key := name + "|" + strconv.FormatInt(e.Size, 10)
+		if useHash && e.Hash != "" {
+			key += "|" + e.Hash
+		}
+		return key
+	}
+	// basisOf names what files sharing e's key have in common, for op reasons
+	basisOf := func(e FileEntry) string {
+		switch {
+		case useAudio && e.AudioHash != "":
+			return "audio hash"
+		case useDates && !contentOnly && e.TakenAt != "":
+			return "capture time+size"
+		}
+		basis := "name+size"
+		if contentOnly {
+			basis = "size"
+		}
+		if useHash && e.Hash != "" {
+			basis += "+hash"
+		}
+		return basis
+	}
+	// With the name in the key a file is in place when its folder matches;
+	// content-only, audio and capture time keys have to compare whole paths
+	folderOf := func(e FileEntry) string {
+		if contentOnly || altKey(e) != "" {
+			return e.Path
+		}
+		if dir := path.Dir(e.Path); dir != "." {
+			return dir
+		}
+		return ""
+	}
+
+	var keys []string
+	sourceByKey := make(map[string][]FileEntry)
+	destByKey := make(map[string][]FileEntry)
+	for _, e := range source {
+		k := makeKey(e)
+		if _, ok := sourceByKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		sourceByKey[k] = append(sourceByKey[k], e)
+	}
+	for _, e := range target {
+		k := makeKey(e)
+		if _, ok := sourceByKey[k]; !ok {
+			if _, ok := destByKey[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		destByKey[k] = append(destByKey[k], e)
+	}
+
+	var ops []Operation
+	for _, k := range keys {
+		srcList, dstList := sourceByKey[k], destByKey[k]
+		var basis string
+		if len(srcList) > 0 {
+			basis = basisOf(srcList[0])
+		} else {
+			basis = basisOf(dstList[0])
+		}
+		score := basisConfidence[basis]
+		switch {
+		case len(srcList) == 0:
+			for _, dst := range dstList {
+				ops = append(ops, Operation{Type: "rm", From: dst.Path, Reason: "no source file with the same " + basis, Confidence: 1})
+			}
+			continue
+		case len(dstList) == 0:
+			for _, src := range srcList {
+				ops = append(ops, Operation{Type: "missing", From: src.Path, Size: src.Size, Reason: "no target file with the same " + basis, Confidence: 1})
+			}
+			continue
+		}
+
+		srcFolders := make(map[string]bool)
+		for _, s := range srcList {
+			srcFolders[folderOf(s)] = true
+		}
+		dstFolders := make(map[string]bool)
+		for _, d := range dstList {
+			dstFolders[folderOf(d)] = true
+		}
+		var onlyInSrc, onlyInDst []FileEntry
+		for _, s := range srcList {
+			if !dstFolders[folderOf(s)] {
+				onlyInSrc = append(onlyInSrc, s)
+			}
+		}
+		for _, d := range dstList {
+			if !srcFolders[folderOf(d)] {
+				onlyInDst = append(onlyInDst, d)
+			}
+		}
+
+		// Move where possible, delete extra files, copy for extra locations.
+		// Copies come first, as their source may be one of the moved files.
+		moves := len(onlyInSrc)
+		if len(onlyInDst) < moves {
+			moves = len(onlyInDst)
+		}
+		copies := fmt.Sprintf("%d with the same %s in the source, %d on the target", len(srcList), basis, len(dstList))
+		for _, s := range onlyInSrc[moves:] {
+			ops = append(ops, Operation{Type: "cp", From: copySource(dstList, s.Path, mounts).Path, To: s.Path, Reason: "another copy needed: " + copies, Confidence: score})
+		}
+		for i := 0; i < moves; i++ {
+			// Which of several candidates goes where is a guess
+			reason, moveScore := "unique "+basis+" match", score
+			if len(onlyInDst) > 1 {
+				reason = fmt.Sprintf("ambiguous %s match: picked #%d of %d candidates for %d places",
+					basis, i+1, len(onlyInDst), len(onlyInSrc))
+				moveScore = score / float64(len(onlyInDst))
+			}
+			ops = append(ops, Operation{Type: "mv", From: onlyInDst[i].Path, To: onlyInSrc[i].Path, Reason: reason, Confidence: moveScore})
+		}
+		for _, d := range onlyInDst[moves:] {
+			ops = append(ops, Operation{Type: "rm", From: d.Path, Reason: "extra copy: " + copies, Confidence: score})
+		}
+	}
+	return ops
+}
@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+// freeSpace is not available on this platform, so -reserve is a no-op
+func freeSpace(path string) (int64, bool) {
+	return 0, false
+}
+
+// totalSpace is not available on this platform either
+func totalSpace(path string) (int64, bool) {
+	return 0, false
+}
+
+// freeInodes is not available on this platform, so the inode budget isn't
+// checked
+func freeInodes(path string) (int64, bool) {
+	return 0, false
+}
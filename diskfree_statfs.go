@@ -0,0 +1,35 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem holding path
+func freeSpace(path string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, false
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), true
+}
+
+// totalSpace returns the size of the filesystem holding path
+func totalSpace(path string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, false
+	}
+	return int64(uint64(st.Blocks) * uint64(st.Bsize)), true
+}
+
+// freeInodes returns the inodes left on the filesystem holding path. It is
+// false where the filesystem has no fixed number of them (btrfs, ZFS and
+// others report a total of 0).
+func freeInodes(path string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil || st.Files == 0 {
+		return 0, false
+	}
+	return int64(st.Ffree), true
+}
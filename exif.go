@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// photoDates enables -photo-dates: capture times of photos are read from
+// their EXIF data during the scan, so renamed copies can still be matched
+var photoDates bool
+
+// photoExts are the formats whose EXIF data we can read: JPEG, and TIFF
+// along with the raw formats built on it
+var photoExts = map[string]bool{
+	"jpg": true, "jpeg": true, "tif": true, "tiff": true,
+	"dng": true, "nef": true, "cr2": true, "arw": true, "orf": true, "rw2": true, "pef": true,
+}
+
+var errNoExifDate = errors.New("no EXIF capture time")
+
+// EXIF tags we look at
+const (
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+)
+
+// isPhoto reports whether the file is a format photoTakenAt can read
+func isPhoto(name string) bool {
+	return photoExts[strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))]
+}
+
+// photoTakenAt returns the EXIF capture time of a JPEG or TIFF-based file as
+// "2006-01-02T15:04:05" (camera local time, as EXIF has no zone)
+func photoTakenAt(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var magic [4]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return "", errNoExifDate
+	}
+
+	var tiff io.ReaderAt
+	switch {
+	case magic[0] == 0xFF && magic[1] == 0xD8:
+		payload, err := jpegExif(f)
+		if err != nil {
+			return "", err
+		}
+		tiff = bytes.NewReader(payload)
+	case string(magic[:]) == "II*\x00" || string(magic[:]) == "MM\x00*":
+		tiff = f
+	default:
+		return "", errNoExifDate
+	}
+
+	raw, err := tiffDate(tiff)
+	if err != nil {
+		return "", err
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", raw)
+	if err != nil {
+		return "", errNoExifDate
+	}
+	return t.Format("2006-01-02T15:04:05"), nil
+}
+
+// jpegExif returns the TIFF structure in a JPEG's APP1 Exif segment
+func jpegExif(f *os.File) ([]byte, error) {
+	if _, err := f.Seek(2, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(f, header[:]); err != nil || header[0] != 0xFF {
+			return nil, errNoExifDate
+		}
+		marker := header[1]
+		length := int64(binary.BigEndian.Uint16(header[2:])) - 2
+		if marker == 0xDA || marker == 0xD9 || length < 0 {
+			// Image data starts, no metadata after this
+			return nil, errNoExifDate
+		}
+		if marker != 0xE1 || length < 6 {
+			if _, err := f.Seek(length, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(f, segment); err != nil {
+			return nil, errNoExifDate
+		}
+		if string(segment[:6]) == "Exif\x00\x00" {
+			return segment[6:], nil
+		}
+	}
+}
+
+// tiffDate finds DateTimeOriginal in the Exif IFD, falling back to the
+// DateTime of IFD0
+func tiffDate(r io.ReaderAt) (string, error) {
+	var header [8]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return "", errNoExifDate
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return "", errNoExifDate
+	}
+
+	ifd0 := readIFD(r, order, int64(order.Uint32(header[4:])))
+	if ptr, ok := ifd0[tagExifIFD]; ok {
+		exif := readIFD(r, order, int64(order.Uint32(ptr[8:])))
+		if date := ifdString(r, order, exif[tagDateTimeOriginal]); date != "" {
+			return date, nil
+		}
+	}
+	if date := ifdString(r, order, ifd0[tagDateTime]); date != "" {
+		return date, nil
+	}
+	return "", errNoExifDate
+}
+
+// readIFD returns the raw 12-byte entries of the IFD at offset by tag
+func readIFD(r io.ReaderAt, order binary.ByteOrder, offset int64) map[uint16][]byte {
+	entries := make(map[uint16][]byte)
+	var count [2]byte
+	if _, err := r.ReadAt(count[:], offset); err != nil {
+		return entries
+	}
+	n := int(order.Uint16(count[:]))
+	buf := make([]byte, 12*n)
+	if _, err := r.ReadAt(buf, offset+2); err != nil {
+		return entries
+	}
+	for i := 0; i < n; i++ {
+		entry := buf[12*i : 12*i+12]
+		entries[order.Uint16(entry)] = entry
+	}
+	return entries
+}
+
+// ifdString reads an ASCII IFD entry, or "" if it isn't one
+func ifdString(r io.ReaderAt, order binary.ByteOrder, entry []byte) string {
+	const typeASCII = 2
+	if entry == nil || order.Uint16(entry[2:]) != typeASCII {
+		return ""
+	}
+	n := order.Uint32(entry[4:])
+	if n > 64 {
+		return ""
+	}
+	value := make([]byte, n)
+	if n <= 4 {
+		copy(value, entry[8:])
+	} else if _, err := r.ReadAt(value, int64(order.Uint32(entry[8:]))); err != nil {
+		return ""
+	}
+	return strings.TrimRight(string(value), "\x00 ")
+}
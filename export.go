@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// exportColumns is the header row of a plan export
+var exportColumns = []string{"type", "from", "to", "size", "reason", "confidence"}
+
+// spreadsheetSafe keeps a spreadsheet from reading a cell as a formula
+func spreadsheetSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// writeExport writes ops as CSV, or TSV with tabs as the separator
+func writeExport(w http.ResponseWriter, ops []Operation, sizes planSizes, tabs bool) {
+	ext, contentType := "csv", "text/csv"
+	if tabs {
+		ext, contentType = "tsv", "text/tab-separated-values"
+	}
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="dir-mimic-plan.`+ext+`"`)
+
+	out := csv.NewWriter(w)
+	if tabs {
+		out.Comma = '\t'
+	}
+	out.Write(exportColumns)
+	for _, op := range ops {
+		size := op.Size
+		if size == 0 {
+			size = sizes.opSize(op)
+		}
+		out.Write([]string{
+			op.Type,
+			spreadsheetSafe(op.From),
+			spreadsheetSafe(op.To),
+			strconv.FormatInt(size, 10),
+			spreadsheetSafe(op.Reason),
+			strconv.FormatFloat(confidence(op), 'f', 2, 64),
+		})
+	}
+	out.Flush()
+}
+
+// handleExport returns a plan as CSV (?format=tsv for tab-separated): the
+// plan in the request body for POST (same format as /apply), or with
+// -source-catalog-url the one computed on the server for GET (?mode= as for
+// /tree). format=folders and format=mkdir return the folder layout the plan
+// makes instead, see writeLayout; GET without a source catalog returns the
+// target's own.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format != "" && format != "csv" && format != "tsv" && format != "folders" && format != "mkdir" {
+		http.Error(w, "format must be csv, tsv, folders or mkdir", http.StatusBadRequest)
+		return
+	}
+	layout := format == "folders" || format == "mkdir"
+
+	switch r.Method {
+	case http.MethodPost:
+		plan, _, err := decodePlan(requestBody(w, r, maxPlanBytes))
+		if err != nil {
+			planError(w, err)
+			return
+		}
+		if layout {
+			catalogMu.RLock()
+			folders := layoutFolders(catalog, plan.Operations)
+			catalogMu.RUnlock()
+			writeLayout(w, folders, format)
+			return
+		}
+		catalogMu.RLock()
+		sizes := planSizes{target: sizeIndex(catalog)}
+		catalogMu.RUnlock()
+		writeExport(w, plan.Operations, sizes, format == "tsv")
+	case http.MethodGet:
+		if layout && !haveSourceCatalog() {
+			catalogMu.RLock()
+			folders := layoutFolders(catalog, nil)
+			catalogMu.RUnlock()
+			writeLayout(w, folders, format)
+			return
+		}
+		if !haveSourceCatalog() {
+			http.Error(w, "No source catalog URL configured or catalog pushed, POST a plan instead", http.StatusNotFound)
+			return
+		}
+		mode := q.Get("mode")
+		if mode == "" {
+			mode = diffMode
+		}
+		if mode != "relocate" && mode != "strict" && mode != "content" {
+			http.Error(w, "mode must be relocate, strict or content", http.StatusBadRequest)
+			return
+		}
+		ops, sizes, err := currentPlan(mode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if layout {
+			catalogMu.RLock()
+			folders := layoutFolders(catalog, ops)
+			catalogMu.RUnlock()
+			writeLayout(w, folders, format)
+			return
+		}
+		writeExport(w, ops, sizes, format == "tsv")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// deviceID is not available on this platform, so -one-file-system is a no-op
+func deviceID(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// fileID is not available on this platform, so hardlinks aren't detected
+func fileID(info os.FileInfo) (dev, ino, nlink uint64, ok bool) {
+	return 0, 0, 0, false
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// filesystemType returns the type of the filesystem mounted at or above
+// path, as /proc/self/mounts lists it ("ext4", "exfat", "fuseblk" ...)
+func filesystemType(path string) string {
+	_, _, fstype := mountOf(path)
+	return fstype
+}
+
+// mountOf returns the mount point, the device (or other source) and the
+// type of the filesystem holding path, from /proc/self/mounts
+func mountOf(path string) (mount, device, fstype string) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", "", ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		point := unescapeMount(fields[1])
+		rel, err := filepath.Rel(point, path)
+		if err != nil || (rel != "." && !filepath.IsLocal(rel)) {
+			continue
+		}
+		// The deepest mount wins, and of the same mount point the last one
+		if len(point) >= len(mount) {
+			mount, device, fstype = point, unescapeMount(fields[0]), fields[2]
+		}
+	}
+	return mount, device, fstype
+}
+
+// unescapeMount undoes the octal escapes (\040 for a space) of a mount point
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+// filesystemType is not available on this platform, so only the platform's
+// own naming rules are checked
+func filesystemType(path string) string {
+	return ""
+}
+
+// mountOf is not available on this platform, so /info leaves the mount out
+func mountOf(path string) (mount, device, fstype string) {
+	return "", "", ""
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// gitTrackedOnly limits the catalog to files git knows about (-git-tracked-only)
+var gitTrackedOnly bool
+
+// gitFileSet lists the files of the git work tree at root that are tracked
+// or untracked-but-not-ignored, so files dir-mimic just moved stay in the
+// catalog before they are committed. dirs holds every folder above them.
+func gitFileSet(root string) (files, dirs map[string]bool, err error) {
+	cmd := exec.Command("git", "-C", root, "ls-files", "-z", "--cached", "--others", "--exclude-standard")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("-git-tracked-only: git ls-files failed in %s: %v %s", root, err, strings.TrimSpace(stderr.String()))
+	}
+
+	files = make(map[string]bool)
+	dirs = make(map[string]bool)
+	for _, p := range strings.Split(string(out), "\x00") {
+		if p == "" {
+			continue
+		}
+		files[p] = true
+		for dir := path.Dir(p); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	return files, dirs, nil
+}
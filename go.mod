@@ -1,3 +1,3 @@
-module dir-mimic
+module github.com/jokkebk/dir-mimic
 
 go 1.21
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateDir is -state-dir: where catalog snapshots and uploads waiting to be
+// imported are kept. Empty means the user cache directory.
+var stateDir string
+
+// snapshotIDFormat names snapshots by when they were taken, so they sort
+const snapshotIDFormat = "20060102-150405"
+
+// CatalogSnapshot is the catalog of a directory at one point in time
+type CatalogSnapshot struct {
+	Version   int         `json:"version"` // catalogVersion
+	Directory string      `json:"directory"`
+	Created   time.Time   `json:"created"`
+	Files     []FileEntry `json:"files"`
+}
+
+// SnapshotInfo describes a saved snapshot in the index
+type SnapshotInfo struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Files   int       `json:"files"`
+	Size    int64     `json:"size"`
+}
+
+// SnapshotMove is a file found at another path in the later snapshot
+type SnapshotMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Size int64  `json:"size"`
+}
+
+// SnapshotDiff is what changed in a directory between two snapshots.
+// Modified files are listed as they are in the later one.
+type SnapshotDiff struct {
+	From     string         `json:"from"`
+	To       string         `json:"to"`
+	Added    []FileEntry    `json:"added"`
+	Removed  []FileEntry    `json:"removed"`
+	Modified []FileEntry    `json:"modified"`
+	Moved    []SnapshotMove `json:"moved"`
+}
+
+// snapshotsMu keeps concurrent saves from losing each other's index entries
+var snapshotsMu sync.Mutex
+
+// snapshotDir is where the snapshots of a directory live
+func snapshotDir(dir string) (string, error) {
+	return stateSubdir("snapshots", dir)
+}
+
+// stateSubdir is where state of the given kind about a directory is kept:
+// one folder per directory, named after it plus a hash of its absolute path
+func stateSubdir(kind, dir string) (string, error) {
+	root := stateDir
+	if root == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		root = filepath.Join(cache, "dir-mimic")
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(abs))
+	return filepath.Join(root, kind, filepath.Base(abs)+"-"+hex.EncodeToString(sum[:4])), nil
+}
+
+// listSnapshots returns the saved snapshots of a directory, oldest first
+func listSnapshots(dir string) ([]SnapshotInfo, error) {
+	snapDir, err := snapshotDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(snapDir, "index.json"))
+	if os.IsNotExist(err) {
+		return []SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []SnapshotInfo
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", snapDir, err)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// saveSnapshot stores the files as a new snapshot of dir
+func saveSnapshot(dir string, files []FileEntry) (SnapshotInfo, error) {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+
+	snapDir, err := snapshotDir(dir)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	list, err := listSnapshots(dir)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := os.MkdirAll(snapDir, 0755); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	now := time.Now()
+	info := SnapshotInfo{ID: now.UTC().Format(snapshotIDFormat), Created: now, Files: len(files)}
+	// Two snapshots within a second get a suffix
+	for n := 2; containsSnapshot(list, info.ID); n++ {
+		info.ID = fmt.Sprintf("%s-%d", now.UTC().Format(snapshotIDFormat), n)
+	}
+	for _, e := range files {
+		info.Size += e.Size
+	}
+
+	abs, _ := filepath.Abs(dir)
+	f, err := os.Create(filepath.Join(snapDir, info.ID+".json.gz"))
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	zw := gzip.NewWriter(f)
+	err = json.NewEncoder(zw).Encode(CatalogSnapshot{Version: catalogVersion, Directory: abs, Created: now, Files: files})
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	data, _ := json.MarshalIndent(append(list, info), "", "  ")
+	tmp := filepath.Join(snapDir, "index.json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return SnapshotInfo{}, err
+	}
+	return info, os.Rename(tmp, filepath.Join(snapDir, "index.json"))
+}
+
+func containsSnapshot(list []SnapshotInfo, id string) bool {
+	for _, s := range list {
+		if s.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSnapshotID turns "latest" and "previous" into snapshot IDs and
+// checks that other IDs exist
+func resolveSnapshotID(list []SnapshotInfo, id string) (string, error) {
+	switch {
+	case id == "latest" && len(list) > 0:
+		return list[len(list)-1].ID, nil
+	case id == "previous" && len(list) > 1:
+		return list[len(list)-2].ID, nil
+	case containsSnapshot(list, id):
+		return id, nil
+	}
+	return "", fmt.Errorf("no snapshot %q (have %d)", id, len(list))
+}
+
+// loadSnapshot reads one saved snapshot of dir
+func loadSnapshot(dir, id string) (*CatalogSnapshot, error) {
+	snapDir, err := snapshotDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(snapDir, id+".json.gz"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s: %v", id, err)
+	}
+	snap := &CatalogSnapshot{}
+	if err := json.NewDecoder(zr).Decode(snap); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %v", id, err)
+	}
+	if err := checkVersion("catalog", snap.Version, catalogVersion); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %v", id, err)
+	}
+	snap.Files = upgradeCatalog(snap.Files, snap.Version)
+	return snap, nil
+}
+
+// diffSnapshots compares two catalogs of the same directory. A file gone
+// from one path and new at another with the same size and hash (or name and
+// size, without hashes) counts as moved, when that pairing is unambiguous.
+func diffSnapshots(before, after []FileEntry) SnapshotDiff {
+	diff := SnapshotDiff{Added: []FileEntry{}, Removed: []FileEntry{}, Modified: []FileEntry{}, Moved: []SnapshotMove{}}
+	old := make(map[string]FileEntry, len(before))
+	for _, e := range before {
+		old[e.Path] = e
+	}
+	var added []FileEntry
+	for _, e := range after {
+		prev, ok := old[e.Path]
+		switch {
+		case !ok:
+			added = append(added, e)
+		case prev.Size != e.Size || prev.MTime != e.MTime || (prev.Hash != "" && e.Hash != "" && prev.Hash != e.Hash):
+			diff.Modified = append(diff.Modified, e)
+		}
+		delete(old, e.Path)
+	}
+
+	moveKey := func(e FileEntry) string {
+		if e.Hash != "" {
+			return fmt.Sprintf("%d|%s", e.Size, e.Hash)
+		}
+		return fmt.Sprintf("%d|%s", e.Size, path.Base(e.Path))
+	}
+	gone := make(map[string][]FileEntry)
+	for _, e := range old {
+		gone[moveKey(e)] = append(gone[moveKey(e)], e)
+	}
+	arrived := make(map[string]int)
+	for _, e := range added {
+		arrived[moveKey(e)]++
+	}
+	for _, e := range added {
+		key := moveKey(e)
+		if from := gone[key]; len(from) == 1 && arrived[key] == 1 {
+			diff.Moved = append(diff.Moved, SnapshotMove{From: from[0].Path, To: e.Path, Size: e.Size})
+			delete(old, from[0].Path)
+			continue
+		}
+		diff.Added = append(diff.Added, e)
+	}
+	for _, e := range old {
+		diff.Removed = append(diff.Removed, e)
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Path < diff.Added[j].Path })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Path < diff.Removed[j].Path })
+	sort.Slice(diff.Modified, func(i, j int) bool { return diff.Modified[i].Path < diff.Modified[j].Path })
+	sort.Slice(diff.Moved, func(i, j int) bool { return diff.Moved[i].To < diff.Moved[j].To })
+	return diff
+}
+
+// compareSnapshots loads two snapshots of dir and diffs them
+func compareSnapshots(dir, fromID, toID string) (SnapshotDiff, error) {
+	list, err := listSnapshots(dir)
+	if err != nil {
+		return SnapshotDiff{}, err
+	}
+	if fromID, err = resolveSnapshotID(list, fromID); err != nil {
+		return SnapshotDiff{}, err
+	}
+	if toID, err = resolveSnapshotID(list, toID); err != nil {
+		return SnapshotDiff{}, err
+	}
+	from, err := loadSnapshot(dir, fromID)
+	if err != nil {
+		return SnapshotDiff{}, err
+	}
+	to, err := loadSnapshot(dir, toID)
+	if err != nil {
+		return SnapshotDiff{}, err
+	}
+	diff := diffSnapshots(from.Files, to.Files)
+	diff.From, diff.To = fromID, toID
+	return diff, nil
+}
+
+// printSnapshotDiff shows a snapshot diff in the terminal
+func printSnapshotDiff(dir string, diff SnapshotDiff) {
+	fmt.Printf("Changes in %s from %s to %s:\n", shellQuote(dir), diff.From, diff.To)
+	for _, e := range diff.Added {
+		fmt.Printf("  %s %s (%s)\n", colorize(colorGreen, "+"), shellQuote(e.Path), formatSize(e.Size))
+	}
+	for _, e := range diff.Removed {
+		fmt.Printf("  %s %s (%s)\n", colorize(colorRed, "-"), shellQuote(e.Path), formatSize(e.Size))
+	}
+	for _, e := range diff.Modified {
+		fmt.Printf("  %s %s\n", colorize(colorYellow, "~"), shellQuote(e.Path))
+	}
+	for _, m := range diff.Moved {
+		fmt.Printf("  %s %s -> %s\n", colorize(colorBlue, ">"), shellQuote(m.From), shellQuote(m.To))
+	}
+	fmt.Printf("Added %d, removed %d, modified %d, moved %d\n", len(diff.Added), len(diff.Removed), len(diff.Modified), len(diff.Moved))
+}
+
+// runSnapshot implements `dir-mimic snapshot save|list|diff`
+func runSnapshot(args []string) {
+	usage := "Usage: dir-mimic snapshot save [-H] [-state-dir dir] [-no-default-ignores] [-ignore patterns] <directory>\n" +
+		"       dir-mimic snapshot list [-state-dir dir] <directory>\n" +
+		"       dir-mimic snapshot diff [-state-dir dir] [-json] <directory> <from-id> [to-id]\n"
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("snapshot "+action, flag.ExitOnError)
+	state := fs.String("state-dir", "", "Keep snapshots here instead of the user cache directory")
+	hashFlag := fs.Bool("H", false, "Compute sample hashes, so moved files are recognized by content")
+	jsonOut := fs.Bool("json", false, "Print the diff as JSON")
+	noDefaultIgnores := fs.Bool("no-default-ignores", false, "Disable built-in ignore patterns")
+	extraIgnores := fs.String("ignore", "", "Extra ignore patterns (comma-separated, matched against filename)")
+	noColor := fs.Bool("no-color", false, "Don't use colors in terminal output (also disabled by NO_COLOR)")
+	fs.Parse(args[1:])
+	stateDir = *state
+	if *noColor {
+		useColor = false
+	}
+
+	switch {
+	case action == "save" && fs.NArg() == 1:
+		dir := fs.Arg(0)
+		ignorePatterns = buildIgnorePatterns(*noDefaultIgnores, *extraIgnores)
+		fmt.Fprintf(os.Stderr, "Scanning %s\n", dir)
+		scan, err := scanDirectory(dir, *hashFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error scanning %s: %v\n", dir, err)
+			os.Exit(1)
+		}
+		info, err := saveSnapshot(dir, scan.Files)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Saved snapshot %s: %d files, %s\n", info.ID, info.Files, formatSize(info.Size))
+	case action == "list" && fs.NArg() == 1:
+		list, err := listSnapshots(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, s := range list {
+			fmt.Printf("%s  %s  %d files, %s\n", s.ID, s.Created.Local().Format("2006-01-02 15:04"), s.Files, formatSize(s.Size))
+		}
+	case action == "diff" && (fs.NArg() == 2 || fs.NArg() == 3):
+		toID := "latest"
+		if fs.NArg() == 3 {
+			toID = fs.Arg(2)
+		}
+		diff, err := compareSnapshots(fs.Arg(0), fs.Arg(1), toID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(diff)
+		} else {
+			printSnapshotDiff(fs.Arg(0), diff)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+}
+
+// handleSnapshots lists the target's saved snapshots, oldest first
+func handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list, err := listSnapshots(targetDir)
+	if err != nil {
+		http.Error(w, "Listing snapshots failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleSnapshotSave saves the current catalog as a new snapshot
+func handleSnapshotSave(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	catalogMu.RLock()
+	files := append([]FileEntry{}, catalog...)
+	catalogMu.RUnlock()
+	info, err := saveSnapshot(targetDir, files)
+	if err != nil {
+		http.Error(w, "Saving the snapshot failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Saved snapshot %s: %d files\n", info.ID, info.Files)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// handleSnapshotDiff compares two snapshots of the target:
+// /snapshots/diff?from=ID&to=ID, where to defaults to the latest
+func handleSnapshotDiff(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if to == "" {
+		to = "latest"
+	}
+	diff, err := compareSnapshots(targetDir, from, to)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if strings.HasPrefix(err.Error(), "no snapshot") {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// languages are the values -lang accepts
+var languages = []string{"en", "de", "fi"}
+
+// lang is the language of terminal messages, also passed to the UI
+var lang = "en"
+
+// translations maps English terminal messages to other languages. Messages
+// without a translation are printed in English.
+var translations = map[string]map[string]string{
+	"de": {
+		"PLAN TO EXECUTE": "AUSZUFÜHRENDER PLAN",
+		"In short:":       "Kurz gesagt:",
+		"Summary: %d moves, %d copies, %d deletes, %d links, %d missing\n": "Übersicht: %d verschieben, %d kopieren, %d löschen, %d verknüpfen, %d fehlen\n",
+		"moved":   "verschoben",
+		"copied":  "kopiert",
+		"deleted": "gelöscht",
+		"video":   "Video",
+		"audio":   "Audio",
+		"images":  "Bilder",
+		"other":   "Andere",
+		"Imports: %d files are copied in from the source\n":                                     "Importe: %d Dateien werden von der Quelle hereinkopiert\n",
+		"Undo plan written to %s (%d operations, %d not undoable)\n":                            "Rückgängig-Plan in %s geschrieben (%d Operationen, %d nicht umkehrbar)\n",
+		"Placeholders: %d missing files get stubs until their data is copied\n":                 "Platzhalter: %d fehlende Dateien erhalten Stellvertreter, bis ihre Daten kopiert sind\n",
+		"Low confidence: %d operations below -review-below %.2f, check them before confirming":  "Unsicher: %d Operationen unter -review-below %.2f, bitte vor dem Bestätigen prüfen",
+		"Names: %d operations have paths the target's filesystem doesn't allow, they will fail": "Namen: %d Operationen haben Pfade, die das Dateisystem des Ziels nicht erlaubt, sie schlagen fehl",
+		"Long paths: %d destinations are longer than MAX_PATH":                                  "Lange Pfade: %d Ziele sind länger als MAX_PATH",
+		"Renamed %d destinations to names %s allows\n":                                          "%d Ziele umbenannt, sodass %s sie erlaubt\n",
+		"Deferred: %d operations on files in use by other applications":                         "Zurückgestellt: %d Operationen an Dateien, die andere Programme verwenden",
+		"Deletes run %s\n":              "Löschen läuft %s\n",
+		"Order: %s\n":                   "Reihenfolge: %s\n",
+		"Checksum: %s\n":                "Prüfsumme: %s\n",
+		"Estimated time: %s (%s)\n":     "Geschätzte Dauer: %s (%s)\n",
+		"based on previous runs":        "nach früheren Läufen",
+		"rough guess, no previous runs": "grobe Schätzung, keine früheren Läufe",
+		"To transfer from source: %s, about %s at %g Mbit/s\n":                 "Von der Quelle zu übertragen: %s, etwa %s bei %g Mbit/s\n",
+		"Execute this plan? [y/N]: ":                                           "Diesen Plan ausführen? [j/N]: ",
+		"Include it? [y/N] ":                                                   "Aufnehmen? [j/N] ",
+		"Confirmed by -assume-yes.":                                            "Bestätigt durch -assume-yes.",
+		"Source catalog received: %d files from %s\n":                          "Quellkatalog empfangen: %d Dateien von %s\n",
+		"Plan computed: %d operations\n":                                       "Plan berechnet: %d Operationen\n",
+		"Check before confirming:":                                             "Vor dem Bestätigen prüfen:",
+		"%d folders would be created, %d exist already\n":                      "%d Ordner würden angelegt, %d gibt es schon\n",
+		"Created %d folders, %d existed already\n":                             "%d Ordner angelegt, %d gab es schon\n",
+		"Asked %s to rescan %d folders\n":                                      "Habe %s gebeten, %d Ordner neu einzulesen\n",
+		"To execute this plan, type the first %d characters of its checksum: ": "Um diesen Plan auszuführen, gib die ersten %d Zeichen seiner Prüfsumme ein: ",
+		"That is not the checksum of this plan.":                               "Das ist nicht die Prüfsumme dieses Plans.",
+		"Plan queued, it runs when the apply window %s opens at %s\n":          "Plan wartet, er läuft, wenn das Ausführungsfenster %s um %s öffnet\n",
+		"Apply window open, running the queued plan %s":                        "Ausführungsfenster offen, der wartende Plan %s läuft",
+		"Apply window closed after %d of %d operations, the rest runs at %s\n": "Ausführungsfenster nach %d von %d Operationen geschlossen, der Rest läuft um %s\n",
+		"Queued plan %s cancelled after %d of %d operations\n":                 "Wartender Plan %s nach %d von %d Operationen abgebrochen\n",
+		"Skipping %d deletes, the server runs without -allow-deletes:":         "Überspringe %d Löschungen, der Server läuft ohne -allow-deletes:",
+		"Applying to %d targets at the same time:":                             "Anwenden auf %d Ziele gleichzeitig:",
+		", %d protected":                        ", %d geschützt",
+		", %d in use":                           ", %d in Benutzung",
+		", %d would fail (see apply -simulate)": ", %d würden fehlschlagen (siehe apply -simulate)",
+		"Target: %s":                            "Ziel: %s",
+		"Results per target:":                   "Ergebnisse pro Ziel:",
+		"snapshot failed, nothing done":         "Snapshot fehlgeschlagen, nichts getan",
+		"%d errors, %d deferred":                "%d Fehler, %d zurückgestellt",
+		"Several operations were denied access, likely by an antivirus scanner (Windows Defender) or the Search indexer opening new files. They are retried with growing pauses; excluding the target from real-time scanning and indexing while the plan runs avoids this.": "Mehrere Operationen wurden verweigert, wahrscheinlich weil ein Virenscanner (Windows Defender) oder die Windows-Suche neue Dateien geöffnet hat. Sie werden mit wachsenden Pausen wiederholt; das Ziel während des Plans von Echtzeitscan und Indizierung auszunehmen vermeidet das.",
+		"Retrying %d operations that were denied access...":                                            "Wiederhole %d verweigerte Operationen...",
+		"Inodes: %d needed, %d free on the target's filesystem":                                        "Inodes: %d benötigt, %d frei auf dem Dateisystem des Ziels",
+		"Checkpoint: %d of %d operations done. Continue, abort, or roll back what was done? [c/A/r]: ": "Checkpoint: %d von %d Operationen erledigt. Fortsetzen (c), abbrechen (a) oder Erledigtes zurücknehmen (r)? [c/A/r]: ",
+		"Rolling back %d operations...":                                                                "Nehme %d Operationen zurück...",
+		"Checkpoints: pauses every %d operations to ask whether to go on\n":                            "Checkpoints: hält alle %d Operationen an und fragt, ob es weitergehen soll\n",
+		"Runs in batches of %d operations, each one started through /apply/batch/next\n":               "Läuft in Stapeln von %d Operationen, jeder wird über /apply/batch/next gestartet\n",
+		"Batch: operations %d-%d of %d\n":                                                              "Stapel: Operationen %d-%d von %d\n",
+		"Paused after %d of %d operations, waiting for the next batch\n":                               "Pausiert nach %d von %d Operationen, warte auf den nächsten Stapel\n",
+		"Stopped after %d of %d operations, the rest will not run\n":                                   "Gestoppt nach %d von %d Operationen, der Rest wird nicht ausgeführt\n",
+		"Aborted.":       "Abgebrochen.",
+		"Executing...":   "Wird ausgeführt...",
+		"Done!":          "Fertig!",
+		"Nothing to do.": "Nichts zu tun.",
+		"Waiting for confirmation in the web UI...":         "Warte auf Bestätigung in der Weboberfläche...",
+		"Timed out waiting for web confirmation.":           "Zeitüberschreitung beim Warten auf die Bestätigung in der Weboberfläche.",
+		"Rescanning directory...\n":                         "Verzeichnis wird neu eingelesen...\n",
+		"Left out %d operations below -review-below %.2f\n": "%d Operationen unter -review-below %.2f ausgelassen\n",
+	},
+	"fi": {
+		"PLAN TO EXECUTE": "SUORITETTAVA SUUNNITELMA",
+		"In short:":       "Lyhyesti:",
+		"Summary: %d moves, %d copies, %d deletes, %d links, %d missing\n": "Yhteenveto: %d siirtoa, %d kopiota, %d poistoa, %d linkkiä, %d puuttuu\n",
+		"moved":   "siirretty",
+		"copied":  "kopioitu",
+		"deleted": "poistettu",
+		"video":   "video",
+		"audio":   "ääni",
+		"images":  "kuvat",
+		"other":   "muut",
+		"Imports: %d files are copied in from the source\n":                                     "Tuonnit: %d tiedostoa kopioidaan lähteestä\n",
+		"Undo plan written to %s (%d operations, %d not undoable)\n":                            "Kumoamissuunnitelma kirjoitettu tiedostoon %s (%d toimintoa, %d ei kumottavissa)\n",
+		"Placeholders: %d missing files get stubs until their data is copied\n":                 "Paikanvaraajat: %d puuttuvaa tiedostoa saa tyngän, kunnes niiden data kopioidaan\n",
+		"Low confidence: %d operations below -review-below %.2f, check them before confirming":  "Epävarmat: %d toimintoa alle -review-below %.2f, tarkista ne ennen vahvistamista",
+		"Names: %d operations have paths the target's filesystem doesn't allow, they will fail": "Nimet: %d toiminnon polkuja kohteen tiedostojärjestelmä ei salli, ne epäonnistuvat",
+		"Long paths: %d destinations are longer than MAX_PATH":                                  "Pitkät polut: %d kohdetta on pidempiä kuin MAX_PATH",
+		"Renamed %d destinations to names %s allows\n":                                          "Nimettiin uudelleen %d kohdetta nimille, jotka %s sallii\n",
+		"Deferred: %d operations on files in use by other applications":                         "Lykätty: %d toimintoa tiedostoille, jotka ovat muiden ohjelmien käytössä",
+		"Deletes run %s\n":              "Poistot ajetaan %s\n",
+		"Order: %s\n":                   "Järjestys: %s\n",
+		"Checksum: %s\n":                "Tarkistussumma: %s\n",
+		"Estimated time: %s (%s)\n":     "Arvioitu kesto: %s (%s)\n",
+		"based on previous runs":        "aiempien ajojen perusteella",
+		"rough guess, no previous runs": "karkea arvio, ei aiempia ajoja",
+		"To transfer from source: %s, about %s at %g Mbit/s\n":                 "Siirrettävää lähteestä: %s, noin %s nopeudella %g Mbit/s\n",
+		"Execute this plan? [y/N]: ":                                           "Suoritetaanko suunnitelma? [k/E]: ",
+		"Include it? [y/N] ":                                                   "Otetaanko mukaan? [k/E] ",
+		"Confirmed by -assume-yes.":                                            "Vahvistettu valitsimella -assume-yes.",
+		"Source catalog received: %d files from %s\n":                          "Lähdeluettelo vastaanotettu: %d tiedostoa kohteesta %s\n",
+		"Plan computed: %d operations\n":                                       "Suunnitelma laskettu: %d toimenpidettä\n",
+		"Check before confirming:":                                             "Tarkista ennen vahvistamista:",
+		"%d folders would be created, %d exist already\n":                      "%d kansiota luotaisiin, %d on jo olemassa\n",
+		"Created %d folders, %d existed already\n":                             "Luotiin %d kansiota, %d oli jo olemassa\n",
+		"Asked %s to rescan %d folders\n":                                      "Pyydettiin palvelinta %s lukemaan %d kansiota uudelleen\n",
+		"To execute this plan, type the first %d characters of its checksum: ": "Suorita suunnitelma kirjoittamalla sen tarkistussumman %d ensimmäistä merkkiä: ",
+		"That is not the checksum of this plan.":                               "Tämä ei ole tämän suunnitelman tarkistussumma.",
+		"Plan queued, it runs when the apply window %s opens at %s\n":          "Suunnitelma jonossa, se suoritetaan kun suoritusikkuna %s aukeaa %s\n",
+		"Apply window open, running the queued plan %s":                        "Suoritusikkuna auki, suoritetaan jonossa oleva suunnitelma %s",
+		"Apply window closed after %d of %d operations, the rest runs at %s\n": "Suoritusikkuna sulkeutui %d/%d toimenpiteen jälkeen, loput suoritetaan %s\n",
+		"Queued plan %s cancelled after %d of %d operations\n":                 "Jonossa oleva suunnitelma %s peruttiin %d/%d toimenpiteen jälkeen\n",
+		"Skipping %d deletes, the server runs without -allow-deletes:":         "Ohitetaan %d poistoa, palvelin on käynnissä ilman -allow-deletes:",
+		"Applying to %d targets at the same time:":                             "Sovelletaan %d kohteeseen yhtä aikaa:",
+		", %d protected":                        ", %d suojattu",
+		", %d in use":                           ", %d käytössä",
+		", %d would fail (see apply -simulate)": ", %d epäonnistuisi (katso apply -simulate)",
+		"Target: %s":                            "Kohde: %s",
+		"Results per target:":                   "Tulokset kohteittain:",
+		"snapshot failed, nothing done":         "tilannevedos epäonnistui, mitään ei tehty",
+		"%d errors, %d deferred":                "%d virhettä, %d siirretty myöhemmäksi",
+		"Several operations were denied access, likely by an antivirus scanner (Windows Defender) or the Search indexer opening new files. They are retried with growing pauses; excluding the target from real-time scanning and indexing while the plan runs avoids this.": "Useita toimintoja estettiin, luultavasti koska virustorjunta (Windows Defender) tai Windows-haun indeksointi avasi uusia tiedostoja. Niitä yritetään uudelleen kasvavin tauoin; kohteen jättäminen reaaliaikaisen tarkistuksen ja indeksoinnin ulkopuolelle suunnitelman ajaksi estää tämän.",
+		"Retrying %d operations that were denied access...":                                            "Yritetään uudelleen %d estettyä toimintoa...",
+		"Inodes: %d needed, %d free on the target's filesystem":                                        "Inodet: %d tarvitaan, %d vapaana kohteen tiedostojärjestelmässä",
+		"Checkpoint: %d of %d operations done. Continue, abort, or roll back what was done? [c/A/r]: ": "Tarkistuspiste: %d / %d operaatiota tehty. Jatka (c), keskeytä (a) vai peru tehdyt (r)? [c/A/r]: ",
+		"Rolling back %d operations...":                                                                "Perutaan %d operaatiota...",
+		"Checkpoints: pauses every %d operations to ask whether to go on\n":                            "Tarkistuspisteet: pysähtyy %d operaation välein kysymään, jatketaanko\n",
+		"Runs in batches of %d operations, each one started through /apply/batch/next\n":               "Suoritetaan %d operaation erissä, kukin käynnistetään osoitteella /apply/batch/next\n",
+		"Batch: operations %d-%d of %d\n":                                                              "Erä: operaatiot %d-%d / %d\n",
+		"Paused after %d of %d operations, waiting for the next batch\n":                               "Tauko %d / %d operaation jälkeen, odotetaan seuraavaa erää\n",
+		"Stopped after %d of %d operations, the rest will not run\n":                                   "Pysäytetty %d / %d operaation jälkeen, loppuja ei suoriteta\n",
+		"Aborted.":       "Keskeytetty.",
+		"Executing...":   "Suoritetaan...",
+		"Done!":          "Valmis!",
+		"Nothing to do.": "Ei tehtävää.",
+		"Waiting for confirmation in the web UI...":         "Odotetaan vahvistusta selainkäyttöliittymästä...",
+		"Timed out waiting for web confirmation.":           "Vahvistusta selainkäyttöliittymästä ei tullut ajoissa.",
+		"Rescanning directory...\n":                         "Luetaan hakemisto uudelleen...\n",
+		"Left out %d operations below -review-below %.2f\n": "Jätettiin pois %d toimintoa alle -review-below %.2f\n",
+	},
+}
+
+// yesWords are the answers that confirm a [y/N] prompt, per language
+var yesWords = map[string][]string{
+	"de": {"j", "ja"},
+	"fi": {"k", "kyllä"},
+}
+
+// tr returns the message in the -lang language
+func tr(msg string) string {
+	if t, ok := translations[lang][msg]; ok {
+		return t
+	}
+	return msg
+}
+
+// isYes reports whether a prompt answer confirms. English answers always
+// work, whatever the language.
+func isYes(answer string) bool {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes" || containsString(yesWords[lang], answer)
+}
+
+// setLang sets the message language from -lang, or from the environment
+// (LC_ALL, LC_MESSAGES, LANG) when the flag is empty
+func setLang(flagValue string) error {
+	if flagValue != "" {
+		if !containsString(languages, flagValue) {
+			return fmt.Errorf("-lang must be one of %s", strings.Join(languages, ", "))
+		}
+		lang = flagValue
+		return nil
+	}
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := os.Getenv(name); value != "" {
+			// "de_DE.UTF-8" -> "de"; "C" and unknown languages mean English
+			if code := strings.ToLower(value[:min(2, len(value))]); containsString(languages, code) {
+				lang = code
+			}
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// honorIgnoreFiles is -honor-ignore-files: the target's .stignore
+// (Syncthing) and .rsync-filter files (rsync -F) decide what is cataloged,
+// so dir-mimic agrees with the tools that maintain the directory
+var honorIgnoreFiles bool
+
+// Names of the ignore files, and Syncthing's own bookkeeping that never
+// belongs in the catalog
+const (
+	stignoreName    = ".stignore"
+	rsyncFilterName = ".rsync-filter"
+)
+
+var syncthingInternal = []string{".stignore", ".stfolder", ".stversions"}
+
+// ignoreRule is one line of an ignore file
+type ignoreRule struct {
+	base    string // Directory of the file the rule came from, relative to the root
+	re      *regexp.Regexp
+	include bool // "!pattern" or "+ pattern": not ignored, stop looking
+	dirOnly bool // "pattern/" (rsync)
+}
+
+// ignoreFileRules finds the rules that apply below the scan root. Rules
+// from a directory's .rsync-filter come before those of its parents, as
+// with rsync's dir-merge, and .stignore applies to everything.
+type ignoreFileRules struct {
+	root  string
+	mu    sync.Mutex
+	byDir map[string][]ignoreRule
+	top   []ignoreRule // From .stignore
+}
+
+func newIgnoreFileRules(root string) *ignoreFileRules {
+	r := &ignoreFileRules{root: root, byDir: make(map[string][]ignoreRule)}
+	r.top = parseIgnoreFile(filepath.Join(root, stignoreName), "", false, 0)
+	return r
+}
+
+// rulesFor returns the rules for entries of the directory dir ("" for the
+// root), most specific first
+func (r *ignoreFileRules) rulesFor(dir string) []ignoreRule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rulesForLocked(dir)
+}
+
+func (r *ignoreFileRules) rulesForLocked(dir string) []ignoreRule {
+	if rules, ok := r.byDir[dir]; ok {
+		return rules
+	}
+	own := parseIgnoreFile(filepath.Join(r.root, filepath.FromSlash(dir), rsyncFilterName), dir, true, 0)
+	var inherited []ignoreRule
+	if dir == "" {
+		inherited = r.top
+	} else {
+		parent := path.Dir(dir)
+		if parent == "." {
+			parent = ""
+		}
+		inherited = r.rulesForLocked(parent)
+	}
+	rules := append(own, inherited...)
+	r.byDir[dir] = rules
+	return rules
+}
+
+// ignored reports whether the entry at rel (slash-separated) is excluded
+func (r *ignoreFileRules) ignored(rel string, isDir bool) bool {
+	dir := path.Dir(rel)
+	if dir == "." {
+		if containsString(syncthingInternal, rel) {
+			return true
+		}
+		dir = ""
+	}
+	for _, rule := range r.rulesFor(dir) {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		sub := rel
+		if rule.base != "" {
+			sub = strings.TrimPrefix(rel, rule.base+"/")
+		}
+		if rule.re.MatchString(sub) {
+			return !rule.include
+		}
+	}
+	return false
+}
+
+// parseIgnoreFile reads a .stignore (rsync == false) or .rsync-filter file.
+// Missing files have no rules. Unsupported lines (rsync merge rules and
+// modifiers, Syncthing (?d) and the like) are skipped.
+func parseIgnoreFile(file, base string, rsync bool, depth int) []ignoreRule {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		var rule ignoreRule
+		rule.base = base
+		foldCase := false
+
+		if rsync {
+			if line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(line, "- "), strings.HasPrefix(line, "exclude "):
+			case strings.HasPrefix(line, "+ "), strings.HasPrefix(line, "include "):
+				rule.include = true
+			default:
+				continue
+			}
+			line = line[strings.IndexByte(line, ' ')+1:]
+		} else {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "//") {
+				continue
+			}
+			if name, ok := strings.CutPrefix(line, "#include "); ok && depth < 8 {
+				rules = append(rules, parseIgnoreFile(filepath.Join(filepath.Dir(file), strings.TrimSpace(name)), base, false, depth+1)...)
+				continue
+			}
+			if line[0] == '#' {
+				continue
+			}
+			if rest, ok := strings.CutPrefix(line, "!"); ok {
+				rule.include, line = true, rest
+			}
+			for strings.HasPrefix(line, "(?") {
+				end := strings.IndexByte(line, ')')
+				if end < 0 {
+					break
+				}
+				foldCase = foldCase || line[:end+1] == "(?i)"
+				line = line[end+1:]
+			}
+		}
+
+		if strings.HasSuffix(line, "/") && len(line) > 1 {
+			rule.dirOnly, line = rsync, strings.TrimSuffix(line, "/")
+		}
+		rule.re = compileIgnorePattern(line, foldCase)
+		if rule.re != nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// compileIgnorePattern turns a glob into a regexp matched against a path
+// relative to the rule's directory. A leading "/" anchors the pattern
+// there; otherwise it matches the last components of the path. "**"
+// crosses directories, "*" and "?" don't.
+func compileIgnorePattern(pattern string, foldCase bool) *regexp.Regexp {
+	anchored := strings.HasPrefix(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return nil
+	}
+
+	var b strings.Builder
+	if foldCase {
+		b.WriteString("(?i)")
+	}
+	if anchored {
+		b.WriteString("^")
+	} else {
+		b.WriteString("(^|/)")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil
+	}
+	return re
+}
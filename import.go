@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// An import brings data from outside the target into it, which is what a
+// missing or updated file needs. Where the data comes from is the
+// operation's Source:
+//
+//   - "" (the default): From is a path under -source-dir, the source's files
+//     on a drive the server can read
+//   - "upload": From is a path the browser sent the file to /upload for
+//   - "url": From is an http(s) URL, like another dir-mimic's /file, on a
+//     host the server may fetch from (see importHosts)
+//
+// Every import is written to a temporary name next to its destination,
+// checked against the expected size (and SHA256, when the plan has one) and
+// only then renamed into place, with the source's mtime, so a failed or
+// corrupted transfer never leaves a partial file behind.
+
+// sourceDir is -source-dir: the source's data on a drive the server can
+// read, like a USB disk with the original folder. Missing and updated files
+// in a plan are imported from it instead of left for rsync.
+var sourceDir string
+
+// setupSourceDir checks -source-dir and makes it absolute
+func setupSourceDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+		return fmt.Errorf("-source-dir %s is not a directory", dir)
+	}
+	if abs == targetDir {
+		return fmt.Errorf("-source-dir is the target itself")
+	}
+	sourceDir = abs
+	return nil
+}
+
+// hostList is the repeatable -import-host flag
+type hostList []string
+
+func (l *hostList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *hostList) Set(value string) error {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" || strings.Contains(value, "/") {
+		return fmt.Errorf("invalid host %q, expected host or host:port", value)
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+// importHosts are the -import-host hosts imports with source "url" may
+// fetch from. The server would fetch any URL a plan names otherwise, so
+// without them only the host of -source-catalog-url is allowed.
+var importHosts hostList
+
+// maxUploadBytes is -max-upload-size, the largest file /upload takes
+var maxUploadBytes = int64(64 << 30)
+
+// importStallTimeout is how long a URL import may go without receiving
+// anything before it fails. There is no limit on the whole download, a
+// large file takes as long as it takes.
+const importStallTimeout = time.Minute
+
+// importClient fetches URL imports; importStallTimeout covers the response
+// and the data, these the connection
+var importClient = &http.Client{Transport: &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	DialContext:         (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+	TLSHandshakeTimeout: 30 * time.Second,
+}}
+
+// importHostAllowed reports whether a URL import may fetch from u's host:
+// one of importHosts (by name, or name and port), or that of the source
+// catalog URL
+func importHostAllowed(u *url.URL) bool {
+	host, name := strings.ToLower(u.Host), strings.ToLower(u.Hostname())
+	if sourceCatalogURL != "" {
+		if src, err := url.Parse(sourceCatalogURL); err == nil && strings.ToLower(src.Host) == host {
+			return true
+		}
+	}
+	return containsString(importHosts, host) || containsString(importHosts, name)
+}
+
+// stallReader reads a download, restarting the stall timer with each read
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.timer.Reset(importStallTimeout)
+	return n, err
+}
+
+// fetchImport downloads a URL import into the target, failing it when the
+// server sends nothing for importStallTimeout
+func (t *applyTarget) fetchImport(op Operation, mtime time.Time) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var stalled atomic.Bool
+	timer := time.AfterFunc(importStallTimeout, func() {
+		stalled.Store(true)
+		cancel()
+	})
+	defer timer.Stop()
+	stallErr := func(err error) error {
+		if stalled.Load() {
+			return fmt.Errorf("nothing received for %s", importStallTimeout)
+		}
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, op.From, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := importClient.Do(req)
+	if err != nil {
+		return "", stallErr(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", op.From, resp.Status)
+	}
+	size := op.Size
+	if size == 0 {
+		size = resp.ContentLength // -1 when the server doesn't say
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && op.MTime == 0 {
+		mtime = modified
+	}
+	backup, err := t.importInto(&stallReader{r: resp.Body, timer: timer}, op.To, size, op.SHA256, 0644, mtime)
+	return backup, stallErr(err)
+}
+
+// sourcePath returns where a source-relative path is under -source-dir
+func sourcePath(rel string) (string, error) {
+	if sourceDir == "" {
+		return "", fmt.Errorf("no -source-dir to import from")
+	}
+	if !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("path outside source directory: %s", rel)
+	}
+	return filepath.Join(sourceDir, filepath.FromSlash(rel)), nil
+}
+
+// validateImport checks an import's source before it is accepted into a plan
+func validateImport(op Operation) error {
+	switch op.Source {
+	case "", "upload":
+		if !filepath.IsLocal(filepath.FromSlash(op.From)) {
+			return fmt.Errorf("import %s: path outside source directory", op.From)
+		}
+	case "url":
+		u, err := url.Parse(op.From)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("import %s: not an http(s) URL", op.From)
+		}
+		if !importHostAllowed(u) {
+			return fmt.Errorf("import %s: %s is not an -import-host of this server", op.From, u.Host)
+		}
+	default:
+		return fmt.Errorf("import %s: unknown source %q", op.From, op.Source)
+	}
+	return nil
+}
+
+// importFromSource turns the plan's missing and update operations into
+// imports from -source-dir, for the files that are there. The rest stay
+// missing.
+func importFromSource(ops []Operation) []Operation {
+	if sourceDir == "" {
+		return ops
+	}
+	out := make([]Operation, 0, len(ops))
+	for _, op := range ops {
+		if op.Type == "missing" || op.Type == "update" {
+			if full, err := sourcePath(op.From); err == nil {
+				if info, err := os.Stat(full); err == nil && info.Mode().IsRegular() {
+					reason := "missing on the target"
+					if op.Type == "update" {
+						reason = "outdated on the target"
+					}
+					op = Operation{Type: "import", From: op.From, To: op.From, Size: info.Size(), Reason: reason}
+				}
+			}
+		}
+		out = append(out, op)
+	}
+	return out
+}
+
+// importLabel describes where an import's data comes from, for the terminal
+func importLabel(op Operation) string {
+	switch op.Source {
+	case "upload":
+		return "uploaded"
+	case "url":
+		return op.From
+	}
+	return filepath.Join(sourceDir, filepath.FromSlash(op.From))
+}
+
+// executeImport copies an import's data into the target and returns the
+// backup of the file it replaced, if one was kept
+func (t *applyTarget) executeImport(op Operation) (string, error) {
+	mtime := time.Now()
+	if op.MTime > 0 {
+		mtime = time.UnixMilli(op.MTime)
+	}
+
+	// With -stage-dir, data imported before isn't fetched again
+	if entry := stagedPath(op.SHA256); entry != "" {
+		backup, err := t.importStaged(entry, op)
+		if err == nil && op.Source == "upload" {
+			if staged, err := uploadPath(op.From); err == nil {
+				os.Remove(staged)
+			}
+		}
+		return backup, err
+	}
+
+	switch op.Source {
+	case "url":
+		return t.fetchImport(op, mtime)
+	case "upload":
+		staged, err := uploadPath(op.From)
+		if err != nil {
+			return "", err
+		}
+		backup, err := t.importFile(staged, op, mtime)
+		if err == nil {
+			os.Remove(staged)
+		}
+		return backup, err
+	}
+
+	src, err := sourcePath(op.From)
+	if err != nil {
+		return "", err
+	}
+	return t.importFile(src, op, time.Time{})
+}
+
+// importStaged puts a cached copy of an import's data in place, with the
+// operation's mtime when it has its own inode
+func (t *applyTarget) importStaged(entry string, op Operation) (string, error) {
+	dst, err := resolveOpPath(t.dir, op.To)
+	if err != nil {
+		return "", err
+	}
+	t.printf("  %s %s\n", colorize(colorDim, "cached:"), shellQuote(op.To))
+	backup, err := t.backupExisting(op.To)
+	if err != nil {
+		return "", err
+	}
+	own, err := cloneFromStage(entry, dst)
+	if err == nil && own && op.MTime > 0 {
+		err = os.Chtimes(dst, time.Now(), time.UnixMilli(op.MTime))
+	}
+	return backup, err
+}
+
+// importFile imports a local file. A zero mtime means the file's own.
+func (t *applyTarget) importFile(src string, op Operation, mtime time.Time) (string, error) {
+	in, info, err := openRegular(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	if mtime.IsZero() {
+		mtime = info.ModTime()
+	}
+	size := op.Size
+	if size == 0 {
+		size = info.Size()
+	}
+	return t.importInto(in, op.To, size, op.SHA256, info.Mode(), mtime)
+}
+
+// importInto writes r to rel in the target, replacing (and with
+// -backup-dir/-backup-suffix keeping) what is there. The data is written to
+// a temporary file first and must come to size bytes (unless that is -1,
+// unknown), and hash to sum when that is given, before it is renamed into
+// place.
+func (t *applyTarget) importInto(r io.Reader, rel string, size int64, sum string, mode os.FileMode, mtime time.Time) (string, error) {
+	dst, err := resolveOpPath(t.dir, rel)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".dir-mimic-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	progress := t.newImportProgress(io.TeeReader(r, h), rel, size)
+	n, err := io.Copy(tmp, progress)
+	progress.finish()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	switch {
+	case err != nil:
+	case size >= 0 && n != size:
+		err = fmt.Errorf("got %d bytes, expected %d", n, size)
+	case sum != "" && got != sum:
+		err = fmt.Errorf("SHA-256 mismatch, the data was corrupted on the way")
+	}
+	if err == nil {
+		os.Chmod(tmp.Name(), mode)
+		err = os.Chtimes(tmp.Name(), time.Now(), mtime)
+	}
+	var backup string
+	if err == nil {
+		backup, err = t.backupExisting(rel)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	} else {
+		stageFile(got, dst)
+	}
+	return backup, err
+}
+
+// uploadPath is where an uploaded file waits to be imported: in the state
+// directory, never in the target, so a plan that isn't confirmed leaves the
+// target alone
+func uploadPath(rel string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("path outside source directory: %s", rel)
+	}
+	dir, err := stateSubdir("uploads", targetDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(rel)), nil
+}
+
+// handleUpload stores the request body as the file at ?path=, for a
+// following plan's import with source "upload"
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rel := r.URL.Query().Get("path")
+	staged, err := uploadPath(rel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+		http.Error(w, "Upload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmp := staged + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		http.Error(w, "Upload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(f, http.MaxBytesReader(w, r.Body, maxUploadBytes))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, staged)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Upload larger than -max-upload-size", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Upload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": rel, "size": n})
+}
+
+// handleFile serves a cataloged file of the target, so another dir-mimic can
+// import from this one with source "url". It hands out the files' data, not
+// just the catalog, so it takes the operator role.
+func handleFile(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rel := r.URL.Query().Get("path")
+	catalogMu.RLock()
+	cataloged := catalogPaths[rel]
+	catalogMu.RUnlock()
+	if !cataloged {
+		http.Error(w, "Not in the catalog", http.StatusNotFound)
+		return
+	}
+	full, err := resolvePath(rel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, info, err := openRegular(full)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, filepath.Base(full), info.ModTime(), f)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+// TargetInfo describes the directory the server serves and the disk it is
+// on, so whoever is about to apply a plan can check it is the right one
+type TargetInfo struct {
+	Path        string `json:"path"`
+	Host        string `json:"host,omitempty"`
+	FileCount   int    `json:"fileCount"`
+	FolderCount int    `json:"folderCount"`
+	TotalSize   int64  `json:"totalSize"`
+	FreeSpace   int64  `json:"freeSpace,omitempty"`  // Available to unprivileged users
+	DiskSize    int64  `json:"diskSize,omitempty"`   // Size of the filesystem
+	Filesystem  string `json:"filesystem,omitempty"` // e.g. "ext4", Linux only
+	Device      string `json:"device,omitempty"`     // e.g. "/dev/sdb1", Linux only
+	MountPoint  string `json:"mountPoint,omitempty"`
+	Seq         int64  `json:"seq"`
+	LastScan    int64  `json:"lastScan,omitempty"` // When the catalog was scanned (Unix ms), missing during the first scan
+}
+
+// handleInfo returns the TargetInfo of the served directory
+func handleInfo(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info := TargetInfo{Path: targetDir}
+	info.Host, _ = os.Hostname()
+	catalogMu.RLock()
+	info.FileCount = len(catalog)
+	info.FolderCount, info.TotalSize = catalogStats(catalog)
+	info.Seq = catalogSeq
+	if catalogSeq > 0 {
+		info.LastScan = catalogScanned.UnixMilli()
+	}
+	catalogMu.RUnlock()
+	info.FreeSpace, _ = freeSpace(targetDir)
+	info.DiskSize, _ = totalSpace(targetDir)
+	info.MountPoint, info.Device, info.Filesystem = mountOf(targetDir)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
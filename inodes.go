@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// InodeBudget is how many inodes a plan takes on the target's filesystem
+// and how many are left there. Small ext4 volumes can run out of inodes
+// long before they run out of space, and a plan creating many small files
+// or placeholders then fails halfway.
+type InodeBudget struct {
+	Needed int64 `json:"needed"` // The peak while it runs; negative when the plan only frees inodes
+	Free   int64 `json:"free"`
+}
+
+// fits reports whether the plan's inodes are available
+func (b InodeBudget) fits() bool {
+	return b.Needed <= b.Free
+}
+
+// inodeDelta estimates how many more inodes the target uses at the worst
+// point while ops run in the given (execution) order: one per new file,
+// symlink and folder, one less per delete. A copy over an existing file
+// reuses its inode unless the old file is kept as a backup, and a link
+// replacing a duplicate frees the duplicate's. Moves and renames take none.
+// Deletes only help once they have run, so with -delete-order last the
+// creates count in full. A plan that never takes more than it frees returns
+// its net change.
+func inodeDelta(ops []Operation) int64 {
+	keepsOld := backupDir != "" || backupSuffix != ""
+	onDisk := func(rel string) bool {
+		_, err := os.Lstat(filepath.Join(targetDir, filepath.FromSlash(rel)))
+		return err == nil
+	}
+	var delta, peak int64
+	newDirs := make(map[string]bool)
+	addParents := func(rel string) {
+		for dir := path.Dir(rel); dir != "." && dir != "/" && !newDirs[dir]; dir = path.Dir(dir) {
+			if info, err := os.Stat(filepath.Join(targetDir, filepath.FromSlash(dir))); err == nil && info.IsDir() {
+				break
+			}
+			newDirs[dir] = true
+			delta++
+		}
+	}
+
+	for _, op := range ops {
+		switch op.Type {
+		case "cp", "import":
+			if !onDisk(op.To) || keepsOld {
+				delta++
+			}
+		case "placeholder":
+			if !onDisk(op.From) {
+				delta++
+			}
+		case "symlink":
+			if !onDisk(op.To) {
+				delta++
+			}
+		case "hardlink":
+			if onDisk(op.To) {
+				delta--
+			}
+		case "rm":
+			delta--
+		}
+		if dst := destination(op); dst != "" {
+			addParents(dst)
+		}
+		if delta > peak {
+			peak = delta
+		}
+	}
+	if peak == 0 {
+		return delta
+	}
+	return peak
+}
+
+// inodeBudget returns the inode budget of ops in execution order, or false when the target's
+// filesystem doesn't say how many inodes it has left
+func inodeBudget(ops []Operation) (InodeBudget, bool) {
+	free, ok := freeInodes(targetDir)
+	if !ok {
+		return InodeBudget{}, false
+	}
+	return InodeBudget{Needed: inodeDelta(ops), Free: free}, true
+}
+
+// checkInodes refuses a plan that needs more inodes than the target has left
+func checkInodes(ops []Operation) error {
+	if b, ok := inodeBudget(ops); ok && !b.fits() {
+		return fmt.Errorf("the plan needs %d inodes for new files and folders, but the target's filesystem has only %d left; delete files there or use a filesystem with more inodes", b.Needed, b.Free)
+	}
+	return nil
+}
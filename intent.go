@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Intent is a group of operations that together do one thing a person would
+// name, like renaming a folder or cleaning up duplicates in it
+type Intent struct {
+	Summary string
+	Count   int
+}
+
+// minIntentOps is how many operations it takes to make a group; single
+// operations are read as they are
+const minIntentOps = 2
+
+// folderLabel names a folder of the target for intent summaries
+func folderLabel(dir string) string {
+	if dir == "." || dir == "" {
+		return "/"
+	}
+	return "/" + dir
+}
+
+// plural is "1 file" or "3 files"
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return "1 " + one
+	}
+	return fmt.Sprintf("%d %s", n, many)
+}
+
+// folderMoveLabel describes moving the files of one folder into another
+func folderMoveLabel(from, to string) string {
+	switch {
+	case path.Dir(from) == path.Dir(to):
+		return fmt.Sprintf("Folder '%s' renamed to '%s'", path.Base(from), path.Base(to))
+	case path.Base(from) == path.Base(to):
+		return fmt.Sprintf("Folder %s moved into %s", folderLabel(from), folderLabel(path.Dir(to)))
+	}
+	return fmt.Sprintf("Folder %s moved to %s", folderLabel(from), folderLabel(to))
+}
+
+// inferIntents groups the plan into intents, largest first. Moves between
+// the same two folders are a folder move or rename (subfolders moving along
+// count towards their parent), and deletes, copies, links and missing files
+// are grouped by folder. Operations that don't fall into a group of
+// minIntentOps are counted in a final "other" entry.
+func inferIntents(ops []Operation) []Intent {
+	type group struct {
+		label string
+		count int
+		unit  [2]string
+	}
+	groups := make(map[string]*group)
+	var keys []string
+	add := func(key, label string, unit [2]string) {
+		g, ok := groups[key]
+		if !ok {
+			g = &group{label: label, unit: unit}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.count++
+	}
+
+	// Folder pairs that files move between directly
+	movePairs := make(map[[2]string]bool)
+	for _, op := range ops {
+		if op.Type == "mv" && path.Dir(op.From) != path.Dir(op.To) {
+			movePairs[[2]string{path.Dir(op.From), path.Dir(op.To)}] = true
+		}
+	}
+
+	for _, op := range ops {
+		switch op.Type {
+		case "mv":
+			from, to := path.Dir(op.From), path.Dir(op.To)
+			if from == to {
+				add("rename|"+from, "Files renamed in "+folderLabel(from), [2]string{"file", "files"})
+				continue
+			}
+			// Season 01/Extras -> S01/Extras is part of Season 01 -> S01
+			for path.Base(from) == path.Base(to) && path.Dir(from) != "." && path.Dir(to) != "." &&
+				movePairs[[2]string{path.Dir(from), path.Dir(to)}] {
+				from, to = path.Dir(from), path.Dir(to)
+			}
+			add("mv|"+from+"|"+to, folderMoveLabel(from, to), [2]string{"file", "files"})
+		case "rm":
+			dir := path.Dir(op.From)
+			if strings.HasPrefix(op.Reason, "extra copy") {
+				add("dupe|"+dir, "Duplicate cleanup in "+folderLabel(dir), [2]string{"delete", "deletes"})
+			} else {
+				add("rm|"+dir, "Files removed from "+folderLabel(dir), [2]string{"delete", "deletes"})
+			}
+		case "cp":
+			from, to := path.Dir(op.From), path.Dir(op.To)
+			add("cp|"+from+"|"+to, "Copies from "+folderLabel(from)+" into "+folderLabel(to), [2]string{"file", "files"})
+		case "symlink", "hardlink":
+			dir := path.Dir(op.To)
+			add("ln|"+dir, "Duplicates in "+folderLabel(dir)+" replaced by links", [2]string{"link", "links"})
+		case "missing", "update", "placeholder", "import":
+			dir := path.Dir(op.From)
+			add("missing|"+dir, "Files to bring over from the source into "+folderLabel(dir), [2]string{"file", "files"})
+		default:
+			add("other|"+op.Type, "", [2]string{})
+		}
+	}
+
+	var intents []Intent
+	other := 0
+	for _, key := range keys {
+		g := groups[key]
+		if g.count < minIntentOps || g.label == "" {
+			other += g.count
+			continue
+		}
+		intents = append(intents, Intent{
+			Summary: g.label + " — " + plural(g.count, g.unit[0], g.unit[1]),
+			Count:   g.count,
+		})
+	}
+	sort.SliceStable(intents, func(i, j int) bool { return intents[i].Count > intents[j].Count })
+	if other > 0 && len(intents) > 0 {
+		intents = append(intents, Intent{Summary: plural(other, "other operation", "other operations"), Count: other})
+	}
+	return intents
+}
+
+// printIntents lists the plan's intents ahead of the operations, so a big
+// plan can be read as a handful of actions
+func printIntents(ops []Operation) {
+	intents := inferIntents(ops)
+	if len(intents) == 0 {
+		return
+	}
+	fmt.Println(colorize(colorBold, tr("In short:")))
+	for _, intent := range intents {
+		fmt.Println("  " + printable(intent.Summary))
+	}
+	fmt.Println(strings.Repeat("-", 60))
+}
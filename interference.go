@@ -0,0 +1,44 @@
+package main
+
+import "time"
+
+// On Windows, Defender and the Search indexer open files as soon as they
+// are written, and for a moment moving, replacing or deleting them is
+// denied. Such an operation is retried a few times with growing pauses, and
+// if it is still denied, once more after the rest of the plan; only then is
+// it deferred like a file in use, rather than reported as an error.
+
+// deniedBackoff are the pauses before each retry of a denied operation
+var deniedBackoff = []time.Duration{
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	4 * time.Second,
+}
+
+// deniedHintAfter is how many denied operations in a plan make the likely
+// culprits worth naming
+const deniedHintAfter = 3
+
+// deniedOp is an operation still denied after its retries, waiting for the
+// end of the plan
+type deniedOp struct {
+	op       Operation
+	replaced bool   // Its destination existed before
+	backup   string // Where what it replaces was kept
+}
+
+// retryDenied runs an operation again while it is denied access and
+// returns the outcome of the last try
+func (t *applyTarget) retryDenied(op Operation) (string, error) {
+	var backup string
+	var err error
+	for _, pause := range deniedBackoff {
+		time.Sleep(pause)
+		if backup, err = t.runOperation(op); err == nil || !isAccessDenied(err) {
+			break
+		}
+	}
+	return backup, err
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// isAccessDenied is always false here: open files don't block moves and
+// deletes, so a denial is a real permission problem and retrying won't help
+func isAccessDenied(err error) bool {
+	return false
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// layoutVersion is the version of folder layout templates
+const layoutVersion = 1
+
+// Layout is a folder structure without its files, as /export?format=folders
+// writes it and "dir-mimic layout" creates it on another drive
+type Layout struct {
+	Version int      `json:"version"`
+	Path    string   `json:"path,omitempty"` // Where it was exported from
+	Folders []string `json:"folders"`        // Every folder, parents before their subfolders
+}
+
+// layoutFolders returns the folders the target holds once ops ran, missing
+// files included: the layout the plan makes
+func layoutFolders(files []FileEntry, ops []Operation) []string {
+	sim := simulatePlan(files, ops)
+	dirs := make(map[string]bool, len(sim.folders))
+	for dir := range sim.folders {
+		dirs[dir] = true
+	}
+	for _, op := range ops {
+		if op.Type == "missing" {
+			for dir := path.Dir(op.From); dir != "."; dir = path.Dir(dir) {
+				dirs[dir] = true
+			}
+		}
+	}
+	folders := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		folders = append(folders, dir)
+	}
+	sort.Strings(folders)
+	return folders
+}
+
+// leafFolders leaves out the folders that another one is inside of, which
+// mkdir -p creates anyway
+func leafFolders(folders []string) []string {
+	parents := make(map[string]bool)
+	for _, dir := range folders {
+		parents[path.Dir(dir)] = true
+	}
+	var leaves []string
+	for _, dir := range folders {
+		if !parents[dir] {
+			leaves = append(leaves, dir)
+		}
+	}
+	return leaves
+}
+
+// writeLayout writes folders as a JSON template, or as a shell script of
+// mkdir -p commands with format "mkdir"
+func writeLayout(w http.ResponseWriter, folders []string, format string) {
+	if format == "mkdir" {
+		w.Header().Set("Content-Type", "text/x-shellscript; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="dir-mimic-layout.sh"`)
+		fmt.Fprintf(w, "#!/bin/sh\n# Folder layout of %s, run it in the folder to create it in\nset -e\n", targetDir)
+		for _, dir := range leafFolders(folders) {
+			fmt.Fprintf(w, "mkdir -p -- %s\n", shellQuote(dir))
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="dir-mimic-layout.json"`)
+	json.NewEncoder(w).Encode(Layout{Version: layoutVersion, Path: targetDir, Folders: folders})
+}
+
+// runLayoutCommand creates the folders of a layout template in a directory,
+// e.g. a new empty drive
+func runLayoutCommand(args []string) {
+	fs := flag.NewFlagSet("layout", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only list the folders that would be created")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: dir-mimic layout [-dry-run] <layout.json|-> <directory>\n")
+		os.Exit(1)
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+	var layout Layout
+	if err := json.NewDecoder(in).Decode(&layout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid layout: %v\n", err)
+		os.Exit(1)
+	}
+	if layout.Version > layoutVersion {
+		fmt.Fprintf(os.Stderr, "Error: layout version %d is newer than this dir-mimic understands (%d), upgrade dir-mimic\n", layout.Version, layoutVersion)
+		os.Exit(1)
+	}
+	dir, err := filepath.Abs(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting absolute path: %v\n", err)
+		os.Exit(1)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "Error: %s is not a directory\n", dir)
+		os.Exit(1)
+	}
+
+	created, existed := 0, 0
+	for _, rel := range layout.Folders {
+		// A template is data from elsewhere: it may not reach outside dir
+		clean := path.Clean(rel)
+		if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			fmt.Fprintf(os.Stderr, "Error: %q is not a folder inside the directory\n", rel)
+			os.Exit(1)
+		}
+		full := filepath.Join(dir, filepath.FromSlash(clean))
+		if info, err := os.Stat(full); err == nil && info.IsDir() {
+			existed++
+			continue
+		}
+		created++
+		if *dryRun {
+			fmt.Println(full)
+			continue
+		}
+		if err := os.MkdirAll(full, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *dryRun {
+		fmt.Printf(tr("%d folders would be created, %d exist already\n"), created, existed)
+		return
+	}
+	fmt.Printf(tr("Created %d folders, %d existed already\n"), created, existed)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LintWarning is a pattern in a plan that is probably not what was meant,
+// like deleting a whole top-level folder. Warnings don't stop the plan, they
+// are shown with it before it is confirmed.
+type LintWarning struct {
+	Kind    string // "top-folder-deleted", "into-deleted-folder" or "many-copies"
+	Message string
+}
+
+// lintManyCopies is how many copies of one file make a warning
+const lintManyCopies = 100
+
+// lintPlan looks for suspicious patterns in a plan for a target holding
+// files: a top-level folder emptied by it, files moved or copied into a
+// folder whose files are all deleted, and one file copied lintManyCopies
+// times or more
+func lintPlan(ops []Operation, files []FileEntry) []LintWarning {
+	// Files below each folder, before and leaving by the plan
+	below := make(map[string]int)
+	for _, f := range files {
+		for dir := path.Dir(filepath.ToSlash(f.Path)); dir != "."; dir = path.Dir(dir) {
+			below[dir]++
+		}
+	}
+	deleted := make(map[string]int)
+	movedOut := make(map[string]int) // Top-level folder -> files moved out of it
+	arriving := make(map[string]bool)
+	copies := make(map[string]int)
+	for _, op := range ops {
+		switch op.Type {
+		case "rm":
+			for dir := path.Dir(op.From); dir != "."; dir = path.Dir(dir) {
+				deleted[dir]++
+			}
+		case "mv":
+			if top := topFolder(op.From); top != topFolder(op.To) {
+				movedOut[top]++
+			}
+		case "cp":
+			copies[op.From]++
+		}
+		if op.To != "" {
+			arriving[topFolder(op.To)] = true
+		}
+	}
+
+	var warnings []LintWarning
+	var tops []string
+	for dir := range below {
+		if !strings.Contains(dir, "/") {
+			tops = append(tops, dir)
+		}
+	}
+	sort.Strings(tops)
+	for _, top := range tops {
+		n := below[top]
+		switch {
+		case deleted[top] == 0 || arriving[top] || deleted[top]+movedOut[top] < n:
+		case deleted[top] == n:
+			warnings = append(warnings, LintWarning{"top-folder-deleted",
+				fmt.Sprintf("Deletes the whole top-level folder %s (%s)", folderLabel(top), plural(n, "file", "files"))})
+		default:
+			warnings = append(warnings, LintWarning{"top-folder-deleted",
+				fmt.Sprintf("Empties the top-level folder %s: %s deleted, %d moved elsewhere", folderLabel(top), plural(deleted[top], "file", "files"), movedOut[top])})
+		}
+	}
+
+	// Files arriving in a folder whose files all go, by the topmost such folder
+	into := make(map[string]int)
+	var intoOrder []string
+	for _, op := range ops {
+		if op.To == "" || op.Type == "rm" {
+			continue
+		}
+		emptied := ""
+		for dir := path.Dir(op.To); dir != "."; dir = path.Dir(dir) {
+			if below[dir] > 0 && deleted[dir] == below[dir] {
+				emptied = dir
+			}
+		}
+		if emptied == "" {
+			continue
+		}
+		if into[emptied] == 0 {
+			intoOrder = append(intoOrder, emptied)
+		}
+		into[emptied]++
+	}
+	for _, dir := range intoOrder {
+		warnings = append(warnings, LintWarning{"into-deleted-folder",
+			fmt.Sprintf("Moves or copies %s into %s, where every file there now (%d) is deleted", plural(into[dir], "file", "files"), folderLabel(dir), below[dir])})
+	}
+
+	var copied []string
+	for from, n := range copies {
+		if n >= lintManyCopies {
+			copied = append(copied, from)
+		}
+	}
+	sort.Slice(copied, func(i, j int) bool { return copies[copied[i]] > copies[copied[j]] })
+	for _, from := range copied {
+		warnings = append(warnings, LintWarning{"many-copies",
+			fmt.Sprintf("Copies %s %d times", from, copies[from])})
+	}
+	return warnings
+}
+
+// printLint shows the plan's warnings ahead of the operations
+func printLint(ops []Operation) {
+	catalogMu.RLock()
+	warnings := lintPlan(ops, catalog)
+	catalogMu.RUnlock()
+	if len(warnings) == 0 {
+		return
+	}
+	fmt.Println(colorize(colorYellow, tr("Check before confirming:")))
+	for _, w := range warnings {
+		fmt.Println("  " + colorize(colorYellow, "WARNING") + " " + printable(w.Message))
+	}
+	fmt.Println(strings.Repeat("-", 60))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// listener is one -listen address with what requests arriving there may do
+type listener struct {
+	addr     string
+	certFile string // With keyFile: serve HTTPS
+	keyFile  string
+	maxRole  role // The most a request here can do, whatever its token
+	open     bool // auth=none: requests get maxRole without a token
+}
+
+// url is how the listener is printed at startup
+func (l listener) url() string {
+	scheme := "http"
+	if l.certFile != "" {
+		scheme = "https"
+	}
+	host, port, _ := net.SplitHostPort(l.addr)
+	if host == "" {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port) + basePath + "/"
+}
+
+// listenerList is the repeatable -listen flag: an address followed by
+// comma-separated options, e.g. "localhost:8080,auth=none" or
+// ":8443,cert=server.crt,key=server.key,role=viewer"
+type listenerList []listener
+
+func (l *listenerList) String() string {
+	addrs := make([]string, len(*l))
+	for i, ln := range *l {
+		addrs[i] = ln.addr
+	}
+	return strings.Join(addrs, " ")
+}
+
+func (l *listenerList) Set(value string) error {
+	parts := strings.Split(value, ",")
+	ln := listener{addr: strings.TrimSpace(parts[0]), maxRole: roleOperator}
+	if _, _, err := net.SplitHostPort(ln.addr); err != nil {
+		return fmt.Errorf("invalid address %q, expected host:port or :port", ln.addr)
+	}
+	for _, opt := range parts[1:] {
+		key, val, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch key {
+		case "cert":
+			ln.certFile = val
+		case "key":
+			ln.keyFile = val
+		case "role":
+			switch val {
+			case "viewer":
+				ln.maxRole = roleViewer
+			case "operator":
+				ln.maxRole = roleOperator
+			default:
+				return fmt.Errorf("%s: role must be viewer or operator", ln.addr)
+			}
+		case "auth":
+			switch val {
+			case "none":
+				ln.open = true
+			case "token":
+				ln.open = false
+			default:
+				return fmt.Errorf("%s: auth must be none or token", ln.addr)
+			}
+		default:
+			return fmt.Errorf("%s: unknown option %q (cert, key, role or auth)", ln.addr, opt)
+		}
+	}
+	if (ln.certFile == "") != (ln.keyFile == "") {
+		return fmt.Errorf("%s: HTTPS needs both cert= and key=", ln.addr)
+	}
+	*l = append(*l, ln)
+	return nil
+}
+
+// listeners is -listen; without it the server has one listener, on -p
+// (localhost only with -localhost)
+var listeners listenerList
+
+// basePath is -base-path without its trailing slash, e.g. "/dir-mimic": a
+// reverse proxy forwards requests for that path unchanged, and the routes
+// are served below it
+var basePath string
+
+// parseBasePath normalizes -base-path to a leading slash and no trailing one
+func parseBasePath(value string) (string, error) {
+	p := "/" + strings.Trim(value, "/")
+	if p == "/" {
+		return "", nil
+	}
+	if strings.ContainsAny(p, "?#") {
+		return "", fmt.Errorf("invalid base path %q", value)
+	}
+	return p, nil
+}
+
+// underBasePath serves handler below basePath, redirecting the bare path to
+// the UI so its relative requests resolve below it
+func underBasePath(handler http.Handler) http.Handler {
+	if basePath == "" {
+		return handler
+	}
+	stripped := http.StripPrefix(basePath, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
+
+type listenerKey struct{}
+
+// withListener tags each request with the listener it arrived on
+func withListener(l *listener, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerKey{}, l)))
+	})
+}
+
+// requestListener returns the listener a request arrived on
+func requestListener(r *http.Request) *listener {
+	l, _ := r.Context().Value(listenerKey{}).(*listener)
+	return l
+}
+
+// readOnlyRequest reports whether the request came in on a listener that
+// allows no more than viewing
+func readOnlyRequest(r *http.Request) bool {
+	l := requestListener(r)
+	return l != nil && l.maxRole < roleOperator
+}
+
+// serve runs the HTTP server on every listener and exits when one fails
+func serve(handler http.Handler, ls []listener) {
+	failed := make(chan error, len(ls))
+	for i := range ls {
+		l := &ls[i]
+		srv := &http.Server{Addr: l.addr, Handler: loggingMiddleware(allowlistMiddleware(withListener(l, underBasePath(handler))))}
+		access := "full access"
+		if l.maxRole < roleOperator {
+			access = "read-only"
+		}
+		if host, _, _ := net.SplitHostPort(l.addr); l.open && !isLoopbackHost(host) {
+			fmt.Fprintf(os.Stderr, "Warning: anyone who can reach %s gets %s without a token\n", l.addr, access)
+		}
+		if l.open {
+			access += ", no token needed"
+		}
+		if len(listeners) > 0 {
+			fmt.Printf("%s (%s)\n", l.url(), access)
+		} else {
+			fmt.Println(l.url())
+		}
+		go func() {
+			if l.certFile != "" {
+				failed <- fmt.Errorf("%s: %w", l.addr, srv.ListenAndServeTLS(l.certFile, l.keyFile))
+			} else {
+				failed <- fmt.Errorf("%s: %w", l.addr, srv.ListenAndServe())
+			}
+		}()
+	}
+	fmt.Fprintf(os.Stderr, "Server error: %v\n", <-failed)
+	os.Exit(1)
+}
+
+// isLoopbackHost reports whether a listen host only takes local connections
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
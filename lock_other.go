@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly || windows)
+
+package main
+
+// isLocked can't detect locks on this platform
+func isLocked(path string) bool {
+	return false
+}
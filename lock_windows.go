@@ -0,0 +1,25 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// isLocked reports whether another process has the file open in a way that
+// prevents moving or deleting it, by trying to open it without sharing
+func isLocked(path string) bool {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return false
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ, 0, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return err == errorSharingViolation || err == errorLockViolation
+	}
+	syscall.CloseHandle(h)
+	return false
+}
@@ -1,19 +1,20 @@
 package main
 
 import (
-	"bufio"
-	"crypto/sha1"
-	"crypto/sha256"
 	_ "embed"
-	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/jokkebk/dir-mimic/planspec"
 )
 
 //go:embed ui.html
@@ -26,36 +27,49 @@ type FileEntry struct {
 	MTime  int64  `json:"mtime"`
 	Hash   string `json:"hash,omitempty"`
 	Folder string `json:"folder,omitempty"` // Derived from path
+	Dev    uint64 `json:"dev,omitempty"`    // Device and inode, only for files with several hardlinks
+	Ino    uint64 `json:"ino,omitempty"`
+	// EXIF capture time with -photo-dates, e.g. "2024-07-01T14:03:22"
+	TakenAt string `json:"takenAt,omitempty"`
+	// Sample hash of the audio data without tags, with -audio-hash
+	AudioHash string `json:"audioHash,omitempty"`
 }
 
-// Operation represents a file operation to perform
-type Operation struct {
-	Type string `json:"type"` // "mv", "cp", "rm", "missing"
-	From string `json:"from"`
-	To   string `json:"to,omitempty"`
-}
-
-// Plan is just a list of operations
-type Plan struct {
-	Operations []Operation `json:"operations"`
-}
+// Operation and Plan are the plan format, see planspec
+type (
+	Operation = planspec.Operation
+	Plan      = planspec.Plan
+)
 
 // Default ignore patterns (matched against basename using filepath.Match)
 var defaultIgnorePatterns = []string{
-	"._*",           // macOS AppleDouble resource forks
-	".DS_Store",     // macOS folder metadata
+	"._*",             // macOS AppleDouble resource forks
+	".DS_Store",       // macOS folder metadata
 	".Spotlight-V100", // macOS Spotlight index
-	".Trashes",      // macOS trash
-	".fseventsd",    // macOS FS events
-	"Thumbs.db",     // Windows thumbnails
-	"desktop.ini",   // Windows folder config
+	".Trashes",        // macOS trash
+	".fseventsd",      // macOS FS events
+	"Thumbs.db",       // Windows thumbnails
+	"desktop.ini",     // Windows folder config
 }
 
 var (
-	targetDir      string
-	useHashing     bool
-	catalog        []FileEntry
-	ignorePatterns []string
+	targetDir        string
+	useHashing       bool
+	catalog          []FileEntry
+	specialFiles     []SpecialFile
+	inaccessible     []ScanError
+	scanWarnings     []ScanWarning
+	mountPoints      []string // Of the catalog, see ScanResult.Mounts
+	ignorePatterns   []string
+	sourceCatalogURL string
+	writeManifestOn  bool
+	diffMode         string
+	baseDir          string // Directory given on the command line when -subdir narrows the scope
+	maxDepth         int    // 0 = unlimited
+	fileFilter       FileFilter
+	oneFileSystem    bool
+	strictScan       bool
+	dualConfirm      bool
 )
 
 // shouldIgnore returns true if the given filename matches any active ignore pattern.
@@ -69,35 +83,344 @@ func shouldIgnore(name string) bool {
 	return false
 }
 
+// buildIgnorePatterns combines the default patterns with comma-separated extras
+func buildIgnorePatterns(noDefaults bool, extra string) []string {
+	var patterns []string
+	if !noDefaults {
+		patterns = append(patterns, defaultIgnorePatterns...)
+	}
+	if extra != "" {
+		for _, p := range strings.Split(extra, ",") {
+			p = strings.TrimSpace(p)
+			if p != "" {
+				patterns = append(patterns, p)
+			}
+		}
+	}
+	return patterns
+}
+
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "dedupe" {
+		runDedupe(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "apply" {
+		runApplyCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify-content" {
+		runVerifyContent(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mimic" {
+		runMimic(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		runSnapshot(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "layout" {
+		runLayoutCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "catalog" {
+		runCatalogCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		runService(os.Args[2:])
+		return
+	}
+	runServer()
+}
+
+// runServer parses the command line and serves the target until killed
+func runServer() {
 	port := flag.Int("p", 8080, "HTTP server port")
 	hashFlag := flag.Bool("H", false, "Enable sample hash computation for file identification")
 	localhostOnly := flag.Bool("localhost", false, "Listen only on localhost (for local connections)")
 	noDefaultIgnores := flag.Bool("no-default-ignores", false, "Disable built-in ignore patterns")
 	extraIgnores := flag.String("ignore", "", "Extra ignore patterns (comma-separated, matched against filename)")
+	sourceURL := flag.String("source-catalog-url", "", "Fetch the source catalog from this URL (another dir-mimic instance or a static JSON file)")
+	modeFlag := flag.String("mode", "relocate", "Default comparison mode in the UI: relocate (match by name+size), strict (compare paths) or content (match by content anywhere)")
+	subdirFlag := flag.String("subdir", "", "Only work on this subdirectory of the target (relative path)")
+	maxDepthFlag := flag.Int("max-depth", 0, "Only catalog files at most this many levels below the root (0 = unlimited)")
+	minSizeFlag := flag.String("min-size", "", "Only catalog files at least this large (e.g. 100K, 5M)")
+	maxSizeFlag := flag.String("max-size", "", "Only catalog files at most this large (e.g. 4G)")
+	includeExt := flag.String("include-ext", "", "Only catalog files with these extensions (comma-separated, e.g. mkv,mp4)")
+	excludeExt := flag.String("exclude-ext", "", "Never catalog files with these extensions (comma-separated, e.g. nfo,txt)")
+	oneFSFlag := flag.Bool("one-file-system", false, "Don't descend into directories on other filesystems (mount points)")
+	strictFlag := flag.Bool("strict", false, "Abort the scan on the first unreadable path instead of skipping it")
+	dualConfirmFlag := flag.Bool("dual-confirm", false, "Require confirmation in both the terminal and the web UI before executing a plan")
+	viewerTokenFlag := flag.String("viewer-token", "", "Token required to read the catalog (requires -operator-token)")
+	operatorTokenFlag := flag.String("operator-token", "", "Token required to apply plans")
+	flag.Var(&allowedNets, "allow-cidr", "Only accept requests from this network, e.g. 192.168.1.0/24 (repeatable)")
+	flag.Var(&trustedProxies, "trusted-proxy", "Take the client's address from X-Forwarded-For on requests from this reverse proxy, e.g. 127.0.0.1 (repeatable)")
+	basePathFlag := flag.String("base-path", "", "Serve the UI and all routes below this path, e.g. /dir-mimic/ behind a reverse proxy that passes the path on")
+	allowDeletesFlag := flag.Bool("allow-deletes", false, "Execute the deletes of plans; without it they are left out")
+	flag.Var(&libraryServers, "library-scan", "Ask this media server to rescan the folders an applied plan changed: plex, jellyfin or emby with url=, token= and root= options (repeatable)")
+	flag.Var(&compareRoots, "compare-root", "Also catalog this directory, read-only, to compare it with the target or another -compare-root, e.g. a backup (repeatable)")
+	flag.Var(&listeners, "listen", "Listen on this address instead of -p, with options: cert=file,key=file for HTTPS, role=viewer for read-only, auth=none for no token (repeatable)")
+	logLevelFlag := flag.String("log-level", "warn", "Access log level: debug, info, warn or error")
+	debugFlag := flag.Bool("debug", false, "Serve pprof profiles and scanner/apply counters under /debug/")
+	maxPlanOpsFlag := flag.Int("max-plan-ops", maxPlanOps, "Reject plans with more operations than this")
+	maxPlanSizeFlag := flag.String("max-plan-size", "256M", "Reject plans larger than this (K/M/G suffixes allowed)")
+	maxUploadSizeFlag := flag.String("max-upload-size", "64G", "Reject files uploaded for import larger than this")
+	noColorFlag := flag.Bool("no-color", false, "Don't use colors in terminal output (also disabled by NO_COLOR)")
+	linkSpeedFlag := flag.Float64("link-speed", linkSpeedMbps, "Link speed in Mbit/s for estimating transfer of missing files")
+	previewDirFlag := flag.String("preview-dir", "", "Build a symlink view of the planned layout here when the UI asks for a preview")
+	flag.Var(&importHosts, "import-host", "Allow imports from URLs on this host (host or host:port, repeatable; the -source-catalog-url host is always allowed)")
+	sourceDirFlag := flag.String("source-dir", "", "The source's files on a drive this machine can read: missing and updated files are copied in from there")
+	cloneDirFlag := flag.String("clone-dir", "", "Build the planned layout here from hardlinks to the target's files when the UI asks for a clone")
+	honorIgnoreFlag := flag.Bool("honor-ignore-files", false, "Don't catalog what the target's .stignore (Syncthing) and .rsync-filter files exclude")
+	gitTrackedFlag := flag.Bool("git-tracked-only", false, "Only catalog files git tracks or would track (not ignored)")
+	snapshotFlag := flag.String("snapshot", "", "Snapshot the target before executing a plan: btrfs, zfs or apfs")
+	photoDatesFlag := flag.Bool("photo-dates", false, "Read photo capture times from EXIF and match photos by capture time + size")
+	audioHashFlag := flag.Bool("audio-hash", false, "Hash the audio data of MP3 and FLAC files, so retagged copies still match")
+	applyWindowFlag := flag.String("apply-window", "", "Run confirmed plans only in this time of day, e.g. 01:00-06:00; they queue until it opens")
+	excludeNewerFlag := flag.String("exclude-newer", "", "Never delete or overwrite files modified within this age, e.g. 7d or 12h")
+	reserveFlag := flag.String("reserve", "", "Pause a running plan while a copy would leave less than this free on its filesystem, e.g. 10G")
+	checkpointFlag := flag.Int("checkpoint-every", 0, "Pause a running plan after every N operations and ask whether to continue, abort or roll back")
+	deleteOrderFlag := flag.String("delete-order", deleteOrder, "When deletes run: interleaved (plan order), first (free space before copying) or last")
+	orderFlag := flag.String("order", executionOrder, "Order of operations: plan, small-first (renames and small copies first), large-first or by-folder (one folder at a time)")
+	conflictFlag := flag.String("conflict", conflictStrategy, "Strict mode conflicts (same path, different content): source, newer, larger, keep-both or ask")
+	langFlag := flag.String("lang", "", "Language of terminal messages and the web UI: en, de or fi (default from LANG)")
+	reviewBelowFlag := flag.Float64("review-below", 0, "Leave operations with a lower match confidence (0-1) out of the plan unless approved one by one")
+	matcherFlag := flag.String("matcher-cmd", "", "Command that pairs up files left unmatched by the diff (JSON on stdin/stdout)")
+	backupDirFlag := flag.String("backup-dir", "", "Keep files that moves and copies would overwrite in this directory")
+	backupSuffixFlag := flag.String("backup-suffix", "", "Keep files that moves and copies would overwrite next to them with this suffix, e.g. .bak")
+	stageDirFlag := flag.String("stage-dir", "", "Cache copied and imported files here by SHA-256 and link repeated copies from it (on the target's filesystem)")
+	manifestFlag := flag.Bool("manifest", false, "Write a "+manifestName+" manifest of the target after each successful apply")
+	containerFlag := flag.Bool("container", false, "Container mode: scan in the background, JSON access log on stdout, web confirmation without a terminal")
+	assumeYesFlag := flag.Bool("assume-yes", false, "Execute plans without confirmation (for scripted use; requires -operator-token)")
+	confirmChecksumFlag := flag.Bool("confirm-checksum", false, "Confirm plans on the terminal by typing the first 8 characters of their checksum instead of y")
+	noTerminalConfirmFlag := flag.Bool("no-terminal-confirm", false, "Confirm plans in the web UI instead of the terminal")
+	stateDirFlag := flag.String("state-dir", "", "Keep catalog snapshots and uploads here instead of the user cache directory")
+	configFlag := flag.String("config", "", "Config file with named profiles (default "+defaultConfigPath()+")")
+	profileFlag := flag.String("profile", "", "Take flags not given on the command line from this profile in the config file")
+	if err := applyEnvDefaults(flag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 	flag.Parse()
+	if err := setupProfile(flag.CommandLine, *configFlag, *profileFlag, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	activeProfile = *profileFlag
+	stateDir = *stateDirFlag
 
 	args := flag.Args()
+	if dir, ok := os.LookupEnv(envPrefix + "DIR"); ok && len(args) == 0 {
+		args = []string{dir}
+	}
 	if len(args) != 1 {
-		fmt.Fprintf(os.Stderr, "Usage: dir-mimic [-H] [-p port] [-localhost] [-no-default-ignores] [-ignore patterns] <directory>\n")
+		fmt.Fprintf(os.Stderr, "Usage: dir-mimic [-profile name] [-config file] [-H] [-p port] [-localhost] [-listen addr[,options]]... [-base-path path] [-no-default-ignores] [-ignore patterns] [-mode relocate|strict|content] [-conflict strategy] [-review-below score] [-subdir path] [-max-depth n] [-min-size size] [-max-size size] [-include-ext exts] [-exclude-ext exts] [-one-file-system] [-strict] [-dual-confirm] [-allow-deletes] [-viewer-token t] [-operator-token t] [-allow-cidr net]... [-trusted-proxy net]... [-log-level level] [-debug] [-max-plan-ops n] [-max-plan-size size] [-max-upload-size size] [-no-color] [-lang code] [-link-speed mbps] [-preview-dir dir] [-clone-dir dir] [-source-dir dir] [-import-host host]... [-git-tracked-only] [-honor-ignore-files] [-snapshot fs] [-delete-order order] [-order order] [-exclude-newer age] [-apply-window hh:mm-hh:mm] [-reserve size] [-checkpoint-every n] [-library-scan server]... [-photo-dates] [-audio-hash] [-matcher-cmd cmd] [-backup-dir dir | -backup-suffix s] [-stage-dir dir] [-source-catalog-url url] [-compare-root dir]... [-manifest] [-state-dir dir] [-container] [-confirm-checksum] [-no-terminal-confirm] [-assume-yes] <directory>\n")
+		fmt.Fprintf(os.Stderr, "       dir-mimic dedupe [-auto] [-no-default-ignores] [-ignore patterns] <directory>\n")
+		fmt.Fprintf(os.Stderr, "       dir-mimic apply [-profile name] [-config file] [-yes] [-manifest] [-no-color] [-snapshot fs] [-delete-order order] [-order order] [-exclude-newer age] [-reserve size] [-checkpoint-every n] [-backup-dir dir | -backup-suffix s] [-stage-dir dir] [-no-default-ignores] [-ignore patterns] <plan.json|-> <directory>\n")
+		fmt.Fprintf(os.Stderr, "       dir-mimic service install [-name n] [flags] <directory> | service start|stop|uninstall [-name n]\n")
+		fmt.Fprintf(os.Stderr, "       dir-mimic mimic [-yes] [-dry-run] [-copy-missing] [flags] <source-dir> <target-dir>\n")
+		fmt.Fprintf(os.Stderr, "       dir-mimic verify [-profile name] [-config file] [-H] [-honor-ignore-files] [-photo-dates] [-audio-hash] [-mode strict|relocate|content] [-conflict strategy] [-link-speed mbps] [-matcher-cmd cmd] [-no-default-ignores] [-ignore patterns] <source-catalog> <directory>\n")
+		fmt.Fprintf(os.Stderr, "       dir-mimic verify-content [-j n] [-honor-ignore-files] [-no-default-ignores] [-ignore patterns] <source-dir> <target-dir>\n")
+		fmt.Fprintf(os.Stderr, "       dir-mimic layout [-dry-run] <layout.json|-> <directory>\n")
 		os.Exit(1)
 	}
 
 	targetDir = args[0]
 	useHashing = *hashFlag
+	diffMode = *modeFlag
+	if diffMode != "relocate" && diffMode != "strict" && diffMode != "content" {
+		fmt.Fprintf(os.Stderr, "Error: -mode must be relocate, strict or content\n")
+		os.Exit(1)
+	}
+	if *sourceURL != "" {
+		sourceCatalogURL = normalizeCatalogURL(*sourceURL)
+	}
 
-	// Build ignore patterns
-	if !*noDefaultIgnores {
-		ignorePatterns = append(ignorePatterns, defaultIgnorePatterns...)
+	ignorePatterns = buildIgnorePatterns(*noDefaultIgnores, *extraIgnores)
+	writeManifestOn = *manifestFlag
+	if writeManifestOn {
+		// The manifest itself must not show up as a file to delete
+		ignorePatterns = append(ignorePatterns, manifestName, manifestName+".tmp", manifestStatName, manifestStatName+".tmp")
 	}
-	if *extraIgnores != "" {
-		for _, p := range strings.Split(*extraIgnores, ",") {
-			p = strings.TrimSpace(p)
-			if p != "" {
-				ignorePatterns = append(ignorePatterns, p)
+
+	var err error
+	if *minSizeFlag != "" {
+		if fileFilter.MinSize, err = parseSize(*minSizeFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -min-size: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *maxSizeFlag != "" {
+		if fileFilter.MaxSize, err = parseSize(*maxSizeFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -max-size: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if maxPlanBytes, err = parseSize(*maxPlanSizeFlag); err != nil || maxPlanBytes <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-plan-size: invalid size %q\n", *maxPlanSizeFlag)
+		os.Exit(1)
+	}
+	if maxUploadBytes, err = parseSize(*maxUploadSizeFlag); err != nil || maxUploadBytes <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-upload-size: invalid size %q\n", *maxUploadSizeFlag)
+		os.Exit(1)
+	}
+	maxPlanOps = *maxPlanOpsFlag
+	if maxPlanOps <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-plan-ops must be positive\n")
+		os.Exit(1)
+	}
+	fileFilter.IncludeExt = parseExtList(*includeExt)
+	fileFilter.ExcludeExt = parseExtList(*excludeExt)
+
+	maxDepth = *maxDepthFlag
+	oneFileSystem = *oneFSFlag
+	strictScan = *strictFlag
+	dualConfirm = *dualConfirmFlag
+	allowDeletes = *allowDeletesFlag
+	gitTrackedOnly = *gitTrackedFlag
+	honorIgnoreFiles = *honorIgnoreFlag
+	matcherCmd = *matcherFlag
+	photoDates = *photoDatesFlag
+	audioHashing = *audioHashFlag
+	if conflictStrategy = *conflictFlag; !containsString(conflictStrategies, conflictStrategy) {
+		fmt.Fprintf(os.Stderr, "Error: -conflict must be one of %s\n", strings.Join(conflictStrategies, ", "))
+		os.Exit(1)
+	}
+	if err := setLang(*langFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if reviewBelow = *reviewBelowFlag; reviewBelow < 0 || reviewBelow > 1 {
+		fmt.Fprintf(os.Stderr, "Error: -review-below must be between 0 and 1\n")
+		os.Exit(1)
+	}
+	if *reserveFlag != "" {
+		if diskReserve, err = parseSize(*reserveFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -reserve: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *excludeNewerFlag != "" {
+		if excludeNewer, err = parseAge(*excludeNewerFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -exclude-newer: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *applyWindowFlag != "" {
+		if window, err = parseApplyWindow(*applyWindowFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -apply-window: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if deleteOrder = *deleteOrderFlag; !containsString(deleteOrders, deleteOrder) {
+		fmt.Fprintf(os.Stderr, "Error: -delete-order must be interleaved, first or last\n")
+		os.Exit(1)
+	}
+	if executionOrder = *orderFlag; !containsString(executionOrders, executionOrder) {
+		fmt.Fprintf(os.Stderr, "Error: -order must be plan, small-first, large-first or by-folder\n")
+		os.Exit(1)
+	}
+	snapshotKind = *snapshotFlag
+	if !validSnapshotKind(snapshotKind) {
+		fmt.Fprintf(os.Stderr, "Error: -snapshot must be btrfs, zfs or apfs\n")
+		os.Exit(1)
+	}
+	if *noColorFlag {
+		useColor = false
+	}
+	if linkSpeedMbps = *linkSpeedFlag; linkSpeedMbps <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -link-speed must be positive\n")
+		os.Exit(1)
+	}
+
+	logLevel, err := parseLogLevel(*logLevelFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	accessLog = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	noTerminalConfirm = *noTerminalConfirmFlag
+	assumeYes = *assumeYesFlag
+	if containerMode = *containerFlag; containerMode {
+		setupContainerMode(logLevel)
+	}
+	// An EOF on stdin would silently abort every plan, so refuse them up front
+	terminalConfirm = stdinIsTerminal()
+	if !terminalConfirm && !noTerminalConfirm && !assumeYes {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", errNoTerminal)
+	}
+	if checkpointEvery = *checkpointFlag; checkpointEvery < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -checkpoint-every must not be negative\n")
+		os.Exit(1)
+	}
+	if confirmChecksum = *confirmChecksumFlag; confirmChecksum && (assumeYes || noTerminalConfirm) {
+		fmt.Fprintf(os.Stderr, "Error: -confirm-checksum is for confirming on the terminal, it can't be used with -assume-yes or -no-terminal-confirm\n")
+		os.Exit(1)
+	}
+	if checkpointEvery > 0 && assumeYes && !noTerminalConfirm {
+		fmt.Fprintf(os.Stderr, "Error: -checkpoint-every needs someone to ask, use -no-terminal-confirm instead of -assume-yes\n")
+		os.Exit(1)
+	}
+	if checkpointEvery > 0 && window != nil {
+		fmt.Fprintf(os.Stderr, "Error: -checkpoint-every can't be used with -apply-window, nobody is asked while a queued plan runs\n")
+		os.Exit(1)
+	}
+
+	if len(listeners) > 0 {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "p" || f.Name == "localhost" {
+				fmt.Fprintf(os.Stderr, "Error: -listen replaces -%s, give the address with -listen\n", f.Name)
+				os.Exit(1)
 			}
+		})
+	}
+	if basePath, err = parseBasePath(*basePathFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	viewerToken, operatorToken = *viewerTokenFlag, *operatorTokenFlag
+	if viewerToken != "" && operatorToken == "" {
+		fmt.Fprintf(os.Stderr, "Error: -viewer-token requires -operator-token\n")
+		os.Exit(1)
+	}
+	if viewerToken != "" && viewerToken == operatorToken {
+		fmt.Fprintf(os.Stderr, "Error: -viewer-token and -operator-token must differ\n")
+		os.Exit(1)
+	}
+	// Without anyone confirming, the operator token is all that stands
+	// between the network and the target's files
+	if assumeYes && operatorToken == "" {
+		fmt.Fprintf(os.Stderr, "Error: -assume-yes executes every plan posted to the server, it requires -operator-token\n")
+		os.Exit(1)
+	}
+	for _, ln := range listeners {
+		if assumeYes && ln.open && ln.maxRole == roleOperator {
+			fmt.Fprintf(os.Stderr, "Error: -assume-yes can't be used with %s,auth=none, add role=viewer to it\n", ln.addr)
+			os.Exit(1)
 		}
 	}
+	if maxDepth < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-depth must not be negative\n")
+		os.Exit(1)
+	}
+
+	// Narrow the scope to a subdirectory; its path becomes the effective root
+	if *subdirFlag != "" {
+		if !filepath.IsLocal(*subdirFlag) {
+			fmt.Fprintf(os.Stderr, "Error: -subdir must be a relative path inside the target directory\n")
+			os.Exit(1)
+		}
+		baseDir, _ = filepath.Abs(targetDir)
+		targetDir = filepath.Join(targetDir, *subdirFlag)
+	}
 
 	// Verify directory exists
 	info, err := os.Stat(targetDir)
@@ -116,120 +439,122 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Error getting absolute path: %v\n", err)
 		os.Exit(1)
 	}
-
-	// Scan directory
-	fmt.Fprintf(os.Stderr, "Scanning directory: %s\n", targetDir)
-	catalog, err = scanDirectory(targetDir, useHashing)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error scanning directory: %v\n", err)
+	if *previewDirFlag != "" {
+		if previewDir, err = checkOutsideTarget("-preview-dir", *previewDirFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *cloneDirFlag != "" {
+		if cloneDir, err = checkCloneDir(*cloneDirFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := setupBackups(*backupDirFlag, *backupSuffixFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Fprintf(os.Stderr, "Found %d files\n", len(catalog))
-
-	// Start HTTP server
-	http.HandleFunc("/", handleUI)
-	http.HandleFunc("/catalog", handleCatalog)
-	http.HandleFunc("/apply", handleApply)
-
-	var addr string
-	if *localhostOnly {
-		addr = fmt.Sprintf("localhost:%d", *port)
-	} else {
-		addr = fmt.Sprintf(":%d", *port)
+	if err := setupStageDir(*stageDirFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
-	fmt.Printf("http://localhost:%d\n", *port)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
+	if err := setupSourceDir(*sourceDirFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-}
-
-// scanDirectory walks the directory and builds the catalog
-func scanDirectory(root string, withHash bool) ([]FileEntry, error) {
-	var entries []FileEntry
-
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if shouldIgnore(info.Name()) {
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-		if info.IsDir() {
-			return nil
-		}
-
-		relPath, err := filepath.Rel(root, path)
-		if err != nil {
-			return err
-		}
-
-		entry := FileEntry{
-			Path:  relPath,
-			Size:  info.Size(),
-			MTime: info.ModTime().UnixMilli(),
-		}
 
-		if withHash {
-			hash, err := computeSampleHash(path, info.Size())
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: could not hash %s: %v\n", relPath, err)
-			} else {
-				entry.Hash = hash
+	// Scan directory, in the background in container mode so the port
+	// is bound right away
+	scanFailed := func(err error) {
+		fmt.Fprintf(os.Stderr, "Error scanning directory: %v\n", err)
+		os.Exit(1)
+	}
+	if containerMode {
+		go func() {
+			if err := initialScan(); err != nil {
+				scanFailed(err)
 			}
-		}
-
-		entries = append(entries, entry)
-		return nil
-	})
-
-	return entries, err
-}
-
-// computeSampleHash computes a sample SHA1 hash (first+last 64KB)
-func computeSampleHash(path string, size int64) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return "", err
+		}()
+	} else if err := initialScan(); err != nil {
+		scanFailed(err)
 	}
-	defer f.Close()
-
-	h := sha1.New()
 
-	if size <= 65536 {
-		_, err = io.Copy(h, f)
-	} else {
-		// Read first 64KB
-		buf := make([]byte, 65536)
-		n, err := f.Read(buf)
-		if err != nil {
-			return "", err
-		}
-		h.Write(buf[:n])
+	// Start HTTP server. Routes live on our own mux: pprof and expvar
+	// register themselves on the default one, which must stay unserved.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleUI)
+	mux.HandleFunc("/schema/plan.json", handlePlanSchema)
+	mux.HandleFunc("/catalog", requireRole(roleViewer, handleCatalog))
+	mux.HandleFunc("/info", requireRole(roleViewer, handleInfo))
+	mux.HandleFunc("/catalog/changes", requireRole(roleViewer, handleCatalogChanges))
+	mux.HandleFunc("/rescan", requireRole(roleOperator, handleRescan))
+	mux.HandleFunc("/preview", requireRole(roleOperator, handlePreview))
+	mux.HandleFunc("/clone", requireRole(roleOperator, handleClone))
+	mux.HandleFunc("/apply", requireRole(roleOperator, handleApply))
+	mux.HandleFunc("/apply/batch", requireRole(roleOperator, handleApplyBatch))
+	mux.HandleFunc("/apply/batch/next", requireRole(roleOperator, handleApplyBatchNext))
+	mux.HandleFunc("/apply/queued", requireRole(roleOperator, handleApplyQueued))
+	mux.HandleFunc("/status", requireRole(roleViewer, handleStatus))
+	mux.HandleFunc("/preflight", requireRole(roleViewer, handlePreflight))
+	mux.HandleFunc("/validate", requireRole(roleViewer, handleValidate))
+	mux.HandleFunc("/source-catalog", requireRole(roleViewer, handleSourceCatalog))
+	mux.HandleFunc("/source", requireRole(roleOperator, handleSourcePush))
+	mux.HandleFunc("/tree", requireRole(roleViewer, handleTree))
+	mux.HandleFunc("/plan", requireRole(roleViewer, handlePlan))
+	mux.HandleFunc("/compare", requireRole(roleViewer, handleCompare))
+	mux.HandleFunc("/export", requireRole(roleViewer, handleExport))
+	mux.HandleFunc("/upload", requireRole(roleOperator, handleUpload))
+	mux.HandleFunc("/file", requireRole(roleOperator, handleFile))
+	mux.HandleFunc("/snapshots", requireRole(roleViewer, handleSnapshots))
+	mux.HandleFunc("/snapshots/save", requireRole(roleOperator, handleSnapshotSave))
+	mux.HandleFunc("/snapshots/diff", requireRole(roleViewer, handleSnapshotDiff))
+	mux.HandleFunc("/never-touch", requireRole(roleOperator, handleNeverTouch))
+	mux.HandleFunc("/match", requireRole(roleViewer, handleMatch))
+	mux.HandleFunc("/hash", requireRole(roleViewer, handleHash))
+	mux.HandleFunc("/events", requireRole(roleViewer, handleEvents))
+	mux.HandleFunc("/confirm", requireRole(roleOperator, handleConfirm))
+	mux.HandleFunc("/confirm/pending", requireRole(roleViewer, handleConfirmPending))
+	if *debugFlag {
+		registerDebugHandlers(mux)
+		fmt.Fprintf(os.Stderr, "Debug endpoints enabled: /debug/pprof/ and /debug/vars\n")
+	}
 
-		// Read last 64KB
-		_, err = f.Seek(-65536, io.SeekEnd)
-		if err != nil {
-			return "", err
+	ls := listeners
+	if len(ls) == 0 {
+		addr := fmt.Sprintf(":%d", *port)
+		if *localhostOnly {
+			addr = fmt.Sprintf("localhost:%d", *port)
 		}
-		n, err = f.Read(buf)
-		if err != nil {
-			return "", err
+		ls = listenerList{{addr: addr, maxRole: roleOperator}}
+	}
+	if len(allowedNets) > 0 {
+		fmt.Fprintf(os.Stderr, "Accepting requests only from localhost and %s\n", allowedNets.String())
+		if basePath != "" && len(trustedProxies) == 0 {
+			fmt.Fprintf(os.Stderr, "Warning: a reverse proxy on this host connects from localhost, so -allow-cidr lets everything it forwards through; add -trusted-proxy 127.0.0.1\n")
 		}
-		h.Write(buf[:n])
 	}
+	serve(mux, ls)
+}
 
-	return hex.EncodeToString(h.Sum(nil)), nil
+// formatSize formats a byte count the same way as the web UI
+func formatSize(bytes int64) string {
+	switch {
+	case bytes < 1024:
+		return fmt.Sprintf("%d B", bytes)
+	case bytes < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/1024)
+	case bytes < 1024*1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/(1024*1024))
+	}
+	return fmt.Sprintf("%.1f GB", float64(bytes)/(1024*1024*1024))
 }
 
 // setCORSHeaders adds CORS headers to allow requests from file:// and other origins
 func setCORSHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, Authorization")
 }
 
 // handleUI serves the embedded HTML UI
@@ -244,12 +569,44 @@ func handleUI(w http.ResponseWriter, r *http.Request) {
 
 // CatalogResponse contains the catalog plus metadata
 type CatalogResponse struct {
-	Path           string      `json:"path"`
-	Files          []FileEntry `json:"files"`
-	FileCount      int         `json:"fileCount"`
-	FolderCount    int         `json:"folderCount"`
-	TotalSize      int64       `json:"totalSize"`
-	IgnorePatterns []string    `json:"ignorePatterns"`
+	Version         int                          `json:"version"` // catalogVersion
+	Path            string                       `json:"path"`
+	Seq             int64                        `json:"seq"` // Bumped on every rescan, see /catalog/changes
+	Files           []FileEntry                  `json:"files"`
+	FileCount       int                          `json:"fileCount"`
+	FolderCount     int                          `json:"folderCount"`
+	TotalSize       int64                        `json:"totalSize"`
+	DiskSize        int64                        `json:"diskSize"` // TotalSize with hardlinked files counted once
+	HardlinkGroups  []HardlinkGroup              `json:"hardlinkGroups,omitempty"`
+	IgnorePatterns  []string                     `json:"ignorePatterns"`
+	SourceURL       string                       `json:"sourceCatalogUrl,omitempty"`
+	SourcePushed    string                       `json:"sourcePushed,omitempty"` // Where the catalog pushed to /source was scanned
+	Mode            string                       `json:"mode"`
+	Conflict        string                       `json:"conflict"` // -conflict strategy
+	ReviewBelow     float64                      `json:"reviewBelow,omitempty"`
+	Lang            string                       `json:"lang"`
+	NeverTouch      []string                     `json:"neverTouch,omitempty"`
+	LinkSpeed       float64                      `json:"linkSpeedMbps"`
+	PreviewDir      string                       `json:"previewDir,omitempty"`
+	CloneDir        string                       `json:"cloneDir,omitempty"`
+	SourceDir       string                       `json:"sourceDir,omitempty"` // -source-dir, missing files are imported from there
+	Matcher         bool                         `json:"matcher,omitempty"`   // -matcher-cmd is set, see /match
+	Profile         string                       `json:"profile,omitempty"`   // -profile the server runs with
+	Profiles        map[string]map[string]string `json:"profiles,omitempty"`
+	Timings         TimingRates                  `json:"timings"`                  // For the UI's execution time estimate
+	ProtectedSince  int64                        `json:"protectedSince,omitempty"` // -exclude-newer cutoff (Unix ms)
+	BaseDir         string                       `json:"baseDir,omitempty"`
+	MaxDepth        int                          `json:"maxDepth,omitempty"`
+	Filter          *FileFilter                  `json:"filter,omitempty"`
+	SpecialFiles    []SpecialFile                `json:"specialFiles,omitempty"`
+	Inaccessible    []ScanError                  `json:"inaccessible,omitempty"`
+	Warnings        []ScanWarning                `json:"warnings,omitempty"`
+	ReadOnly        bool                         `json:"readOnly,omitempty"`        // Came in on a -listen address with role=viewer
+	CompareRoots    []string                     `json:"compareRoots,omitempty"`    // -compare-root directories, see /compare
+	AllowDeletes    bool                         `json:"allowDeletes"`              // Without -allow-deletes, deletes are left out of plans
+	ApplyWindow     string                       `json:"applyWindow,omitempty"`     // -apply-window, plans queue until it opens
+	ConfirmChecksum bool                         `json:"confirmChecksum,omitempty"` // The terminal asks for the start of the plan's checksum
+	Mounts          []string                     `json:"mounts,omitempty"`          // Folders where another filesystem is mounted
 }
 
 // handleCatalog returns the server-side catalog as JSON
@@ -259,199 +616,249 @@ func handleCatalog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Calculate stats
-	folders := make(map[string]bool)
-	var totalSize int64
-	for _, entry := range catalog {
-		totalSize += entry.Size
-		// Extract folder path
-		dir := filepath.Dir(entry.Path)
-		if dir != "." {
-			folders[dir] = true
-			// Also count parent folders
-			for dir != "." && dir != "/" {
-				folders[dir] = true
-				dir = filepath.Dir(dir)
-			}
-		}
+	catalogMu.RLock()
+	if catalogSeq == 0 {
+		catalogMu.RUnlock()
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, "Initial scan in progress", http.StatusServiceUnavailable)
+		return
 	}
+	folderCount, totalSize := catalogStats(catalog)
 
 	response := CatalogResponse{
-		Path:           targetDir,
-		Files:          catalog,
-		FileCount:      len(catalog),
-		FolderCount:    len(folders),
-		TotalSize:      totalSize,
-		IgnorePatterns: ignorePatterns,
+		Version:         catalogVersion,
+		Path:            targetDir,
+		Seq:             catalogSeq,
+		Files:           catalog,
+		FileCount:       len(catalog),
+		FolderCount:     folderCount,
+		TotalSize:       totalSize,
+		HardlinkGroups:  hardlinkGroups(catalog),
+		IgnorePatterns:  ignorePatterns,
+		SourceURL:       sourceCatalogURL,
+		Mode:            diffMode,
+		Conflict:        conflictStrategy,
+		ReviewBelow:     reviewBelow,
+		Lang:            lang,
+		NeverTouch:      neverTouchRules(),
+		LinkSpeed:       linkSpeedMbps,
+		PreviewDir:      previewDir,
+		CloneDir:        cloneDir,
+		SourceDir:       sourceDir,
+		Matcher:         matcherAvailable(),
+		Profile:         activeProfile,
+		Profiles:        browserProfiles(),
+		Timings:         timingRates(),
+		ProtectedSince:  protectedSince(),
+		BaseDir:         baseDir,
+		MaxDepth:        maxDepth,
+		SpecialFiles:    specialFiles,
+		Inaccessible:    inaccessible,
+		Warnings:        scanWarnings,
+		CompareRoots:    compareRoots,
+		AllowDeletes:    allowDeletes,
+		ApplyWindow:     applyWindowString(),
+		ConfirmChecksum: confirmChecksum,
+		Mounts:          mountPoints,
+	}
+	catalogMu.RUnlock()
+	response.DiskSize = diskSize(totalSize, response.HardlinkGroups)
+	response.ReadOnly = readOnlyRequest(r)
+	response.SourcePushed = pushedSourceLabel()
+	if fileFilter.active() {
+		response.Filter = &fileFilter
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleApply receives a plan and executes it after terminal confirmation
-func handleApply(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
-	if r.Method == http.MethodOptions {
-		return
+// normalizeCatalogURL turns "host:port" or a bare server URL into the
+// /catalog endpoint of that dir-mimic instance. Other URLs are used as-is.
+func normalizeCatalogURL(raw string) string {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
 	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Read raw body for checksum
-	body, err := io.ReadAll(r.Body)
+	u, err := url.Parse(raw)
 	if err != nil {
-		http.Error(w, "Failed to read body", http.StatusBadRequest)
-		return
+		return raw
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/catalog"
 	}
+	return u.String()
+}
 
-	var plan Plan
-	if err := json.Unmarshal(body, &plan); err != nil {
-		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
-		return
+// decodeCatalog parses either a CatalogResponse or a bare list of file
+// entries, which predates versioning, and converts older versions
+func decodeCatalog(data []byte) ([]FileEntry, error) {
+	var files []FileEntry
+	if err := json.Unmarshal(data, &files); err == nil {
+		return upgradeCatalog(files, 0), nil
+	}
+	var resp CatalogResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	if err := checkVersion("catalog", resp.Version, catalogVersion); err != nil {
+		return nil, err
 	}
+	if resp.Files == nil {
+		return nil, fmt.Errorf("no \"files\" array found")
+	}
+	return upgradeCatalog(resp.Files, resp.Version), nil
+}
 
-	// Compute checksum of received payload
-	checksum := sha256.Sum256(body)
-	checksumHex := hex.EncodeToString(checksum[:])
-
-	// Display plan in terminal
-	fmt.Println("\n" + strings.Repeat("=", 60))
-	fmt.Println("PLAN TO EXECUTE")
-	fmt.Println(strings.Repeat("=", 60))
-
-	mvCount, cpCount, rmCount, missingCount := 0, 0, 0, 0
-	for _, op := range plan.Operations {
-		switch op.Type {
-		case "mv":
-			fmt.Printf("  MOVE: %s -> %s\n", op.From, op.To)
-			mvCount++
-		case "cp":
-			fmt.Printf("  COPY: %s -> %s\n", op.From, op.To)
-			cpCount++
-		case "rm":
-			fmt.Printf("  DELETE: %s\n", op.From)
-			rmCount++
-		case "missing":
-			missingCount++
-		}
+// fetchSourceCatalog returns the catalog last pushed to /source, or else
+// downloads and decodes the -source-catalog-url one
+func fetchSourceCatalog() ([]FileEntry, error) {
+	pushedSource.Lock()
+	files := pushedSource.files
+	pushedSource.Unlock()
+	if files != nil {
+		return files, nil
 	}
+	return fetchCatalog(sourceCatalogURL)
+}
 
-	fmt.Println(strings.Repeat("-", 60))
-	fmt.Printf("Summary: %d moves, %d copies, %d deletes, %d missing\n", mvCount, cpCount, rmCount, missingCount)
-	fmt.Printf("Checksum: %s\n", checksumHex)
-	fmt.Println(strings.Repeat("-", 60))
+// fetchCatalog downloads and decodes a catalog from a URL
+func fetchCatalog(catalogURL string) ([]FileEntry, error) {
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Get(catalogURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch source catalog: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch source catalog: %s", resp.Status)
+	}
 
-	// Ask for confirmation
-	fmt.Print("Execute this plan? [y/N]: ")
-	reader := bufio.NewReader(os.Stdin)
-	response, _ := reader.ReadString('\n')
-	response = strings.TrimSpace(strings.ToLower(response))
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source catalog: %w", err)
+	}
+	files, err := decodeCatalog(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source catalog: %w", err)
+	}
+	return files, nil
+}
 
-	if response != "y" && response != "yes" {
-		fmt.Println("Aborted.")
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "aborted"})
+// handleSourceCatalog returns the catalog pushed to /source, or fetches the
+// one given with -source-catalog-url on behalf of the UI, so static servers
+// without CORS headers work too
+func handleSourceCatalog(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
 		return
 	}
-
-	// Execute operations
-	fmt.Println("\nExecuting...")
-	errors := []string{}
-
-	for _, op := range plan.Operations {
-		var err error
-		switch op.Type {
-		case "mv":
-			err = executeMove(op.From, op.To)
-		case "cp":
-			err = executeCopy(op.From, op.To)
-		case "rm":
-			err = executeDelete(op.From)
-		case "missing":
-			// Nothing to do for missing files
-			continue
-		}
-		if err != nil {
-			errMsg := fmt.Sprintf("%s %s: %v", op.Type, op.From, err)
-			fmt.Fprintf(os.Stderr, "  ERROR: %s\n", errMsg)
-			errors = append(errors, errMsg)
-		} else {
-			fmt.Printf("  OK: %s %s\n", op.Type, op.From)
-		}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !haveSourceCatalog() {
+		http.Error(w, "No source catalog: none was pushed to /source and there is no -source-catalog-url", http.StatusNotFound)
+		return
 	}
 
-	fmt.Println("\nDone!")
-
-	// Rescan directory
-	fmt.Fprintf(os.Stderr, "Rescanning directory...\n")
-	newCatalog, err := scanDirectory(targetDir, useHashing)
+	files, err := fetchSourceCatalog()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: could not rescan: %v\n", err)
-	} else {
-		catalog = newCatalog
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	result := map[string]interface{}{
-		"status": "completed",
-		"errors": errors,
-	}
-	json.NewEncoder(w).Encode(result)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version": catalogVersion,
+		"path":    sourceCatalogLabel(),
+		"files":   files,
+	})
 }
 
-func executeMove(from, to string) error {
-	fromPath := filepath.Join(targetDir, from)
-	toPath := filepath.Join(targetDir, to)
+// resolvePath joins a catalog-relative path onto targetDir, refusing paths
+// that would escape it
+func resolvePath(rel string) (string, error) {
+	return resolvePathIn(targetDir, rel)
+}
 
-	// Ensure destination directory exists
-	toDir := filepath.Dir(toPath)
-	if err := os.MkdirAll(toDir, 0755); err != nil {
-		return err
+// resolvePathIn is resolvePath for the target directory dir
+func resolvePathIn(dir, rel string) (string, error) {
+	full := filepath.Join(dir, filepath.FromSlash(rel))
+	if full != dir && !strings.HasPrefix(full, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("path outside target directory: %s", rel)
 	}
+	return full, nil
+}
 
-	return os.Rename(fromPath, toPath)
+// resolveOpPath is resolvePathIn for the paths of operations, which may not
+// name the target directory itself: a delete or move of "." would take the
+// whole target with it
+func resolveOpPath(dir, rel string) (string, error) {
+	full, err := resolvePathIn(dir, rel)
+	if err == nil && full == dir {
+		return "", fmt.Errorf("path is the target directory itself: %q", rel)
+	}
+	return full, err
 }
 
-func executeCopy(from, to string) error {
-	fromPath := filepath.Join(targetDir, from)
-	toPath := filepath.Join(targetDir, to)
+// HashRequest lists catalog paths to hash on demand
+type HashRequest struct {
+	Paths []string `json:"paths"`
+}
 
-	// Ensure destination directory exists
-	toDir := filepath.Dir(toPath)
-	if err := os.MkdirAll(toDir, 0755); err != nil {
-		return err
-	}
+// HashResponse maps each requested path to its hash or an error message
+type HashResponse struct {
+	Algorithm string            `json:"algorithm"`
+	Hashes    map[string]string `json:"hashes"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
 
-	src, err := os.Open(fromPath)
-	if err != nil {
-		return err
+// handleHash computes sample hashes for just the requested files, so the UI
+// can resolve ambiguous matches without a full -H scan
+func handleHash(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
 	}
-	defer src.Close()
-
-	dst, err := os.Create(toPath)
-	if err != nil {
-		return err
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, src)
-	if err != nil {
-		return err
+	var req HashRequest
+	if err := json.NewDecoder(requestBody(w, r, maxPlanBytes)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Copy file mode
-	info, err := os.Stat(fromPath)
-	if err == nil {
-		os.Chmod(toPath, info.Mode())
+	response := HashResponse{
+		Algorithm: "sha1-sample",
+		Hashes:    make(map[string]string),
+		Errors:    make(map[string]string),
+	}
+	for _, rel := range req.Paths {
+		full, err := resolvePath(rel)
+		if err != nil {
+			response.Errors[rel] = err.Error()
+			continue
+		}
+		info, err := os.Stat(full)
+		if err != nil {
+			response.Errors[rel] = err.Error()
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			response.Errors[rel] = "not a regular file"
+			continue
+		}
+		hash, err := computeSampleHash(full, info.Size())
+		if err != nil {
+			response.Errors[rel] = err.Error()
+			continue
+		}
+		response.Hashes[rel] = hash
 	}
 
-	return nil
-}
-
-func executeDelete(path string) error {
-	fullPath := filepath.Join(targetDir, path)
-	return os.Remove(fullPath)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
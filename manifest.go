@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestName is the sha256sum-compatible manifest written by -manifest
+const manifestName = "SHA256SUMS"
+
+// manifestStatName sits next to the manifest and records the size and ctime
+// each hash was taken at, so a hash is only reused for a file that wasn't
+// written since. The mtime can't tell: rsync -t and cp -p set it back.
+const manifestStatName = manifestName + ".stat"
+
+// manifestStat is a file's size and ctime when its hash was taken
+type manifestStat struct {
+	size  int64
+	ctime int64 // Nanoseconds
+}
+
+// isManifestFile reports whether a relative path is the manifest or its
+// stat file, which aren't part of the tree
+func isManifestFile(rel string) bool {
+	return rel == manifestName || rel == manifestStatName
+}
+
+// readManifest parses an existing manifest into path -> hash
+func readManifest(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// "<hash>  <path>" (binary mode uses " *<path>")
+		hash, rel, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || len(hash) != sha256.Size*2 {
+			continue
+		}
+		rel = strings.TrimPrefix(strings.TrimPrefix(rel, " "), "*")
+		hashes[rel] = hash
+	}
+	return hashes, scanner.Err()
+}
+
+// readManifestStats parses a manifest's stat file into path -> stat
+func readManifestStats(path string) (map[string]manifestStat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stats := make(map[string]manifestStat)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// "<size> <ctime> <path>"
+		var st manifestStat
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if _, err := fmt.Sscan(fields[0], &st.size); err != nil {
+			continue
+		}
+		if _, err := fmt.Sscan(fields[1], &st.ctime); err != nil {
+			continue
+		}
+		stats[fields[2]] = st
+	}
+	return stats, scanner.Err()
+}
+
+// statFile returns the size and ctime of a file, false where there is no ctime
+func statFile(path string) (manifestStat, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return manifestStat{}, false
+	}
+	ctime, ok := changeTime(info)
+	return manifestStat{size: info.Size(), ctime: ctime}, ok
+}
+
+// computeSHA256 hashes the whole file
+func computeSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeManifest writes SHA256SUMS for the current catalog after ops were
+// applied, and its stat file. The previous manifest's hash is reused for a
+// file the operations didn't touch whose size and ctime are still the ones
+// it was hashed at; everything else is hashed from disk.
+func writeManifest(ops []Operation) error {
+	manifestPath := filepath.Join(targetDir, manifestName)
+	statPath := filepath.Join(targetDir, manifestStatName)
+
+	cached, err := readManifest(manifestPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	stats, _ := readManifestStats(statPath)
+
+	touched := make(map[string]bool)
+	for _, op := range ops {
+		touched[filepath.ToSlash(op.From)] = true
+		if op.To != "" {
+			touched[filepath.ToSlash(op.To)] = true
+		}
+	}
+
+	// setCatalog replaces the slice, so a copy of the header is enough
+	catalogMu.RLock()
+	files := catalog
+	catalogMu.RUnlock()
+
+	var lines, statLines []string
+	hashed, reused := 0, 0
+	for _, entry := range files {
+		rel := filepath.ToSlash(entry.Path)
+		if isManifestFile(rel) {
+			continue
+		}
+		full := filepath.Join(targetDir, entry.Path)
+		// Stat before hashing: a write while it is read changes the ctime
+		// and the next manifest hashes the file again
+		st, statOK := statFile(full)
+		hash, ok := cached[rel]
+		if prev, seen := stats[rel]; ok && seen && statOK && !touched[rel] && prev == st && st.size == entry.Size {
+			reused++
+		} else {
+			hash, err = computeSHA256(full)
+			if err != nil {
+				return fmt.Errorf("hashing %s: %w", rel, err)
+			}
+			hashed++
+		}
+		lines = append(lines, hash+"  "+rel)
+		if statOK {
+			statLines = append(statLines, fmt.Sprintf("%d %d %s", st.size, st.ctime, rel))
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][sha256.Size*2+2:] < lines[j][sha256.Size*2+2:] })
+
+	if err := writeLines(manifestPath, lines); err != nil {
+		return err
+	}
+	if err := writeLines(statPath, statLines); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s: %d files (%d hashed, %d cached)\n", manifestName, len(lines), hashed, reused)
+	return nil
+}
+
+// writeLines replaces a file with lines through a temporary file
+func writeLines(path string, lines []string) error {
+	tmpPath := path + ".tmp"
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	if err := os.WriteFile(tmpPath, []byte(content), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
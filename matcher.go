@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// matcherCmd is the -matcher-cmd program that pairs up files the built-in
+// matching couldn't, e.g. by parsing episode numbers out of names
+var matcherCmd string
+
+// matcherTimeout bounds a single matcher run
+const matcherTimeout = 2 * time.Minute
+
+// MatchCandidates is written to the matcher's stdin: source files missing
+// on the target, and target files that would be deleted
+type MatchCandidates struct {
+	Source []FileEntry `json:"source"`
+	Target []FileEntry `json:"target"`
+}
+
+// MatchDecision pairs a source path with the target file that should be
+// moved there. The matcher prints {"matches": [...]} on stdout.
+type MatchDecision struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// runMatcher pipes the candidates through -matcher-cmd and returns the
+// decisions that refer to actual candidates, each file used at most once
+func runMatcher(c MatchCandidates) ([]MatchDecision, error) {
+	input, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), matcherTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", matcherCmd)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", matcherCmd)
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("matcher %q failed: %v", matcherCmd, err)
+	}
+
+	var result struct {
+		Matches []MatchDecision `json:"matches"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("matcher %q printed invalid JSON: %v", matcherCmd, err)
+	}
+
+	sources := make(map[string]bool, len(c.Source))
+	for _, e := range c.Source {
+		sources[e.Path] = true
+	}
+	targets := make(map[string]bool, len(c.Target))
+	for _, e := range c.Target {
+		targets[e.Path] = true
+	}
+	var valid []MatchDecision
+	for _, m := range result.Matches {
+		if !sources[m.Source] || !targets[m.Target] {
+			fmt.Fprintf(os.Stderr, "Warning: matcher returned unknown pair %s <- %s, ignored\n", m.Source, m.Target)
+			continue
+		}
+		delete(sources, m.Source)
+		delete(targets, m.Target)
+		valid = append(valid, m)
+	}
+	return valid, nil
+}
+
+// applyMatcher lets -matcher-cmd turn missing + delete pairs into moves
+func applyMatcher(ops []Operation, source, target []FileEntry) []Operation {
+	srcByPath := make(map[string]FileEntry, len(source))
+	for _, e := range source {
+		srcByPath[e.Path] = e
+	}
+	dstByPath := make(map[string]FileEntry, len(target))
+	for _, e := range target {
+		dstByPath[e.Path] = e
+	}
+
+	var c MatchCandidates
+	for _, op := range ops {
+		switch op.Type {
+		case "missing":
+			c.Source = append(c.Source, srcByPath[op.From])
+		case "rm":
+			c.Target = append(c.Target, dstByPath[op.From])
+		}
+	}
+	if len(c.Source) == 0 || len(c.Target) == 0 {
+		return ops
+	}
+
+	matches, err := runMatcher(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		return ops
+	}
+	if len(matches) == 0 {
+		return ops
+	}
+
+	matchedSource := make(map[string]string, len(matches))
+	matchedTarget := make(map[string]bool, len(matches))
+	for _, m := range matches {
+		matchedSource[m.Source] = m.Target
+		matchedTarget[m.Target] = true
+	}
+	result := ops[:0:0]
+	for _, op := range ops {
+		switch {
+		case op.Type == "missing" && matchedSource[op.From] != "":
+			result = append(result, Operation{Type: "mv", From: matchedSource[op.From], To: op.From, Reason: "paired by -matcher-cmd", Confidence: matcherConfidence})
+		case op.Type == "rm" && matchedTarget[op.From]:
+			// Replaced by the move above
+		default:
+			result = append(result, op)
+		}
+	}
+	return result
+}
+
+// handleMatch runs -matcher-cmd for the UI's diff: POST MatchCandidates,
+// get back {"matches": [...]}
+func handleMatch(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if matcherCmd == "" {
+		http.Error(w, "No matcher configured", http.StatusNotFound)
+		return
+	}
+
+	var c MatchCandidates
+	if err := json.NewDecoder(requestBody(w, r, maxPlanBytes)).Decode(&c); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	matches, err := runMatcher(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if matches == nil {
+		matches = []MatchDecision{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"matches": matches})
+}
+
+// matcherAvailable reports -matcher-cmd to the UI
+func matcherAvailable() bool {
+	return strings.TrimSpace(matcherCmd) != ""
+}
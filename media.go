@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// libraryServer is one -library-scan media server, told to rescan the
+// folders a plan changed so its library follows the reorganization
+type libraryServer struct {
+	kind  string // plex, jellyfin or emby
+	url   string
+	token string
+	root  string // The target as the media server sees it, e.g. /data in its container
+}
+
+// libraryList is the repeatable -library-scan flag: the kind followed by
+// comma-separated options, e.g. "plex,url=http://nas:32400,token=abc" or
+// "jellyfin,url=http://nas:8096,token=abc,root=/media"
+type libraryList []libraryServer
+
+func (l *libraryList) String() string {
+	kinds := make([]string, len(*l))
+	for i, s := range *l {
+		kinds[i] = s.kind + " " + s.url
+	}
+	return strings.Join(kinds, ", ")
+}
+
+func (l *libraryList) Set(value string) error {
+	parts := strings.Split(value, ",")
+	s := libraryServer{kind: strings.TrimSpace(parts[0])}
+	if s.kind != "plex" && s.kind != "jellyfin" && s.kind != "emby" {
+		return fmt.Errorf("unknown media server %q, expected plex, jellyfin or emby", s.kind)
+	}
+	for _, opt := range parts[1:] {
+		key, val, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch key {
+		case "url":
+			s.url = strings.TrimSuffix(val, "/")
+		case "token":
+			s.token = val
+		case "root":
+			s.root = strings.TrimSuffix(val, "/")
+		default:
+			return fmt.Errorf("%s: unknown option %q (url, token or root)", s.kind, opt)
+		}
+	}
+	if s.url == "" {
+		return fmt.Errorf("%s: url= is required", s.kind)
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+// libraryServers is -library-scan
+var libraryServers libraryList
+
+// libraryClient talks to the media servers; a scan only has to be started
+var libraryClient = &http.Client{Timeout: 30 * time.Second}
+
+// changedFolders returns the folders of the target that operations put
+// files into or took files out of, without those inside another one of
+// them. A folder that no longer exists is replaced by its nearest existing
+// parent.
+func changedFolders(ops []Operation) []string {
+	seen := make(map[string]bool)
+	add := func(rel string) {
+		if rel == "" {
+			return
+		}
+		dir := path.Dir(rel)
+		for dir != "." {
+			if info, err := os.Stat(filepath.Join(targetDir, filepath.FromSlash(dir))); err == nil && info.IsDir() {
+				break
+			}
+			dir = path.Dir(dir)
+		}
+		seen[dir] = true
+	}
+	for _, op := range ops {
+		switch op.Type {
+		case "mv":
+			add(op.From)
+			add(op.To)
+		case "rm", "placeholder":
+			add(op.From)
+		case "cp", "symlink", "hardlink", "import":
+			add(op.To)
+		}
+	}
+	if seen["."] {
+		return []string{"."}
+	}
+
+	var folders []string
+	for dir := range seen {
+		folders = append(folders, dir)
+	}
+	sort.Strings(folders)
+	var top []string
+	for _, dir := range folders {
+		if len(top) > 0 && strings.HasPrefix(dir, top[len(top)-1]+"/") {
+			continue
+		}
+		top = append(top, dir)
+	}
+	return top
+}
+
+// notifyLibraries asks each -library-scan server to rescan the folders the
+// operations changed. Failures are only warned about: the plan is done.
+func notifyLibraries(ops []Operation) {
+	if len(libraryServers) == 0 {
+		return
+	}
+	folders := changedFolders(ops)
+	if len(folders) == 0 {
+		return
+	}
+	for _, s := range libraryServers {
+		var paths []string
+		for _, dir := range folders {
+			paths = append(paths, s.path(dir))
+		}
+		var err error
+		if s.kind == "plex" {
+			err = s.scanPlex(paths)
+		} else {
+			err = s.scanJellyfin(paths)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not ask %s at %s to rescan: %v\n", s.kind, s.url, err)
+			continue
+		}
+		fmt.Printf(tr("Asked %s to rescan %d folders\n"), s.kind, len(paths))
+	}
+}
+
+// path is where the media server finds a folder of the target
+func (s libraryServer) path(rel string) string {
+	root := s.root
+	if root == "" {
+		root = filepath.ToSlash(targetDir)
+	}
+	if rel == "." {
+		return root
+	}
+	return root + "/" + rel
+}
+
+// do sends a request to the media server and checks the status
+func (s libraryServer) do(req *http.Request) (*http.Response, error) {
+	resp, err := libraryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", req.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+// scanPlex starts a partial scan of each folder in the library section
+// whose location holds it
+func (s libraryServer) scanPlex(paths []string) error {
+	req, err := http.NewRequest(http.MethodGet, s.url+"/library/sections", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Plex-Token", s.token)
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var sections struct {
+		Directory []struct {
+			Key      string `xml:"key,attr"`
+			Location []struct {
+				Path string `xml:"path,attr"`
+			} `xml:"Location"`
+		} `xml:"Directory"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&sections); err != nil {
+		return fmt.Errorf("invalid library sections: %v", err)
+	}
+
+	for _, p := range paths {
+		for _, dir := range sections.Directory {
+			for _, loc := range dir.Location {
+				loc := strings.TrimSuffix(loc.Path, "/")
+				// A folder above the section's location means the whole section
+				scan := p
+				switch {
+				case p == loc || strings.HasPrefix(p, loc+"/"):
+				case strings.HasPrefix(loc, p+"/"):
+					scan = loc
+				default:
+					continue
+				}
+				q := url.Values{"path": {scan}}
+				req, err := http.NewRequest(http.MethodGet, s.url+"/library/sections/"+dir.Key+"/refresh?"+q.Encode(), nil)
+				if err != nil {
+					return err
+				}
+				req.Header.Set("X-Plex-Token", s.token)
+				resp, err := s.do(req)
+				if err != nil {
+					return err
+				}
+				resp.Body.Close()
+			}
+		}
+	}
+	return nil
+}
+
+// scanJellyfin reports the folders as updated, which Jellyfin and Emby
+// answer with a scan of just those folders
+func (s libraryServer) scanJellyfin(paths []string) error {
+	type update struct {
+		Path       string `json:"Path"`
+		UpdateType string `json:"UpdateType"`
+	}
+	var body struct {
+		Updates []update `json:"Updates"`
+	}
+	for _, p := range paths {
+		body.Updates = append(body.Updates, update{Path: p, UpdateType: "Modified"})
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url+"/Library/Media/Updated", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Emby-Token", s.token)
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
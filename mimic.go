@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runMimic implements `dir-mimic mimic <source-dir> <target-dir>...`: with
+// both directories local, scan them, show the plan in the terminal and apply
+// it after confirmation, without the browser in between. Further targets
+// (mirrors of the first) get the plan computed for the first one.
+func runMimic(args []string) {
+	fs := flag.NewFlagSet("mimic", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "Execute without asking for confirmation")
+	dryRun := fs.Bool("dry-run", false, "Only show the plan")
+	copyMissing := fs.Bool("copy-missing", false, "Also copy missing and updated files from the source")
+	hashFlag := fs.Bool("H", false, "Compute sample hashes on both sides for matching")
+	mode := fs.String("mode", "relocate", "Comparison mode: relocate, strict or content")
+	conflict := fs.String("conflict", conflictStrategy, "Strict mode conflicts: source, newer, larger, keep-both or ask")
+	review := fs.Float64("review-below", 0, "Ask about operations with a lower match confidence (0-1) one by one, and leave them out with -yes")
+	dates := fs.Bool("photo-dates", false, "Read photo capture times from EXIF and match photos by capture time + size")
+	audio := fs.Bool("audio-hash", false, "Hash the audio data of MP3 and FLAC files, so retagged copies still match")
+	honorIgnore := fs.Bool("honor-ignore-files", false, "Don't catalog what .stignore and .rsync-filter files exclude")
+	matcher := fs.String("matcher-cmd", "", "Command that pairs up files left unmatched by the diff")
+	noDefaultIgnores := fs.Bool("no-default-ignores", false, "Disable built-in ignore patterns")
+	extraIgnores := fs.String("ignore", "", "Extra ignore patterns (comma-separated, matched against filename)")
+	sanitize := fs.Bool("sanitize-names", false, "Rename destinations the target's filesystem doesn't allow (e.g. \"a:b\" on exFAT) to names it does")
+	undoFile := fs.String("undo-file", "", "Write a plan that takes back what was done to this file")
+	snapshot := fs.String("snapshot", "", "Snapshot the target before executing: btrfs, zfs or apfs")
+	backupDirFlag := fs.String("backup-dir", "", "Keep files that moves and copies would overwrite in this directory")
+	backupSuffixFlag := fs.String("backup-suffix", "", "Keep files that moves and copies would overwrite next to them with this suffix, e.g. .bak")
+	stageDirFlag := fs.String("stage-dir", "", "Cache copied and imported files here by SHA-256 and link repeated copies from it (on the target's filesystem)")
+	newer := fs.String("exclude-newer", "", "Never delete or overwrite files modified within this age, e.g. 7d or 12h")
+	reserve := fs.String("reserve", "", "Pause while a copy would leave less than this free on its filesystem, e.g. 10G")
+	fs.Var(&libraryServers, "library-scan", "Ask this media server to rescan the changed folders afterwards: plex, jellyfin or emby with url=, token= and root= options (repeatable)")
+	checkpoint := fs.Int("checkpoint-every", 0, "Pause after every N operations and ask whether to continue, abort or roll back")
+	order := fs.String("delete-order", deleteOrder, "When deletes run: interleaved (plan order), first or last")
+	execOrder := fs.String("order", executionOrder, "Order of operations: plan, small-first (renames and small copies first), large-first or by-folder (one folder at a time)")
+	jsonFlag := fs.Bool("json", false, "Print a summary as JSON on stdout, the terminal output going to stderr")
+	noColor := fs.Bool("no-color", false, "Don't use colors in terminal output (also disabled by NO_COLOR)")
+	langFlag := fs.String("lang", "", "Language of terminal messages and the web UI: en, de or fi (default from LANG)")
+	configFile := fs.String("config", "", "Config file with named profiles")
+	profile := fs.String("profile", "", "Take flags not given on the command line from this profile")
+	fs.Parse(args)
+	if *jsonFlag {
+		setupJSONOutput()
+	}
+	if err := setupProfile(fs, *configFile, *profile, true); err != nil {
+		cliFail("%v", err)
+	}
+
+	if fs.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: dir-mimic mimic [-profile name] [-config file] [-yes] [-dry-run] [-copy-missing] [-sanitize-names] [-H] [-mode relocate|strict|content] [-conflict strategy] [-review-below score] [-photo-dates] [-audio-hash] [-honor-ignore-files] [-matcher-cmd cmd] [-snapshot fs] [-undo-file file] [-delete-order order] [-order order] [-exclude-newer age] [-reserve size] [-checkpoint-every n] [-library-scan server]... [-backup-dir dir | -backup-suffix s] [-stage-dir dir] [-json] [-no-color] [-lang code] [-no-default-ignores] [-ignore patterns] <source-dir> <target-dir>...\n")
+		cliFail("a source and at least one target directory are required")
+	}
+	if err := setLang(*langFlag); err != nil {
+		cliFail("%v", err)
+	}
+	if *noColor {
+		useColor = false
+	}
+	if *mode != "relocate" && *mode != "strict" && *mode != "content" {
+		cliFail("-mode must be relocate, strict or content")
+	}
+	if conflictStrategy = *conflict; !containsString(conflictStrategies, conflictStrategy) {
+		cliFail("-conflict must be one of %s", strings.Join(conflictStrategies, ", "))
+	}
+	if reviewBelow = *review; reviewBelow < 0 || reviewBelow > 1 {
+		cliFail("-review-below must be between 0 and 1")
+	}
+	if deleteOrder = *order; !containsString(deleteOrders, deleteOrder) {
+		cliFail("-delete-order must be interleaved, first or last")
+	}
+	if executionOrder = *execOrder; !containsString(executionOrders, executionOrder) {
+		cliFail("-order must be plan, small-first, large-first or by-folder")
+	}
+	if checkpointEvery = *checkpoint; checkpointEvery < 0 {
+		cliFail("-checkpoint-every must not be negative")
+	}
+	if checkpointEvery > 0 && *yes {
+		cliFail("-checkpoint-every needs someone to ask, it can't be combined with -yes")
+	}
+	var err error
+	if *newer != "" {
+		if excludeNewer, err = parseAge(*newer); err != nil {
+			cliFail("-exclude-newer: %v", err)
+		}
+	}
+	if *reserve != "" {
+		if diskReserve, err = parseSize(*reserve); err != nil {
+			cliFail("-reserve: %v", err)
+		}
+	}
+	snapshotKind = *snapshot
+	if !validSnapshotKind(snapshotKind) {
+		cliFail("-snapshot must be btrfs, zfs or apfs")
+	}
+	photoDates = *dates
+	audioHashing = *audio
+	honorIgnoreFiles = *honorIgnore
+	matcherCmd = *matcher
+	ignorePatterns = buildIgnorePatterns(*noDefaultIgnores, *extraIgnores)
+
+	for _, dir := range fs.Args() {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			cliFail("%s is not a directory", dir)
+		}
+	}
+	targets, err := resolveTargets(fs.Args()[1:])
+	if err != nil {
+		cliFail("%v", err)
+	}
+	if err := checkMultiTarget(targets, *stageDirFlag, *backupDirFlag, *undoFile); err != nil {
+		cliFail("%v", err)
+	}
+	targetDir = targets[0]
+	// Neither side may hold the other, or the plan would shuffle the source
+	srcDir, err := checkOutsideTargets("the source directory", fs.Arg(0), targets)
+	if err != nil {
+		cliFail("%v", err)
+	}
+	if err := setupBackups(*backupDirFlag, *backupSuffixFlag); err != nil {
+		cliFail("%v", err)
+	}
+	if err := setupStageDir(*stageDirFlag); err != nil {
+		cliFail("%v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Scanning source: %s\n", srcDir)
+	source, err := scanDirectory(srcDir, *hashFlag)
+	if err != nil {
+		cliFail("scanning source: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Scanning target: %s\n", targetDir)
+	target, err := scanDirectory(targetDir, *hashFlag)
+	if err != nil {
+		cliFail("scanning target: %v", err)
+	}
+	catalog = target.Files
+
+	ops := computePlan(source.Files, target.Files, target.Special, target.Mounts, *mode)
+	stdin := bufio.NewReader(os.Stdin)
+	// Low-confidence operations only make it into the plan when approved;
+	// a dry run shows them all
+	if reviewBelow > 0 && !*dryRun {
+		var in *bufio.Reader
+		if !*yes && stdinIsTerminal() {
+			in = stdin
+		}
+		var dropped int
+		if ops, dropped = reviewOperations(ops, in); dropped > 0 {
+			fmt.Printf(tr("Left out %d operations below -review-below %.2f\n"), dropped, reviewBelow)
+		}
+	}
+	if *copyMissing {
+		// The source is at hand: missing and updated files are imported
+		// from it, once everything else has made room
+		sourceDir = srcDir
+		var imports []Operation
+		kept := ops[:0]
+		for _, op := range importFromSource(ops) {
+			if op.Type == "import" {
+				imports = append(imports, op)
+			} else {
+				kept = append(kept, op)
+			}
+		}
+		ops = append(kept, imports...)
+	}
+	if *sanitize {
+		ops = sanitizeNames(ops)
+	}
+	ops = orderOperations(ops)
+	runs, err := prepareTargets(targets, ops, target.Files)
+	if err != nil {
+		cliFail("%v", err)
+	}
+	if len(runs) == 1 {
+		printProtected(runs[0].protected)
+	}
+	data, _ := json.Marshal(Plan{Version: planVersion, Operations: runs[0].ops})
+	sum := sha256.Sum256(data)
+	checksumHex := hex.EncodeToString(sum[:])
+	printPlan(runs[0].ops, runs[0].locked, checksumHex)
+	printTargets(runs)
+	summary := newRunSummary(runs[0].ops, checksumHex)
+
+	work := 0
+	for _, op := range ops {
+		if _, ok := opLabels[op.Type]; ok {
+			work++
+		}
+	}
+	if work == 0 {
+		fmt.Println(tr("Nothing to do."))
+		summary.exit(planCode(ops))
+	}
+	if *dryRun {
+		summary.exit(planCode(ops))
+	}
+	if err := checkTargetInodes(runs); err != nil {
+		cliFail("%v", err)
+	}
+
+	if !*yes {
+		if !stdinIsTerminal() {
+			cliFail("stdin is not a terminal to confirm on, use -yes")
+		}
+		if !confirmPrompt(stdin) {
+			fmt.Println(tr("Aborted."))
+			summary.exit(exitAborted)
+		}
+	}
+
+	if checkpointEvery > 0 {
+		askCheckpoint = func(done, total int) string { return checkpointPrompt(stdin, done, total) }
+	}
+	results := executeOnTargets(runs, func(run targetRun, errors []string) {
+		notifyLibraries(run.ops)
+	})
+	code := summary.addResults(results)
+	if *undoFile != "" && results[0].undo != nil {
+		if err := writeUndoPlan(*undoFile, results[0].undo); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not write the undo plan: %v\n", err)
+			summary.Error = "could not write the undo plan: " + err.Error()
+			code = exitError
+		}
+	}
+	summary.exit(code)
+}
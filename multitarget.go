@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// targetRun is the plan as it will be executed on one of the targets of an
+// apply or mimic given several (a disk and its backup mirror, say). What
+// -exclude-newer holds back and which files are in use differ per target.
+type targetRun struct {
+	dir       string
+	ops       []Operation
+	protected []Operation
+	locked    map[int]bool
+	files     []FileEntry // What the target held before the plan
+	issues    int         // Operations a simulation against the target expects to fail
+}
+
+// targetResult is how executing the plan on one target went
+type targetResult struct {
+	dir      string
+	errors   []string
+	deferred []Operation
+	undo     *UndoPlan
+	skipped  bool // Not executed, because its snapshot failed
+}
+
+// resolveTargets makes the target directories absolute and checks them. The
+// same plan is applied to each, all at the same time.
+func resolveTargets(args []string) ([]string, error) {
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		dir, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		if seen[dir] {
+			return nil, fmt.Errorf("%s is given twice", dir)
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	for _, a := range dirs {
+		for _, b := range dirs {
+			if strings.HasPrefix(b, a+string(filepath.Separator)) {
+				return nil, fmt.Errorf("%s is inside %s, targets may not contain each other", b, a)
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// checkMultiTarget refuses the options that only make sense for one target
+func checkMultiTarget(dirs []string, stageDirFlag, backupDirFlag, undoFile string) error {
+	if len(dirs) < 2 {
+		return nil
+	}
+	switch {
+	case stageDirFlag != "":
+		return fmt.Errorf("-stage-dir must be on the target's filesystem, it can't be used with several targets")
+	case backupDirFlag != "":
+		return fmt.Errorf("-backup-dir can't be used with several targets, use -backup-suffix")
+	case undoFile != "":
+		return fmt.Errorf("-undo-file can't be used with several targets, each would need its own")
+	case checkpointEvery > 0:
+		return fmt.Errorf("-checkpoint-every can't be used with several targets, they run at the same time")
+	}
+	return nil
+}
+
+// checkOutsideTargets is checkOutsideTarget for every target
+func checkOutsideTargets(flagName, dir string, dirs []string) (string, error) {
+	defer func(dir string) { targetDir = dir }(targetDir)
+	var abs string
+	for _, targetDir = range dirs {
+		var err error
+		if abs, err = checkOutsideTarget(flagName, dir); err != nil {
+			return "", err
+		}
+	}
+	return abs, nil
+}
+
+// prepareTargets works out the plan for each target and scans it, unless
+// scanned already holds the first target's files. With several targets,
+// the plan is also simulated against each, so a mirror that no longer
+// matches the others shows up before anything is done.
+func prepareTargets(dirs []string, ops []Operation, scanned []FileEntry) ([]targetRun, error) {
+	var runs []targetRun
+	for i, dir := range dirs {
+		targetDir = dir
+		run := targetRun{dir: dir}
+		run.ops, run.protected = withoutProtected(ops)
+		run.locked = findLockedOps(run.ops)
+		if i == 0 && scanned != nil {
+			run.files = scanned
+		} else {
+			scan, err := scanDirectory(dir, false)
+			if err != nil {
+				return nil, fmt.Errorf("scanning %s: %v", dir, err)
+			}
+			run.files = scan.Files
+		}
+		if len(dirs) > 1 {
+			run.issues = len(simulatePlan(run.files, run.ops).Issues)
+		}
+		runs = append(runs, run)
+	}
+	targetDir = dirs[0]
+	return runs, nil
+}
+
+// checkTargetInodes is checkInodes for every target
+func checkTargetInodes(runs []targetRun) error {
+	defer func(dir string) { targetDir = dir }(targetDir)
+	for _, run := range runs {
+		targetDir = run.dir
+		if err := checkInodes(run.ops); err != nil {
+			if len(runs) > 1 {
+				return fmt.Errorf("%s: %v", run.dir, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// printTargets lists the targets the plan is going to be applied to, with
+// what differs between them
+func printTargets(runs []targetRun) {
+	if len(runs) < 2 {
+		return
+	}
+	fmt.Println(colorize(colorBold, fmt.Sprintf(tr("Applying to %d targets at the same time:"), len(runs))))
+	for i, run := range runs {
+		line := fmt.Sprintf("  %d. %s", i+1, run.dir)
+		if len(run.protected) > 0 {
+			line += fmt.Sprintf(tr(", %d protected"), len(run.protected))
+		}
+		if len(run.locked) > 0 {
+			line += fmt.Sprintf(tr(", %d in use"), len(run.locked))
+		}
+		if run.issues > 0 {
+			line += colorize(colorYellow, fmt.Sprintf(tr(", %d would fail (see apply -simulate)"), run.issues))
+		}
+		fmt.Println(line)
+	}
+}
+
+// executeOnTargets executes each target's plan, all targets at the same
+// time, each on its own applyTarget. With several targets, their terminal
+// lines start with the number printTargets gave them. after, if set, runs
+// for each executed target in turn once all are done, with targetDir
+// pointing at it.
+func executeOnTargets(runs []targetRun, after func(run targetRun, errors []string)) []targetResult {
+	results := make([]targetResult, len(runs))
+	var wg sync.WaitGroup
+	for i, run := range runs {
+		target := &applyTarget{dir: run.dir}
+		if len(runs) > 1 {
+			target.label = fmt.Sprintf("[%d] ", i+1)
+			if len(run.protected) > 0 {
+				fmt.Println("\n" + colorize(colorBold, fmt.Sprintf(tr("Target: %s"), run.dir)))
+				printProtected(run.protected)
+			}
+		}
+		wg.Add(1)
+		go func(i int, run targetRun, target *applyTarget) {
+			defer wg.Done()
+			result := targetResult{dir: run.dir}
+			if _, ok := target.snapshotBeforeApply(); !ok {
+				result.skipped = true
+				results[i] = result
+				return
+			}
+			result.errors, result.deferred, _, result.undo = target.executePlan(run.ops, run.locked)
+			for _, op := range result.deferred {
+				target.fprintf(os.Stderr, "  DEFERRED (in use): %s %s\n", op.Type, lockCheckPath(op))
+			}
+			results[i] = result
+		}(i, run, target)
+	}
+	wg.Wait()
+
+	if after != nil {
+		defer func(dir string) { targetDir = dir }(targetDir)
+		for i, run := range runs {
+			if !results[i].skipped {
+				targetDir = run.dir
+				after(run, results[i].errors)
+			}
+		}
+	}
+	printTargetResults(results)
+	return results
+}
+
+// printTargetResults sums up a run on several targets, one line each
+func printTargetResults(results []targetResult) {
+	if len(results) < 2 {
+		return
+	}
+	fmt.Println("\n" + colorize(colorBold, tr("Results per target:")))
+	for _, r := range results {
+		switch {
+		case r.skipped:
+			fmt.Printf("  %s %s: %s\n", colorize(colorRed, "SKIPPED"), r.dir, tr("snapshot failed, nothing done"))
+		case len(r.errors) > 0 || len(r.deferred) > 0:
+			fmt.Printf("  %s %s: "+tr("%d errors, %d deferred")+"\n", colorize(colorRed, "FAILED"), r.dir, len(r.errors), len(r.deferred))
+		default:
+			fmt.Printf("  %s %s\n", colorize(colorGreen, "OK"), r.dir)
+		}
+	}
+}
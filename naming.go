@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// namingRules are the limits the target's filesystem puts on paths. A
+// Linux-origin layout can have names that Windows, or an exFAT or NTFS drive
+// mounted on Linux, won't take, and the OS error for them says little
+// ("invalid argument").
+type namingRules struct {
+	fs      string // Named in messages, "" when only the name length is checked
+	windows bool   // Windows characters and names are not allowed
+	maxPath int    // Longest full path in UTF-16 units, 0 for no limit
+	root    string // The target directory, which counts towards maxPath
+}
+
+// name is the filesystem for messages
+func (r namingRules) name() string {
+	if r.fs == "" {
+		return "the target"
+	}
+	return r.fs
+}
+
+// windowsFilesystems are the types of Linux mounts with Windows naming rules
+var windowsFilesystems = map[string]bool{
+	"vfat": true, "msdos": true, "exfat": true, "ntfs": true, "ntfs3": true, "fuseblk": true,
+}
+
+var targetRules struct {
+	sync.Mutex
+	rules map[string]namingRules // Per target directory
+}
+
+// targetNamingRules returns the rules for the target
+func targetNamingRules() namingRules {
+	return namingRulesOf(targetDir)
+}
+
+// namingRulesOf returns the rules for the target dir, remembered per target
+// directory
+func namingRulesOf(dir string) namingRules {
+	targetRules.Lock()
+	defer targetRules.Unlock()
+	if rules, ok := targetRules.rules[dir]; ok {
+		return rules
+	}
+	if targetRules.rules == nil {
+		targetRules.rules = make(map[string]namingRules)
+	}
+	rules := namingRules{root: dir}
+	if runtime.GOOS == "windows" {
+		// MAX_PATH counts the terminating NUL
+		rules = namingRules{fs: "Windows", windows: true, maxPath: 259, root: dir}
+	} else if fstype := filesystemType(dir); windowsFilesystems[fstype] {
+		if fstype == "fuseblk" {
+			fstype = "NTFS (fuseblk)"
+		}
+		rules = namingRules{fs: fstype, windows: true, root: dir}
+	}
+	targetRules.rules[dir] = rules
+	return rules
+}
+
+// windowsReserved are the device names Windows won't take as a file name,
+// with or without an extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// nameProblem checks a destination path against the target's naming rules.
+// It returns the preflight kind, "illegal-name" or "path-too-long", and
+// what is wrong, or "" when the path is fine.
+func nameProblem(rel string, rules namingRules) (kind, detail string) {
+	for _, name := range strings.Split(rel, "/") {
+		length := len(name) // Bytes on Unix filesystems
+		if rules.windows {
+			length = len(utf16.Encode([]rune(name)))
+		}
+		if length > 255 {
+			return "illegal-name", fmt.Sprintf("%s is %d characters long, more than the 255 a name can have", name, length)
+		}
+		if !rules.windows {
+			continue
+		}
+		if i := strings.IndexFunc(name, func(r rune) bool { return r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r) }); i >= 0 {
+			return "illegal-name", fmt.Sprintf("%s has %q, which %s doesn't allow in names", printable(name), name[i:i+1], rules.fs)
+		}
+		if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+			return "illegal-name", fmt.Sprintf("%q ends in a dot or space, which %s doesn't allow", name, rules.fs)
+		}
+		base, _, _ := strings.Cut(name, ".")
+		if windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))] {
+			return "illegal-name", fmt.Sprintf("%s is a reserved device name on %s", name, rules.fs)
+		}
+	}
+	if rules.maxPath > 0 {
+		full := filepath.Join(rules.root, filepath.FromSlash(rel))
+		if length := len(utf16.Encode([]rune(full))); length > rules.maxPath {
+			return "path-too-long", fmt.Sprintf("%s is %d characters long, more than the %d of MAX_PATH that many %s programs are limited to",
+				rel, length, rules.maxPath, rules.fs)
+		}
+	}
+	return "", ""
+}
+
+// destination returns the path an operation creates in the target, or ""
+func destination(op Operation) string {
+	switch op.Type {
+	case "mv", "cp", "symlink", "hardlink", "import":
+		return op.To
+	case "placeholder":
+		return op.From
+	}
+	return ""
+}
+
+// sanitizeName makes a name the target allows: characters it doesn't take
+// become "_", trailing dots and spaces are dropped, a device name gets a "_"
+// and an overlong name is cut short before its extension
+func sanitizeName(name string, rules namingRules) string {
+	if rules.windows {
+		name = strings.Map(func(r rune) rune {
+			if r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r) {
+				return '_'
+			}
+			return r
+		}, name)
+		name = strings.TrimRight(name, ". ")
+		if name == "" {
+			name = "_"
+		}
+		base, ext, _ := strings.Cut(name, ".")
+		if windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))] {
+			name = base + "_"
+			if ext != "" {
+				name += "." + ext
+			}
+		}
+	}
+
+	length := func(s string) int {
+		if rules.windows {
+			return len(utf16.Encode([]rune(s)))
+		}
+		return len(s)
+	}
+	if length(name) > 255 {
+		ext := filepath.Ext(name)
+		if length(ext) > 32 {
+			ext = ""
+		}
+		runes := []rune(strings.TrimSuffix(name, ext))
+		for length(string(runes))+length(ext) > 255 {
+			runes = runes[:len(runes)-1]
+		}
+		name = string(runes) + ext
+	}
+	return name
+}
+
+// sanitizePath applies sanitizeName to every part of a path
+func sanitizePath(rel string, rules namingRules) string {
+	parts := strings.Split(rel, "/")
+	for i, name := range parts {
+		parts[i] = sanitizeName(name, rules)
+	}
+	return strings.Join(parts, "/")
+}
+
+// sanitizeOperations (-sanitize-names) gives the operations whose
+// destination the target doesn't allow a sanitized one instead, which
+// doesn't take the place of a file on the target or of another
+// destination. It returns the new operations and how many were renamed.
+func sanitizeOperations(ops []Operation) ([]Operation, int) {
+	rules := targetNamingRules()
+	taken := make(map[string]bool)
+	for _, op := range ops {
+		if dst := destination(op); dst != "" {
+			taken[strings.ToLower(dst)] = true
+		}
+	}
+	free := func(p string) bool {
+		_, err := os.Lstat(filepath.Join(targetDir, filepath.FromSlash(p)))
+		return !taken[strings.ToLower(p)] && os.IsNotExist(err)
+	}
+
+	out := make([]Operation, len(ops))
+	renamed := 0
+	for i, op := range ops {
+		out[i] = op
+		dst := destination(op)
+		if kind, _ := nameProblem(dst, rules); kind != "illegal-name" {
+			continue
+		}
+		clean := sanitizePath(dst, rules)
+		ext := path.Ext(clean)
+		stem := strings.TrimSuffix(clean, ext)
+		for n := 2; !free(clean); n++ {
+			clean = stem + " (" + strconv.Itoa(n) + ")" + ext
+		}
+		taken[strings.ToLower(clean)] = true
+		reason := "renamed from " + dst + " for " + rules.name()
+		if op.Reason != "" {
+			reason = op.Reason + "; " + reason
+		}
+		if op.Type == "placeholder" {
+			out[i].From = clean
+		} else {
+			out[i].To = clean
+		}
+		out[i].Reason = reason
+		renamed++
+	}
+	return out, renamed
+}
+
+// sanitizeNames runs sanitizeOperations for -sanitize-names and says how
+// many operations it renamed
+func sanitizeNames(ops []Operation) []Operation {
+	ops, renamed := sanitizeOperations(ops)
+	if renamed > 0 {
+		fmt.Printf(tr("Renamed %d destinations to names %s allows\n"), renamed, targetNamingRules().name())
+	}
+	return ops
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// neverTouch holds the config file's never-touch rules. A rule without a
+// slash is a name (glob) matched against every folder and file name, like
+// "@eaDir" or "#recycle"; a rule starting with one is a path from the top of
+// the target, like "/Photos/raw", covering everything below it. Plans never
+// delete, move or write anything a rule covers.
+var neverTouch struct {
+	sync.RWMutex
+	rules []string
+}
+
+// configPath is the config file in use, where rules added in the UI are saved
+var configPath string
+
+// neverTouchRules returns a copy of the current rules
+func neverTouchRules() []string {
+	neverTouch.RLock()
+	defer neverTouch.RUnlock()
+	return append([]string{}, neverTouch.rules...)
+}
+
+// neverTouched reports whether a rule covers the target-relative path
+func neverTouched(rel string) bool {
+	neverTouch.RLock()
+	defer neverTouch.RUnlock()
+	parts := strings.Split(rel, "/")
+	for _, rule := range neverTouch.rules {
+		if anchored, ok := strings.CutPrefix(rule, "/"); ok {
+			if rel == anchored || strings.HasPrefix(rel, anchored+"/") {
+				return true
+			}
+			continue
+		}
+		for _, part := range parts {
+			if matched, _ := path.Match(rule, part); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// touchesNeverTouched reports whether an operation deletes, moves or writes
+// something a rule covers. Missing files count too: they'd be copied there.
+func touchesNeverTouched(op Operation) bool {
+	switch op.Type {
+	case "mv":
+		return neverTouched(op.From) || neverTouched(op.To)
+	case "cp", "symlink", "hardlink", "import":
+		return neverTouched(op.To)
+	case "rm", "update", "missing", "placeholder":
+		return neverTouched(op.From)
+	}
+	return false
+}
+
+// withoutNeverTouched drops the operations on never-touch paths and returns
+// how many there were
+func withoutNeverTouched(ops []Operation) ([]Operation, int) {
+	kept := make([]Operation, 0, len(ops))
+	for _, op := range ops {
+		if !touchesNeverTouched(op) {
+			kept = append(kept, op)
+		}
+	}
+	return kept, len(ops) - len(kept)
+}
+
+// skipNeverTouched drops the operations of a posted or loaded plan that
+// touch never-touch paths, saying so on the terminal
+func skipNeverTouched(ops []Operation) []Operation {
+	ops, skipped := withoutNeverTouched(ops)
+	printSkippedNeverTouched(skipped)
+	return ops
+}
+
+// printSkippedNeverTouched tells the terminal how many operations were left
+// out for never-touch rules
+func printSkippedNeverTouched(skipped int) {
+	if skipped > 0 {
+		fmt.Println(colorize(colorYellow, fmt.Sprintf("Skipping %d operations on never-touch paths", skipped)))
+	}
+}
+
+// cleanRule normalizes a rule from the UI or the config file and rejects
+// ones that can't work. Any rule with a slash is a path: "Photos/raw" and
+// "./Photos/raw/" become "/Photos/raw".
+func cleanRule(raw string) (string, error) {
+	rule := strings.TrimSpace(filepath.ToSlash(raw))
+	anchored := strings.Contains(rule, "/")
+	rule = strings.TrimPrefix(strings.Trim(rule, "/"), "./")
+	if rule == "" || rule == "." {
+		return "", fmt.Errorf("empty rule")
+	}
+	for _, part := range strings.Split(rule, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("rule %q leaves the target", raw)
+		}
+	}
+	if _, err := path.Match(rule, ""); err != nil {
+		return "", fmt.Errorf("rule %q: %v", raw, err)
+	}
+	if anchored {
+		rule = "/" + rule
+	}
+	return rule, nil
+}
+
+// saveNeverTouch writes the rules to the config file, keeping everything
+// else in it as it was
+func saveNeverTouch(rules []string) error {
+	if configPath == "" {
+		return fmt.Errorf("no config file to save to")
+	}
+	config := make(map[string]json.RawMessage)
+	data, err := os.ReadFile(configPath)
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("%s: %v", configPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(rules) == 0 {
+		delete(config, "neverTouch")
+	} else if config["neverTouch"], err = json.Marshal(rules); err != nil {
+		return err
+	}
+	if data, err = json.MarshalIndent(config, "", "  "); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return err
+	}
+	tmp := configPath + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, configPath)
+}
+
+// handleNeverTouch adds (POST {"rule": "..."}) or removes (DELETE ?rule=...)
+// a never-touch rule, saves the config file and returns the rules
+func handleNeverTouch(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	var raw string
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Rule string `json:"rule"`
+		}
+		if err := json.NewDecoder(requestBody(w, r, maxPlanBytes)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		raw = req.Rule
+	case http.MethodDelete:
+		raw = r.URL.Query().Get("rule")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rule, err := cleanRule(raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	neverTouch.Lock()
+	var rules []string
+	for _, existing := range neverTouch.rules {
+		if existing != rule {
+			rules = append(rules, existing)
+		}
+	}
+	if r.Method == http.MethodPost {
+		rules = append(rules, rule)
+	}
+	if err := saveNeverTouch(rules); err != nil {
+		neverTouch.Unlock()
+		http.Error(w, "Saving the config failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	neverTouch.rules = rules
+	neverTouch.Unlock()
+	fmt.Fprintf(os.Stderr, "Never-touch rules: %s\n", strings.Join(rules, ", "))
+
+	// The /tree and /export plan is recomputed with the new rules
+	planCache.Lock()
+	planCache.ops = nil
+	planCache.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(neverTouchRules())
+}
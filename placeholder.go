@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// placeholderList is the file in the target's root that lists the stubs
+// created by placeholders, one JSON object per line, so scans can tell
+// them from real files. Entries of stubs replaced since are left in it:
+// they no longer match (see readPlaceholders).
+const placeholderList = ".dir-mimic-placeholders"
+
+// placeholderMTime is the mtime of every stub instead of the source file's:
+// rsync's quick check sees it differ and copies the real file over it
+var placeholderMTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// placeholderEntry is one line of the placeholder list
+type placeholderEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// readPlaceholders returns the stubs listed in a root's placeholder list,
+// path -> size
+func readPlaceholders(root string) map[string]int64 {
+	f, err := os.Open(filepath.Join(root, placeholderList))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	stubs := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry placeholderEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			stubs[entry.Path] = entry.Size
+		}
+	}
+	return stubs
+}
+
+// isStub reports whether a file is still the stub a placeholder created:
+// listed, and with the stub's size and mtime. Copying the real file over
+// it changes the mtime.
+func isStub(stubs map[string]int64, rel string, info os.FileInfo) bool {
+	size, ok := stubs[rel]
+	return ok && info.Size() == size && info.ModTime().Equal(placeholderMTime)
+}
+
+// executePlaceholder creates a stub for a file that is still missing on the
+// target, so the layout can be browsed and checked before the data arrives.
+// The stub is empty, or a sparse file of the real size when op.Sparse is
+// set, dated placeholderMTime and recorded in the placeholder list, so
+// scans leave it out and the file still counts as missing. Existing files
+// are never replaced; a stub that is already there is kept.
+func (t *applyTarget) executePlaceholder(op Operation) error {
+	path := filepath.Join(t.dir, op.From)
+	if info, err := os.Lstat(path); err == nil && isStub(readPlaceholders(t.dir), op.From, info) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if op.Sparse && op.Size > 0 {
+		// Truncate extends without writing, so no blocks are allocated
+		if err := f.Truncate(op.Size); err != nil {
+			f.Close()
+			os.Remove(path)
+			return err
+		}
+		size = op.Size
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(path, placeholderMTime, placeholderMTime); err != nil {
+		return err
+	}
+
+	list, err := os.OpenFile(filepath.Join(t.dir, placeholderList), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	line, _ := json.Marshal(placeholderEntry{Path: op.From, Size: size})
+	if _, err := list.Write(append(line, '\n')); err != nil {
+		list.Close()
+		return err
+	}
+	return list.Close()
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"compress/gzip"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/jokkebk/dir-mimic/planspec"
+)
+
+// Limits for plans posted to /apply (-max-plan-ops, -max-plan-size)
+var (
+	maxPlanOps   = 1000000
+	maxPlanBytes = int64(256 << 20)
+)
+
+// errPlanTooLarge is returned when a plan exceeds maxPlanOps or maxPlanBytes
+var errPlanTooLarge = errors.New("plan too large")
+
+// errUnsupportedEncoding is returned for a request body compressed other
+// than with gzip
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding, only gzip is accepted")
+
+// requestBody returns the body of a request with a plan or catalog,
+// decompressing it if it was sent with Content-Encoding: gzip, for clients
+// on slow links. The body is limited to limit bytes both as sent and as
+// decompressed, so a small gzip bomb can't unpack into gigabytes; reading
+// past it fails with *http.MaxBytesError.
+func requestBody(w http.ResponseWriter, r *http.Request, limit int64) io.Reader {
+	body := http.MaxBytesReader(w, r.Body, limit)
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return body
+	case "gzip", "x-gzip":
+		return &gzipBody{body: body, limit: limit}
+	}
+	return errReader{errUnsupportedEncoding}
+}
+
+// gzipBody decompresses a request body on the first read, up to limit bytes
+type gzipBody struct {
+	body  io.Reader
+	r     io.Reader
+	read  int64
+	limit int64
+}
+
+func (g *gzipBody) Read(p []byte) (int, error) {
+	if g.r == nil {
+		zr, err := gzip.NewReader(g.body)
+		if err != nil {
+			return 0, fmt.Errorf("gzip: %w", err)
+		}
+		g.r = io.LimitReader(zr, g.limit+1)
+	}
+	n, err := g.r.Read(p)
+	if g.read += int64(n); g.read > g.limit {
+		return 0, &http.MaxBytesError{Limit: g.limit}
+	}
+	return n, err
+}
+
+// errReader fails every read with err
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+
+// validateOperation checks a single operation, already checked against the
+// schema (planspec.CheckOperation), before it is accepted into a plan. Paths
+// of executable operations must be inside the target, not the target itself.
+func validateOperation(op Operation) error {
+	switch op.Type {
+	case "import":
+		if _, err := resolveOpPath(targetDir, op.To); err != nil {
+			return err
+		}
+		return validateImport(op)
+	case "rm", "placeholder":
+		_, err := resolveOpPath(targetDir, op.From)
+		return err
+	case "mv", "cp", "symlink", "hardlink":
+		if _, err := resolveOpPath(targetDir, op.From); err != nil {
+			return err
+		}
+		_, err := resolveOpPath(targetDir, op.To)
+		return err
+	}
+	// Informational only, never executed
+	return nil
+}
+
+// decodePlan reads a plan straight from r, one operation at a time, so the
+// raw body is never held in memory and reading only continues as fast as
+// operations are validated. It returns the SHA-256 of all bytes read.
+func decodePlan(r io.Reader) (*Plan, string, error) {
+	h := sha256.New()
+	dec := json.NewDecoder(io.TeeReader(r, h))
+	plan := &Plan{}
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, "", err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, "", err
+		}
+		key, _ := tok.(string)
+		if key == "version" {
+			// Checked as soon as it is read, so a newer plan fails on its
+			// version rather than on an operation this build doesn't know
+			if err := dec.Decode(&plan.Version); err != nil {
+				return nil, "", fieldError("/version", err)
+			}
+			if err := checkVersion("plan", plan.Version, planVersion); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+		if key == "catalogSeq" {
+			if err := dec.Decode(&plan.CatalogSeq); err != nil {
+				return nil, "", fieldError("/catalogSeq", err)
+			}
+			continue
+		}
+		if key != "operations" {
+			// Unknown fields are skipped without keeping them around
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+
+		if err := expectDelim(dec, '['); err != nil {
+			return nil, "", err
+		}
+		for dec.More() {
+			if len(plan.Operations) >= maxPlanOps {
+				return nil, "", fmt.Errorf("%w: more than %d operations", errPlanTooLarge, maxPlanOps)
+			}
+			var op Operation
+			n := len(plan.Operations)
+			if err := dec.Decode(&op); err != nil {
+				return nil, "", fieldError(fmt.Sprintf("/operations/%d", n), err)
+			}
+			if err := planspec.CheckOperation(n, op); err != nil {
+				return nil, "", err
+			}
+			if err := validateOperation(op); err != nil {
+				return nil, "", fmt.Errorf("/operations/%d: %w", n, err)
+			}
+			plan.Operations = append(plan.Operations, op)
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, "", err
+	}
+
+	// The checksum covers the whole body, including anything after the object
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, "", err
+	}
+	return plan, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fieldError points a JSON type error at the plan field it is about, e.g.
+// a string where /operations/3/size needs a number
+func fieldError(path string, err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+	if typeErr.Field != "" {
+		path += "/" + strings.ReplaceAll(typeErr.Field, ".", "/")
+	}
+	want := "a string"
+	switch typeErr.Type.Kind() {
+	case reflect.Int, reflect.Int64:
+		want = "an integer"
+	case reflect.Float64:
+		want = "a number"
+	case reflect.Bool:
+		want = "true or false"
+	case reflect.Struct:
+		want = "an object"
+	}
+	return &planspec.Error{Path: path, Message: fmt.Sprintf("must be %s, not a JSON %s", want, typeErr.Value)}
+}
+
+// handlePlanSchema serves the JSON Schema of plans
+func handlePlanSchema(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(planspec.Schema)
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %q, got %v", want, tok)
+	}
+	return nil
+}
+
+// planError maps a decodePlan error to an HTTP status
+func planError(w http.ResponseWriter, err error) {
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooBig):
+		http.Error(w, fmt.Sprintf("Plan larger than %s", formatSize(maxPlanBytes)), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errPlanTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errUnsupportedEncoding):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		http.Error(w, "Invalid plan: "+err.Error(), http.StatusBadRequest)
+	}
+}
+
+// deleteOrder is -delete-order: "interleaved" runs operations in plan
+// order, "first" runs deletes before everything else (to free space on a
+// full disk), "last" after everything else (so nothing is lost if a move or
+// copy fails halfway)
+var deleteOrder = "interleaved"
+
+var deleteOrders = []string{"interleaved", "first", "last"}
+
+// executionOrder is -order: "plan" runs operations in plan order,
+// "small-first" runs the quick ones (moves, links, deletes, small copies)
+// first and the longest copies last, "large-first" the other way round, and
+// "by-folder" finishes one folder before it starts the next
+var executionOrder = "plan"
+
+var executionOrders = []string{"plan", "small-first", "large-first", "by-folder"}
+
+// orderOperations moves deletes to the front or back of the plan according
+// to deleteOrder, and orders each part by executionOrder
+func orderOperations(ops []Operation) []Operation {
+	if deleteOrder == "interleaved" {
+		return sortOperations(ops)
+	}
+	deletes := make([]Operation, 0, len(ops))
+	others := make([]Operation, 0, len(ops))
+	for _, op := range ops {
+		if op.Type == "rm" {
+			deletes = append(deletes, op)
+		} else {
+			others = append(others, op)
+		}
+	}
+	if deleteOrder == "first" {
+		return append(sortOperations(deletes), sortOperations(others)...)
+	}
+	return append(sortOperations(others), sortOperations(deletes)...)
+}
+
+// targetPaths returns the paths in the target an operation reads or writes
+func targetPaths(op Operation) []string {
+	if op.Type == "import" {
+		return []string{op.To} // From is in the source
+	}
+	if op.To == "" {
+		return []string{op.From}
+	}
+	return []string{op.From, op.To}
+}
+
+// sortOperations reorders ops by executionOrder. An operation never moves
+// ahead of an earlier one that touches the same path, or the path of a
+// folder above its destination, so a move that frees a path for another
+// still runs first.
+func sortOperations(ops []Operation) []Operation {
+	if executionOrder == "plan" || len(ops) < 2 {
+		return ops
+	}
+
+	// after[i] are the operations that wait for operation i, waiting[j] how
+	// many operation j still waits for
+	after := make([][]int, len(ops))
+	waiting := make([]int, len(ops))
+	last := make(map[string]int) // Path -> last operation touching it
+	for j, op := range ops {
+		for _, p := range targetPaths(op) {
+			if i, ok := last[p]; ok {
+				after[i] = append(after[i], j)
+				waiting[j]++
+			}
+			last[p] = j
+		}
+		if dst := destination(op); dst != "" {
+			for dir := path.Dir(dst); dir != "." && dir != "/"; dir = path.Dir(dir) {
+				if i, ok := last[dir]; ok {
+					after[i] = append(after[i], j)
+					waiting[j]++
+				}
+			}
+		}
+	}
+
+	q := &opQueue{}
+	switch executionOrder {
+	case "small-first", "large-first":
+		bytes := make([]int64, len(ops))
+		target := currentTarget()
+		for i, op := range ops {
+			bytes[i] = target.spaceNeeded(op)
+		}
+		large := executionOrder == "large-first"
+		q.less = func(a, b int) bool {
+			if bytes[a] != bytes[b] {
+				return (bytes[a] > bytes[b]) == large
+			}
+			return a < b
+		}
+	case "by-folder":
+		folders := make([]string, len(ops))
+		for i, op := range ops {
+			p := destination(op)
+			if p == "" {
+				p = op.From
+			}
+			folders[i] = path.Dir(p)
+		}
+		q.less = func(a, b int) bool {
+			if folders[a] != folders[b] {
+				return folders[a] < folders[b]
+			}
+			return a < b
+		}
+	}
+
+	// Always run the first ready operation by the order
+	for i := range ops {
+		if waiting[i] == 0 {
+			heap.Push(q, i)
+		}
+	}
+	sorted := make([]Operation, 0, len(ops))
+	for q.Len() > 0 {
+		i := heap.Pop(q).(int)
+		sorted = append(sorted, ops[i])
+		for _, j := range after[i] {
+			if waiting[j]--; waiting[j] == 0 {
+				heap.Push(q, j)
+			}
+		}
+	}
+	return sorted
+}
+
+// opQueue is a heap of operation indexes, the first by less on top
+type opQueue struct {
+	items []int
+	less  func(a, b int) bool
+}
+
+func (q *opQueue) Len() int           { return len(q.items) }
+func (q *opQueue) Less(i, j int) bool { return q.less(q.items[i], q.items[j]) }
+func (q *opQueue) Swap(i, j int)      { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *opQueue) Push(x interface{}) { q.items = append(q.items, x.(int)) }
+func (q *opQueue) Pop() interface{} {
+	n := len(q.items)
+	x := q.items[n-1]
+	q.items = q.items[:n-1]
+	return x
+}
@@ -0,0 +1,109 @@
+// Package planspec describes the plan format of dir-mimic, for tools that
+// write plans for it or read the plans it writes: the Go types, and the same
+// format as a JSON Schema (Schema, which the server also serves at
+// /schema/plan.json).
+package planspec
+
+import (
+	_ "embed"
+	"fmt"
+	"regexp"
+)
+
+// Version is the plan format version described here. Plans carry it in
+// their "version" field; dir-mimic refuses plans with a newer one.
+const Version = 1
+
+// Schema is the JSON Schema of a plan
+//
+//go:embed plan.schema.json
+var Schema []byte
+
+// Operation represents a file operation to perform
+type Operation struct {
+	Type   string `json:"type"` // "mv", "cp", "rm", "symlink", "hardlink", "placeholder", "import", "missing", "update"
+	From   string `json:"from"`
+	To     string `json:"to,omitempty"`
+	Size   int64  `json:"size,omitempty"`   // Informational, e.g. bytes a missing file needs from the source
+	MTime  int64  `json:"mtime,omitempty"`  // Placeholders: mtime of the source file
+	Sparse bool   `json:"sparse,omitempty"` // Placeholders: sparse file of Size bytes instead of an empty one
+	// Imports: where From is, "" for -source-dir, "upload" for a file sent
+	// to /upload, "url" when From is a URL
+	Source string `json:"source,omitempty"`
+	SHA256 string `json:"sha256,omitempty"` // Imports: checked against the data before it is put in place
+	Reason string `json:"reason,omitempty"` // Why the diff proposes it, e.g. "unique name+size match"
+	// How sure the diff is that the operation is right, 0-1 (missing = 1)
+	Confidence float64 `json:"confidence,omitempty"`
+}
+
+// Plan is a list of operations, optionally tied to the catalog version it
+// was computed against
+type Plan struct {
+	Version    int         `json:"version"`
+	Operations []Operation `json:"operations"`
+	CatalogSeq int64       `json:"catalogSeq,omitempty"`
+}
+
+// Error is where a plan doesn't match the schema: Path is a JSON Pointer
+// into the plan, like "/operations/3/to"
+type Error struct {
+	Path    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// Operation types, with whether they need a destination
+var opTypes = map[string]bool{
+	"mv": true, "cp": true, "symlink": true, "hardlink": true, "import": true,
+	"rm": false, "placeholder": false,
+	// Informational only, never executed
+	"missing": false, "update": false, "special": false,
+}
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// CheckOperation checks operation i (from 0) of a plan against the schema
+func CheckOperation(i int, op Operation) error {
+	fail := func(field, format string, args ...interface{}) error {
+		return &Error{Path: fmt.Sprintf("/operations/%d/%s", i, field), Message: fmt.Sprintf(format, args...)}
+	}
+	needsTo, known := opTypes[op.Type]
+	switch {
+	case op.Type == "":
+		return fail("type", "missing")
+	case !known:
+		return fail("type", "unknown operation type %q", op.Type)
+	case op.From == "":
+		return fail("from", "missing")
+	case needsTo && op.To == "":
+		return fail("to", "missing, %s needs a destination", op.Type)
+	case op.Size < 0:
+		return fail("size", "must not be negative")
+	case op.Source != "" && op.Source != "upload" && op.Source != "url":
+		return fail("source", "unknown source %q, expected \"\", \"upload\" or \"url\"", op.Source)
+	case op.SHA256 != "" && !sha256Pattern.MatchString(op.SHA256):
+		return fail("sha256", "must be 64 lowercase hex digits")
+	case op.Confidence < 0 || op.Confidence > 1:
+		return fail("confidence", "must be between 0 and 1")
+	}
+	return nil
+}
+
+// Check checks a plan against the schema
+func Check(p Plan) error {
+	if p.Version < 0 {
+		return &Error{Path: "/version", Message: "must not be negative"}
+	}
+	if p.CatalogSeq < 0 {
+		return &Error{Path: "/catalogSeq", Message: "must not be negative"}
+	}
+	for i, op := range p.Operations {
+		if err := CheckOperation(i, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package planspec
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// operationSchema is the part of $defs/operation the checks mirror
+type operationSchema struct {
+	Required   []string `json:"required"`
+	Properties map[string]struct {
+		Enum    []string `json:"enum"`
+		Pattern string   `json:"pattern"`
+		Minimum *float64 `json:"minimum"`
+		Maximum *float64 `json:"maximum"`
+	} `json:"properties"`
+	AllOf []struct {
+		If struct {
+			Properties struct {
+				Type struct {
+					Enum []string `json:"enum"`
+				} `json:"type"`
+			} `json:"properties"`
+		} `json:"if"`
+		Then struct {
+			Required []string `json:"required"`
+		} `json:"then"`
+	} `json:"allOf"`
+}
+
+func loadOperationSchema(t *testing.T) operationSchema {
+	t.Helper()
+	var schema struct {
+		Defs struct {
+			Operation operationSchema `json:"operation"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(Schema, &schema); err != nil {
+		t.Fatalf("embedded schema: %v", err)
+	}
+	return schema.Defs.Operation
+}
+
+func sorted(s []string) []string {
+	s = append([]string(nil), s...)
+	sort.Strings(s)
+	return s
+}
+
+// fieldPath returns the JSON Pointer field CheckOperation failed on, "" if
+// it didn't
+func fieldPath(t *testing.T, op Operation) string {
+	t.Helper()
+	err := CheckOperation(0, op)
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("%+v: %v is not an *Error", op, err)
+	}
+	return strings.TrimPrefix(e.Path, "/operations/0/")
+}
+
+func TestSchemaMatchesOperation(t *testing.T) {
+	schema := loadOperationSchema(t)
+	var fields []string
+	for i := 0; i < reflect.TypeOf(Operation{}).NumField(); i++ {
+		name, _, _ := strings.Cut(reflect.TypeOf(Operation{}).Field(i).Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	var properties []string
+	for name := range schema.Properties {
+		properties = append(properties, name)
+	}
+	if got, want := sorted(properties), sorted(fields); !reflect.DeepEqual(got, want) {
+		t.Errorf("schema properties %v, Operation fields %v", got, want)
+	}
+}
+
+func TestSchemaTypes(t *testing.T) {
+	schema := loadOperationSchema(t)
+	var types, needTo []string
+	for typ, needsTo := range opTypes {
+		types = append(types, typ)
+		if needsTo {
+			needTo = append(needTo, typ)
+		}
+	}
+	if got, want := sorted(schema.Properties["type"].Enum), sorted(types); !reflect.DeepEqual(got, want) {
+		t.Errorf("schema type enum %v, opTypes %v", got, want)
+	}
+
+	var schemaNeedTo []string
+	for _, rule := range schema.AllOf {
+		for _, field := range rule.Then.Required {
+			if field == "to" {
+				schemaNeedTo = append(schemaNeedTo, rule.If.Properties.Type.Enum...)
+			}
+		}
+	}
+	if got, want := sorted(schemaNeedTo), sorted(needTo); !reflect.DeepEqual(got, want) {
+		t.Errorf("schema requires to for %v, CheckOperation for %v", got, want)
+	}
+
+	for _, typ := range types {
+		op := Operation{Type: typ, From: "a", To: "b"}
+		if field := fieldPath(t, op); field != "" {
+			t.Errorf("%s with from and to: rejected at %s", typ, field)
+		}
+		op.To = ""
+		want := ""
+		if opTypes[typ] {
+			want = "to"
+		}
+		if field := fieldPath(t, op); field != want {
+			t.Errorf("%s without to: rejected at %q, want %q", typ, field, want)
+		}
+	}
+	if field := fieldPath(t, Operation{Type: "rename", From: "a", To: "b"}); field != "type" {
+		t.Errorf("unknown type: rejected at %q, want type", field)
+	}
+}
+
+func TestSchemaRequired(t *testing.T) {
+	schema := loadOperationSchema(t)
+	valid := Operation{Type: "rm", From: "a"}
+	for _, field := range schema.Required {
+		op := valid
+		switch field {
+		case "type":
+			op.Type = ""
+		case "from":
+			op.From = ""
+		default:
+			t.Errorf("schema requires %s, which CheckOperation doesn't check", field)
+			continue
+		}
+		if got := fieldPath(t, op); got != field {
+			t.Errorf("without %s: rejected at %q", field, got)
+		}
+	}
+	if got, want := sorted(schema.Required), []string{"from", "type"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("schema requires %v, CheckOperation %v", got, want)
+	}
+}
+
+func TestSchemaFieldRules(t *testing.T) {
+	schema := loadOperationSchema(t)
+	props := schema.Properties
+
+	for _, source := range props["source"].Enum {
+		if field := fieldPath(t, Operation{Type: "import", From: "a", To: "b", Source: source}); field != "" {
+			t.Errorf("source %q: rejected at %s", source, field)
+		}
+	}
+	if field := fieldPath(t, Operation{Type: "import", From: "a", To: "b", Source: "ftp"}); field != "source" {
+		t.Errorf("unknown source: rejected at %q, want source", field)
+	}
+
+	if props["sha256"].Pattern != sha256Pattern.String() {
+		t.Errorf("schema sha256 pattern %q, CheckOperation %q", props["sha256"].Pattern, sha256Pattern.String())
+	}
+
+	if min := props["size"].Minimum; min == nil || *min != 0 {
+		t.Errorf("schema size minimum %v, want 0", min)
+	}
+	if field := fieldPath(t, Operation{Type: "rm", From: "a", Size: -1}); field != "size" {
+		t.Errorf("negative size: rejected at %q, want size", field)
+	}
+
+	confidence := props["confidence"]
+	if confidence.Minimum == nil || confidence.Maximum == nil {
+		t.Fatalf("schema confidence has no range")
+	}
+	for _, c := range []float64{*confidence.Minimum, *confidence.Maximum} {
+		if field := fieldPath(t, Operation{Type: "rm", From: "a", Confidence: c}); field != "" {
+			t.Errorf("confidence %v: rejected at %s", c, field)
+		}
+	}
+	for _, c := range []float64{*confidence.Minimum - 0.1, *confidence.Maximum + 0.1} {
+		if field := fieldPath(t, Operation{Type: "rm", From: "a", Confidence: c}); field != "confidence" {
+			t.Errorf("confidence %v: rejected at %q, want confidence", c, field)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PlanConflict is something preflight found that would make an operation
+// fail or lose data. The UI has the user resolve each one (skip, overwrite
+// or rename) before the plan is submitted.
+type PlanConflict struct {
+	Index    int       `json:"index"` // Into the plan's operations
+	Op       Operation `json:"op"`
+	Kind     string    `json:"kind"` // "destination-exists", "source-missing", "source-changed", "case-collision", "illegal-name" or "path-too-long"
+	Detail   string    `json:"detail"`
+	RenameTo string    `json:"renameTo,omitempty"` // A free destination, for a rename
+	Blocking bool      `json:"blocking,omitempty"` // Executing refuses the operation as it is
+}
+
+// preflightPlan walks the plan in order against the files on disk and the
+// catalog they were planned from
+func preflightPlan(ops []Operation) []PlanConflict {
+	catalogMu.RLock()
+	files := catalog
+	catalogMu.RUnlock()
+	byPath := make(map[string]FileEntry, len(files))
+	byLower := make(map[string]string, len(files))
+	for _, e := range files {
+		p := filepath.ToSlash(e.Path)
+		byPath[p] = e
+		byLower[strings.ToLower(p)] = p
+	}
+
+	vacated := make(map[string]bool) // Moved away or deleted earlier in the plan
+	created := make(map[string]bool) // Moved or copied here earlier in the plan
+	onDisk := func(p string) (os.FileInfo, bool) {
+		info, err := os.Lstat(filepath.Join(targetDir, filepath.FromSlash(p)))
+		return info, err == nil
+	}
+	exists := func(p string) bool {
+		if created[p] {
+			return true
+		}
+		_, ok := onDisk(p)
+		return ok && !vacated[p]
+	}
+	freeName := func(p string) string {
+		ext := path.Ext(p)
+		base := strings.TrimSuffix(p, ext)
+		for i := 2; ; i++ {
+			name := base + " (" + strconv.Itoa(i) + ")" + ext
+			if !exists(name) && byLower[strings.ToLower(name)] == "" {
+				return name
+			}
+		}
+	}
+
+	// A destination differing only in case from a file that is there by
+	// then, from the catalog or earlier in the plan. On a case-insensitive
+	// target the two are one file, so executing refuses it.
+	insensitive := targetCaseInsensitive(targetDir)
+	caseCollision := func(i int, op Operation) *PlanConflict {
+		other := byLower[strings.ToLower(op.To)]
+		if other == "" || other == op.To || other == op.From || !exists(other) {
+			return nil
+		}
+		c := &PlanConflict{Index: i, Op: op, Kind: "case-collision", Detail: op.To + " differs only in case from " + other,
+			RenameTo: freeName(op.To)}
+		if insensitive {
+			c.Detail += ", which it would overwrite on this case-insensitive target"
+			c.Blocking = true
+		}
+		return c
+	}
+
+	// A destination the target's filesystem won't take, or that Windows
+	// programs can't open
+	rules := targetNamingRules()
+	nameConflict := func(i int, op Operation) *PlanConflict {
+		kind, detail := nameProblem(destination(op), rules)
+		if kind == "" {
+			return nil
+		}
+		c := &PlanConflict{Index: i, Op: op, Kind: kind, Detail: detail, Blocking: kind == "illegal-name"}
+		if c.Blocking {
+			// Suggest the name -sanitize-names would give it
+			if c.RenameTo = sanitizePath(destination(op), rules); exists(c.RenameTo) {
+				c.RenameTo = freeName(c.RenameTo)
+			}
+		}
+		return c
+	}
+
+	var conflicts []PlanConflict
+	for i, op := range ops {
+		if op.Type == "import" {
+			if c := nameConflict(i, op); c != nil {
+				conflicts = append(conflicts, *c)
+			} else if c := caseCollision(i, op); c != nil {
+				conflicts = append(conflicts, *c)
+			}
+			created[op.To] = true
+			delete(vacated, op.To)
+			byLower[strings.ToLower(op.To)] = op.To
+			continue
+		}
+		if op.Type == "placeholder" {
+			// A stub is never written over an existing file
+			if c := nameConflict(i, op); c != nil {
+				conflicts = append(conflicts, *c)
+			} else if exists(op.From) {
+				conflicts = append(conflicts, PlanConflict{Index: i, Op: op, Kind: "destination-exists",
+					Detail: op.From + " already exists, so no placeholder is created"})
+			}
+			created[op.From] = true
+			delete(vacated, op.From)
+			continue
+		}
+		if op.Type != "mv" && op.Type != "cp" && op.Type != "rm" && op.Type != "symlink" && op.Type != "hardlink" {
+			continue
+		}
+		conflict := PlanConflict{Index: i, Op: op}
+
+		info, ok := onDisk(op.From)
+		entry, cataloged := byPath[op.From]
+		var nameIssue, caseConflict *PlanConflict
+		if op.Type != "rm" {
+			nameIssue = nameConflict(i, op)
+			caseConflict = caseCollision(i, op)
+		}
+		switch {
+		case !created[op.From] && (!ok || vacated[op.From]):
+			conflict.Kind, conflict.Detail = "source-missing", op.From+" no longer exists"
+		case ok && cataloged && !created[op.From] && info.Mode().IsRegular() &&
+			(info.Size() != entry.Size || info.ModTime().UnixMilli() != entry.MTime):
+			conflict.Kind, conflict.Detail = "source-changed", op.From+" changed since the catalog was scanned"
+		case nameIssue != nil:
+			conflict = *nameIssue
+		case caseConflict != nil && caseConflict.Blocking:
+			conflict = *caseConflict
+		case (op.Type == "mv" || op.Type == "cp") && exists(op.To):
+			conflict.Kind, conflict.Detail = "destination-exists", op.To+" already exists and would be overwritten"
+			conflict.RenameTo = freeName(op.To)
+		case caseConflict != nil:
+			conflict = *caseConflict
+		}
+		if conflict.Kind != "" {
+			conflicts = append(conflicts, conflict)
+		}
+
+		switch op.Type {
+		case "mv", "rm":
+			vacated[op.From] = true
+			delete(created, op.From)
+		}
+		if op.Type != "rm" {
+			created[op.To] = true
+			delete(vacated, op.To)
+			byLower[strings.ToLower(op.To)] = op.To
+		}
+	}
+	return conflicts
+}
+
+// handlePreflight checks a plan (same format as /apply) without executing it
+func handlePreflight(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	plan, _, err := decodePlan(requestBody(w, r, maxPlanBytes))
+	if err != nil {
+		planError(w, err)
+		return
+	}
+	conflicts := preflightPlan(plan.Operations)
+	if conflicts == nil {
+		conflicts = []PlanConflict{}
+	}
+
+	result := map[string]interface{}{"conflicts": conflicts}
+	if b, ok := inodeBudget(orderOperations(plan.Operations)); ok {
+		result["inodes"] = b
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// previewDir is where -preview-dir builds the planned layout. A real FUSE
+// mount would need a third-party library, so the preview is a tree of
+// symlinks to the current files instead: browsable and playable, but the
+// files behind it are the originals.
+var previewDir string
+
+// previewMu serializes /preview requests, which all wipe and rebuild
+// previewDir; the catalog itself is only read
+var previewMu sync.Mutex
+
+// previewMarker identifies a directory dir-mimic may wipe and rebuild
+const previewMarker = ".dir-mimic-preview"
+
+// plannedLayout returns the target as it would look after ops: future path
+// -> current path of the file that would end up there
+func plannedLayout(ops []Operation) map[string]string {
+	layout := make(map[string]string, len(catalog))
+	for _, e := range catalog {
+		layout[e.Path] = e.Path
+	}
+	for _, op := range ops {
+		switch op.Type {
+		case "mv":
+			if src, ok := layout[op.From]; ok {
+				delete(layout, op.From)
+				layout[op.To] = src
+			}
+		case "cp", "symlink", "hardlink":
+			if src, ok := layout[op.From]; ok {
+				layout[op.To] = src
+			}
+		case "rm":
+			delete(layout, op.From)
+		}
+	}
+	return layout
+}
+
+// resetPreviewDir empties the preview directory, refusing to touch one that
+// has content but wasn't created by dir-mimic
+func resetPreviewDir() error {
+	entries, err := os.ReadDir(previewDir)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(previewDir, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		if _, err := os.Lstat(filepath.Join(previewDir, previewMarker)); err != nil {
+			return fmt.Errorf("%s is not empty and not a dir-mimic preview", previewDir)
+		}
+	}
+
+	// Folders are made read-only below, undo that before removing
+	filepath.WalkDir(previewDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(previewDir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildPreview replaces the preview directory with the planned layout and
+// returns the number of files in it
+func buildPreview(ops []Operation) (int, error) {
+	if err := resetPreviewDir(); err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(filepath.Join(previewDir, previewMarker), []byte("Preview of "+targetDir+"\n"), 0644); err != nil {
+		return 0, err
+	}
+
+	layout := plannedLayout(ops)
+	for future, current := range layout {
+		dst := filepath.Join(previewDir, filepath.FromSlash(future))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return 0, err
+		}
+		if err := os.Symlink(filepath.Join(targetDir, filepath.FromSlash(current)), dst); err != nil {
+			return 0, err
+		}
+	}
+
+	// No renaming or adding files in the preview
+	filepath.WalkDir(previewDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(path, 0555)
+		}
+		return nil
+	})
+	return len(layout), nil
+}
+
+// checkOutsideTarget makes sure a directory we write to (-preview-dir,
+// -backup-dir) can't end up in the catalog
+func checkOutsideTarget(flagName, dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if abs == targetDir || strings.HasPrefix(abs, targetDir+string(filepath.Separator)) ||
+		strings.HasPrefix(targetDir, abs+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s must be outside the target directory", flagName)
+	}
+	return abs, nil
+}
+
+// handlePreview builds the preview for a posted plan
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if previewDir == "" {
+		http.Error(w, "No preview directory configured", http.StatusNotFound)
+		return
+	}
+
+	plan, _, err := decodePlan(requestBody(w, r, maxPlanBytes))
+	if err != nil {
+		planError(w, err)
+		return
+	}
+
+	previewMu.Lock()
+	catalogMu.RLock()
+	files, err := buildPreview(plan.Operations)
+	catalogMu.RUnlock()
+	previewMu.Unlock()
+	if err != nil {
+		http.Error(w, "Failed to build preview: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Preview of the plan built in %s (%d files)\n", previewDir, files)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "path": previewDir, "files": files})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Config is the optional config file. Each profile maps flag names (without
+// the dash) to values, so "photos" can bundle -photo-dates, -exclude-ext and
+// the like. neverTouch lists paths plans leave alone (see neverTouched):
+//
+//	{"profiles": {"photos": {"photo-dates": true, "exclude-ext": "xmp,thm", "mode": "relocate"}},
+//	 "neverTouch": ["@eaDir", "#recycle"]}
+type Config struct {
+	Profiles   map[string]map[string]interface{} `json:"profiles"`
+	NeverTouch []string                          `json:"neverTouch"`
+}
+
+// activeProfile is the -profile the server was started with
+var activeProfile string
+
+// profiles holds the config file's profiles with their values as strings
+var profiles map[string]map[string]string
+
+// secretFlags can't be set in a profile: /catalog shows the profiles to
+// viewers, and a config file is easily shared
+var secretFlags = []string{"operator-token", "viewer-token", "library-scan", "token"}
+
+// browserProfileKeys are the profile settings the UI applies itself, the
+// only ones /catalog sends along with the profile names
+var browserProfileKeys = []string{"mode", "conflict"}
+
+// defaultConfigPath is the config file used without -config
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dir-mimic", "config.json")
+}
+
+// loadConfig reads the config file. A missing default config is no error,
+// a missing explicit one is.
+func loadConfig(path string, explicit bool) (*Config, error) {
+	config := &Config{}
+	if path == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var rules []string
+	for _, raw := range config.NeverTouch {
+		rule, err := cleanRule(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: neverTouch: %v", path, err)
+		}
+		rules = append(rules, rule)
+	}
+	neverTouch.rules = rules
+
+	profiles = make(map[string]map[string]string)
+	for name, settings := range config.Profiles {
+		values := make(map[string]string)
+		for key, raw := range settings {
+			if containsString(secretFlags, key) {
+				return nil, fmt.Errorf("%s: profile %q: -%s can't be set in a profile, pass it on the command line", path, name, key)
+			}
+			if values[key], err = profileValue(raw); err != nil {
+				return nil, fmt.Errorf("%s: profile %q: %s: %v", path, name, key, err)
+			}
+		}
+		profiles[name] = values
+	}
+	return config, nil
+}
+
+// profileValue turns a JSON value into flag syntax. Lists become
+// comma-separated, as -ignore and -exclude-ext expect.
+func profileValue(raw interface{}) (string, error) {
+	switch v := raw.(type) {
+	case string:
+		return v, nil
+	case bool, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("list items must be strings")
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", raw)
+}
+
+// profileNames lists the configured profiles, sorted
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// browserProfiles returns the profiles for the UI's dropdown, with only
+// the settings it applies
+func browserProfiles() map[string]map[string]string {
+	if len(profiles) == 0 {
+		return nil
+	}
+	result := make(map[string]map[string]string, len(profiles))
+	for name, settings := range profiles {
+		values := make(map[string]string)
+		for _, key := range browserProfileKeys {
+			if v, ok := settings[key]; ok {
+				values[key] = v
+			}
+		}
+		result[name] = values
+	}
+	return result
+}
+
+// applyProfile sets the flags of the named profile that weren't given on
+// the command line or in the environment, so those still win. Subcommands
+// pass skipUnknown: they only take the profile settings they understand.
+func applyProfile(fs *flag.FlagSet, name string, skipUnknown bool) error {
+	settings, ok := profiles[name]
+	if !ok {
+		if len(profiles) == 0 {
+			return fmt.Errorf("profile %q not found: no profiles configured", name)
+		}
+		return fmt.Errorf("profile %q not found (have %s)", name, strings.Join(profileNames(), ", "))
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "profile" || key == "config" || containsString(secretFlags, key) {
+			return fmt.Errorf("profile %q: %s can't be set in a profile", name, key)
+		}
+		if fs.Lookup(key) == nil {
+			if skipUnknown {
+				continue
+			}
+			return fmt.Errorf("profile %q: unknown flag -%s", name, key)
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := fs.Set(key, settings[key]); err != nil {
+			return fmt.Errorf("profile %q: -%s: %v", name, key, err)
+		}
+	}
+	return nil
+}
+
+// setupProfile loads the config file and applies -profile to fs. Called
+// right after parsing, before any flag value is used.
+func setupProfile(fs *flag.FlagSet, path, name string, skipUnknown bool) error {
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath()
+	}
+	configPath = path
+	if _, err := loadConfig(path, explicit); err != nil {
+		return err
+	}
+	if name == "" {
+		return nil
+	}
+	return applyProfile(fs, name, skipUnknown)
+}
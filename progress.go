@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// progressInterval is how often a running copy reports its progress
+const progressInterval = time.Second
+
+// CopyProgress describes how far a single file copy has come
+type CopyProgress struct {
+	Path  string `json:"path"`
+	Done  int64  `json:"done"`
+	Total int64  `json:"total"`
+	Kind  string `json:"kind,omitempty"` // "import" for data from outside the target
+}
+
+// progressReader wraps a copy source and periodically reports bytes copied
+// to the terminal and the /events stream. Files that finish within the first
+// interval produce no output.
+type progressReader struct {
+	r          io.Reader
+	target     *applyTarget
+	progress   CopyProgress
+	lastReport time.Time
+	reported   bool
+}
+
+func (t *applyTarget) newProgressReader(r io.Reader, path string, total int64) *progressReader {
+	return &progressReader{
+		r:          r,
+		target:     t,
+		progress:   CopyProgress{Path: path, Total: total},
+		lastReport: time.Now(),
+	}
+}
+
+// newImportProgress is newProgressReader for an import
+func (t *applyTarget) newImportProgress(r io.Reader, path string, total int64) *progressReader {
+	p := t.newProgressReader(r, path, total)
+	p.progress.Kind = "import"
+	return p
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.progress.Done += int64(n)
+	if p.progress.Kind == "import" {
+		applyBytesImport.Add(int64(n))
+	} else {
+		applyBytesCopy.Add(int64(n))
+	}
+	if time.Since(p.lastReport) >= progressInterval {
+		p.report()
+	}
+	return n, err
+}
+
+func (p *progressReader) report() {
+	p.lastReport = time.Now()
+	p.reported = true
+
+	percent := 100.0
+	if p.progress.Total > 0 {
+		percent = float64(p.progress.Done) * 100 / float64(p.progress.Total)
+	}
+	label := "COPYING"
+	if p.progress.Kind == "import" {
+		label = "IMPORTING"
+	}
+	line := fmt.Sprintf("  %s: %s %5.1f%% (%s of %s)", label, p.progress.Path, percent,
+		formatSize(p.progress.Done), formatSize(p.progress.Total))
+	if p.target.label != "" {
+		// Other targets print in between, so no redrawing the line
+		p.target.printf("%s\n", line)
+	} else {
+		fmt.Print("\r" + line)
+	}
+	events.publish(Event{Type: "progress", Data: p.progress})
+}
+
+// finish emits a final report if any intermediate one was printed
+func (p *progressReader) finish() {
+	if p.reported {
+		p.report()
+		if p.target.label == "" {
+			fmt.Println()
+		}
+	}
+}
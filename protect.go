@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// excludeNewer is -exclude-newer: target files modified more recently than
+// this are never deleted or overwritten, whatever the plan says
+var excludeNewer time.Duration
+
+// parseAge parses "30d" (days) or a Go duration like "12h"
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(strings.TrimSpace(s), "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q (use e.g. 7d or 12h)", s)
+	}
+	return d, nil
+}
+
+// protectedSince returns the -exclude-newer cutoff in Unix milliseconds for
+// the UI, or 0 if protection is off
+func protectedSince() int64 {
+	if excludeNewer == 0 {
+		return 0
+	}
+	return time.Now().Add(-excludeNewer).UnixMilli()
+}
+
+// protectedPath returns the file an operation would delete or overwrite.
+// Updates only overwrite once they are imports.
+func protectedPath(op Operation) string {
+	switch op.Type {
+	case "rm", "update":
+		return op.From
+	case "mv", "cp", "symlink", "hardlink", "import":
+		return op.To
+	}
+	return ""
+}
+
+// withoutProtected drops operations that would delete or overwrite a file
+// modified within -exclude-newer, and returns them separately
+func withoutProtected(ops []Operation) ([]Operation, []Operation) {
+	if excludeNewer == 0 {
+		return ops, nil
+	}
+	cutoff := time.Now().Add(-excludeNewer)
+	kept := make([]Operation, 0, len(ops))
+	var protected []Operation
+	for _, op := range ops {
+		if rel := protectedPath(op); rel != "" {
+			if info, err := os.Lstat(filepath.Join(targetDir, filepath.FromSlash(rel))); err == nil && info.ModTime().After(cutoff) {
+				protected = append(protected, op)
+				continue
+			}
+		}
+		kept = append(kept, op)
+	}
+	return kept, protected
+}
+
+// printProtected lists the operations -exclude-newer keeps from running
+func printProtected(protected []Operation) {
+	if len(protected) == 0 {
+		return
+	}
+	fmt.Println(colorize(colorYellow, fmt.Sprintf("Skipping %d operations on files modified within %s (-exclude-newer):", len(protected), formatDuration(excludeNewer))))
+	for _, op := range protected {
+		fmt.Printf("  %s %s %s\n", colorize(colorYellow, fmt.Sprintf("%-9s", "PROTECTED")), op.Type, shellQuote(protectedPath(op)))
+	}
+}
+
+// allowDeletes is -allow-deletes. Without it the server leaves the deletes
+// out of the plans it is sent, so nothing is lost before one has learned
+// what a plan does.
+var allowDeletes bool
+
+// withoutDeletes drops the deletes from a plan unless -allow-deletes is
+// set, and returns them separately
+func withoutDeletes(ops []Operation) ([]Operation, []Operation) {
+	if allowDeletes {
+		return ops, nil
+	}
+	kept := make([]Operation, 0, len(ops))
+	var skipped []Operation
+	for _, op := range ops {
+		if op.Type == "rm" {
+			skipped = append(skipped, op)
+			continue
+		}
+		kept = append(kept, op)
+	}
+	return kept, skipped
+}
+
+// printSkippedDeletes lists the deletes left out for want of -allow-deletes
+func printSkippedDeletes(skipped []Operation) {
+	if len(skipped) == 0 {
+		return
+	}
+	fmt.Println(colorize(colorYellow, fmt.Sprintf(tr("Skipping %d deletes, the server runs without -allow-deletes:"), len(skipped))))
+	for _, op := range skipped {
+		fmt.Printf("  %s %s\n", colorize(colorYellow, fmt.Sprintf("%-9s", "SKIPPED")), shellQuote(op.From))
+	}
+}
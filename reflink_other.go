@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// reflink is not available on this platform, so -stage-dir falls back to
+// hardlinks
+func reflink(src, dst string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskReserve is -reserve: free space an apply leaves on each destination
+// filesystem. When a copy would eat into it the plan pauses until space
+// is freed.
+var diskReserve int64
+
+// reserveInterval is how often a paused plan checks the free space again
+const reserveInterval = 5 * time.Second
+
+// reserveMaxWait is how long a plan waits for space before the copy fails,
+// so a full disk nobody attends to doesn't hold the apply forever
+const reserveMaxWait = time.Hour
+
+// DiskAlert is sent as a "disk-low" event while a plan waits for space
+type DiskAlert struct {
+	Path    string `json:"path"` // The operation's destination
+	Free    int64  `json:"free"`
+	Need    int64  `json:"need"`
+	Reserve int64  `json:"reserve"`
+}
+
+// spaceNeeded is how many bytes an operation adds to the destination
+// filesystem. Only copies take space: moves are renames and links are
+// just directory entries.
+func (t *applyTarget) spaceNeeded(op Operation) int64 {
+	if op.Type == "import" {
+		return op.Size
+	}
+	if op.Type != "cp" {
+		return 0
+	}
+	info, err := os.Stat(filepath.Join(t.dir, op.From))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// existingParent returns the closest existing directory above path
+func existingParent(path string) string {
+	dir := filepath.Dir(path)
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// waitForSpace blocks until need bytes fit on the filesystem of the target
+// path to without going below diskReserve. Free space is checked right
+// before each operation, so deletes earlier in the plan and space freed by
+// hand both count. It fails right away if the filesystem is too small even
+// when empty, and after reserveMaxWait.
+func (t *applyTarget) waitForSpace(to string, need int64) error {
+	if diskReserve <= 0 || need == 0 {
+		return nil
+	}
+	dir := existingParent(filepath.Join(t.dir, to))
+	if total, ok := totalSpace(dir); ok && need+diskReserve > total {
+		return fmt.Errorf("needs %s plus the %s reserve, more than the whole filesystem (%s)", formatSize(need), formatSize(diskReserve), formatSize(total))
+	}
+
+	paused := false
+	deadline := time.Now().Add(reserveMaxWait)
+	for {
+		free, ok := freeSpace(dir)
+		if !ok || free-need >= diskReserve {
+			break
+		}
+		if time.Now().After(deadline) {
+			// The UI's notice goes away either way
+			events.publish(Event{Type: "disk-ok", Data: map[string]string{"path": to}})
+			return fmt.Errorf("gave up after waiting %s for space: needs %s, %s free, keeping %s in reserve", reserveMaxWait, formatSize(need), formatSize(free), formatSize(diskReserve))
+		}
+		if !paused {
+			paused = true
+			t.fprintf(os.Stderr, "  %s %s needs %s but only %s is free, keeping %s in reserve. Paused until space is freed...\n",
+				colorize(colorYellow, "DISK LOW:"), shellQuote(to), formatSize(need), formatSize(free), formatSize(diskReserve))
+			events.publish(Event{Type: "disk-low", Data: DiskAlert{Path: to, Free: free, Need: need, Reserve: diskReserve}})
+		}
+		time.Sleep(reserveInterval)
+	}
+	if paused {
+		t.printf("  Enough space again, resuming\n")
+		events.publish(Event{Type: "disk-ok", Data: map[string]string{"path": to}})
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// reviewBelow is -review-below: operations whose confidence is lower are
+// left out of the plan unless approved one by one (0 = off)
+var reviewBelow float64
+
+// basisConfidence is how likely a match on each basis (see relocateOps)
+// pairs up the same file. Ambiguous matches divide it by the number of
+// candidates.
+var basisConfidence = map[string]float64{
+	"name+size+hash":    1,
+	"size+hash":         0.95,
+	"audio hash":        0.95,
+	"capture time+size": 0.9,
+	"name+size":         0.85,
+	"size":              0.5,
+}
+
+// matcherConfidence is the confidence of a move paired by -matcher-cmd
+const matcherConfidence = 0.7
+
+// confidence returns op's confidence score. Operations without one (from
+// plans made before scores existed) count as certain.
+func confidence(op Operation) float64 {
+	if op.Confidence == 0 {
+		return 1
+	}
+	return op.Confidence
+}
+
+// needsReview reports whether op is below the -review-below threshold
+func needsReview(op Operation) bool {
+	return reviewBelow > 0 && confidence(op) < reviewBelow
+}
+
+// reviewOperations asks about each operation below -review-below and
+// returns the plan without the ones not approved, and how many those were.
+// With in nil nothing is asked and all of them are left out.
+func reviewOperations(ops []Operation, in *bufio.Reader) ([]Operation, int) {
+	var kept []Operation
+	dropped := 0
+	for _, op := range ops {
+		if !needsReview(op) {
+			kept = append(kept, op)
+			continue
+		}
+		if in != nil {
+			line := op.Type + " " + shellQuote(op.From)
+			if op.To != "" {
+				line += " -> " + shellQuote(op.To)
+			}
+			fmt.Printf("%s %s\n  %s (confidence %.2f)\n%s",
+				colorize(colorYellow, "REVIEW"), line, printable(op.Reason), confidence(op), tr("Include it? [y/N] "))
+			if answer, _ := in.ReadString('\n'); isYes(answer) {
+				kept = append(kept, op)
+				continue
+			}
+		}
+		dropped++
+	}
+	return kept, dropped
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileFilter limits which files enter the catalog. The UI applies the same
+// filter to the source so filtered-out files don't show up as missing.
+type FileFilter struct {
+	MinSize    int64    `json:"minSize,omitempty"`
+	MaxSize    int64    `json:"maxSize,omitempty"`    // 0 = unlimited
+	IncludeExt []string `json:"includeExt,omitempty"` // Lowercase, without dot
+	ExcludeExt []string `json:"excludeExt,omitempty"`
+}
+
+// active reports whether any filter is set
+func (f FileFilter) active() bool {
+	return f.MinSize > 0 || f.MaxSize > 0 || len(f.IncludeExt) > 0 || len(f.ExcludeExt) > 0
+}
+
+// allows reports whether a file with the given name and size passes the filter
+func (f FileFilter) allows(name string, size int64) bool {
+	if size < f.MinSize || (f.MaxSize > 0 && size > f.MaxSize) {
+		return false
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	if len(f.IncludeExt) > 0 && !containsString(f.IncludeExt, ext) {
+		return false
+	}
+	return !containsString(f.ExcludeExt, ext)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExtList parses "jpg, .MP4" into []string{"jpg", "mp4"}
+func parseExtList(s string) []string {
+	var exts []string
+	for _, e := range strings.Split(s, ",") {
+		e = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), "."))
+		if e != "" {
+			exts = append(exts, e)
+		}
+	}
+	return exts
+}
+
+// parseSize parses a byte count with an optional K/M/G/T suffix (powers of 1024)
+func parseSize(raw string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", raw)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// SpecialFile is a non-regular file (FIFO, socket, device node, or a
+// symlink not pointing to a regular file). These are reported but never
+// enter the catalog, so they can't be copied or hashed by accident.
+type SpecialFile struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"` // "fifo", "socket", "device", "symlink", "other"
+}
+
+// ScanError is a path the scanner could not read
+type ScanError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// ScanWarning is a problem the scanner worked around, like a file it could
+// not hash. The file is still in the catalog, but may match less precisely.
+type ScanWarning struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ScanResult is the outcome of scanning a directory
+type ScanResult struct {
+	Files        []FileEntry
+	Special      []SpecialFile
+	Inaccessible []ScanError
+	Warnings     []ScanWarning
+	Mounts       []string // Folders where another filesystem is mounted
+}
+
+// warn reports a scan warning on stderr and keeps it for the UI
+func (r *ScanResult) warn(path, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", path, message)
+	r.Warnings = append(r.Warnings, ScanWarning{Path: path, Message: message})
+}
+
+// specialKind classifies a non-regular, non-directory file mode
+func specialKind(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	}
+	return "other"
+}
+
+// scanDirectory walks the directory and builds the catalog. Unreadable
+// paths are collected in the result and skipped, unless strictScan is set.
+func scanDirectory(root string, withHash bool) (*ScanResult, error) {
+	result := &ScanResult{}
+
+	start := time.Now()
+	scanRuns.Add(1)
+	scanInProgress.Add(1)
+	defer func() {
+		scanInProgress.Add(-1)
+		scanLastMillis.Set(time.Since(start).Milliseconds())
+	}()
+
+	var rootDev uint64
+	checkDev := false
+	if oneFileSystem {
+		if info, err := os.Stat(root); err == nil {
+			rootDev, checkDev = deviceID(info)
+		}
+	}
+	dirDevs := make(map[string]uint64)
+
+	var fileRules *ignoreFileRules
+	if honorIgnoreFiles {
+		fileRules = newIgnoreFileRules(root)
+	}
+
+	stubs := readPlaceholders(root)
+
+	var gitFiles, gitDirs map[string]bool
+	if gitTrackedOnly {
+		var err error
+		if gitFiles, gitDirs, err = gitFileSet(root); err != nil {
+			return result, err
+		}
+	}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if strictScan || path == root {
+				return err
+			}
+			relPath, _ := filepath.Rel(root, path)
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s: %v\n", relPath, err)
+			result.Inaccessible = append(result.Inaccessible, ScanError{Path: relPath, Error: err.Error()})
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if shouldIgnore(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fileRules != nil && path != root {
+			if rel, err := filepath.Rel(root, path); err == nil && fileRules.ignored(filepath.ToSlash(rel), info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if info.IsDir() {
+			scanDirsVisited.Add(1)
+
+			// Folders without files git knows about (build outputs, .git itself)
+			if gitDirs != nil && path != root {
+				if rel, err := filepath.Rel(root, path); err == nil && !gitDirs[filepath.ToSlash(rel)] {
+					return filepath.SkipDir
+				}
+			}
+
+			// Mount points of other filesystems are left alone
+			if checkDev {
+				if dev, ok := deviceID(info); ok && dev != rootDev {
+					rel, _ := filepath.Rel(root, path)
+					result.warn(rel, "mount point of another filesystem, skipped")
+					return filepath.SkipDir
+				}
+			}
+			// Otherwise they are noted, copies prefer a source on the same one
+			if dev, ok := deviceID(info); ok {
+				dirDevs[path] = dev
+				if parent, ok := dirDevs[filepath.Dir(path)]; ok && path != root && dev != parent {
+					rel, _ := filepath.Rel(root, path)
+					result.Mounts = append(result.Mounts, filepath.ToSlash(rel))
+				}
+			}
+
+			// Directories at the depth limit would only hold files beyond it
+			if maxDepth > 0 && path != root {
+				if rel, err := filepath.Rel(root, path); err == nil && pathDepth(rel) >= maxDepth {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+
+		scanFilesVisited.Add(1)
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath) // Catalog paths use "/", see catalogVersion
+		if gitFiles != nil && !gitFiles[relPath] {
+			return nil
+		}
+
+		// Symlinks to files (e.g. left behind by link dedupe) stand in for their target
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Stat(path); err == nil && target.Mode().IsRegular() {
+				info = target
+			}
+		}
+		if !info.Mode().IsRegular() {
+			result.Special = append(result.Special, SpecialFile{Path: relPath, Kind: specialKind(info.Mode())})
+			return nil
+		}
+
+		if !fileFilter.allows(info.Name(), info.Size()) {
+			return nil
+		}
+		if relPath == placeholderList {
+			return nil
+		}
+		// A placeholder's stub stands in for a file whose data is missing
+		if isStub(stubs, relPath, info) {
+			return nil
+		}
+
+		entry := FileEntry{
+			Path:  relPath,
+			Size:  info.Size(),
+			MTime: info.ModTime().UnixMilli(),
+		}
+		if dev, ino, nlink, ok := fileID(info); ok && nlink > 1 {
+			entry.Dev, entry.Ino = dev, ino
+		}
+
+		if photoDates && isPhoto(info.Name()) {
+			if takenAt, err := photoTakenAt(path); err == nil {
+				entry.TakenAt = takenAt
+			}
+		}
+
+		if audioHashing && isAudio(info.Name()) {
+			if hash, err := computeAudioHash(path); err == nil {
+				entry.AudioHash = hash
+			} else {
+				result.warn(relPath, "could not hash audio: %v", err)
+			}
+		}
+
+		if withHash {
+			hashStart := time.Now()
+			hash, err := computeSampleHash(path, info.Size())
+			scanHashMillis.Add(time.Since(hashStart).Milliseconds())
+			scanFilesHashed.Add(1)
+			if err != nil {
+				result.warn(relPath, "could not hash: %v", err)
+			} else {
+				entry.Hash = hash
+			}
+		}
+
+		result.Files = append(result.Files, entry)
+		return nil
+	})
+
+	return result, err
+}
+
+// pathDepth returns the number of components in a relative path
+func pathDepth(rel string) int {
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// computeSampleHash computes a sample SHA1 hash (first+last 64KB)
+func computeSampleHash(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+
+	if size <= 65536 {
+		_, err = io.Copy(h, f)
+	} else {
+		// Read first 64KB
+		buf := make([]byte, 65536)
+		n, err := f.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		h.Write(buf[:n])
+
+		// Read last 64KB
+		_, err = f.Seek(-65536, io.SeekEnd)
+		if err != nil {
+			return "", err
+		}
+		n, err = f.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		h.Write(buf[:n])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// computeFullHash computes the SHA1 hash of the whole file
+func computeFullHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
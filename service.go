@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultServiceName is what `dir-mimic service` registers unless -name is
+// given, e.g. to supervise several directories
+const defaultServiceName = "dir-mimic"
+
+// runService implements `dir-mimic service <action> [-name n] [flags] <dir>`.
+// The flags after the action (and -name) are the server's own; install
+// records them for the service to start with.
+func runService(args []string) {
+	if len(args) == 0 {
+		serviceUsage()
+	}
+	action, rest := args[0], args[1:]
+	name := defaultServiceName
+	if len(rest) >= 2 && (rest[0] == "-name" || rest[0] == "--name") {
+		name, rest = rest[1], rest[2:]
+	}
+
+	var err error
+	switch action {
+	case "install":
+		if len(rest) == 0 {
+			serviceUsage()
+		}
+		err = installService(name, serviceArgs(rest))
+	case "uninstall", "start", "stop":
+		err = controlService(name, action)
+	case "run":
+		// Started by the Windows service manager, not meant to be typed
+		err = runAsService(name, rest)
+	default:
+		serviceUsage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func serviceUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: dir-mimic service install [-name n] [server flags] <directory>\n")
+	fmt.Fprintf(os.Stderr, "       dir-mimic service start|stop|uninstall [-name n]\n")
+	os.Exit(1)
+}
+
+// serviceArgs prepares server arguments for a service, which starts in
+// another working directory with nobody at the terminal: the directory is
+// made absolute, and plans are confirmed in the web UI unless the flags
+// say otherwise.
+func serviceArgs(args []string) []string {
+	out := append([]string(nil), args...)
+	last := len(out) - 1
+	if info, err := os.Stat(out[last]); err == nil && info.IsDir() {
+		if abs, err := filepath.Abs(out[last]); err == nil {
+			out[last] = abs
+		}
+	}
+
+	confirm := false
+	for _, arg := range out {
+		switch strings.TrimLeft(arg, "-") {
+		case "no-terminal-confirm", "assume-yes", "container":
+			confirm = true
+		}
+	}
+	if !confirm {
+		out = append([]string{"-no-terminal-confirm"}, out...)
+	}
+	return out
+}
+
+// systemdUnit returns a unit file that runs the server with args. Output
+// goes to the journal, tagged with the service name.
+func systemdUnit(name, exe string, args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		// systemd expands % specifiers even inside quotes
+		quoted[i] = strings.ReplaceAll(shellQuote(arg), "%", "%%")
+	}
+	return fmt.Sprintf(`[Unit]
+Description=dir-mimic serving %s
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=%s %s
+Restart=on-failure
+RestartSec=5
+SyslogIdentifier=%s
+Environment=NO_COLOR=1
+
+[Install]
+WantedBy=multi-user.target
+`, args[len(args)-1], strings.ReplaceAll(shellQuote(exe), "%", "%%"), strings.Join(quoted, " "), name)
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// installService prints a systemd unit. Writing it to /etc/systemd/system
+// is left to the user, who knows whether to run it as root.
+func installService(name string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	fmt.Print(systemdUnit(name, exe, args))
+	fmt.Fprintf(os.Stderr, "\nSave this as /etc/systemd/system/%s.service, then run:\n", name)
+	fmt.Fprintf(os.Stderr, "  systemctl daemon-reload && systemctl enable --now %s\n", name)
+	fmt.Fprintf(os.Stderr, "Logs: journalctl -u %s\n", name)
+	return nil
+}
+
+// controlService points to systemctl, which manages the unit
+func controlService(name, action string) error {
+	if action == "uninstall" {
+		return fmt.Errorf("systemd manages the service here, use: systemctl disable --now %s && rm /etc/systemd/system/%s.service", name, name)
+	}
+	return fmt.Errorf("systemd manages the service here, use: systemctl %s %s", action, name)
+}
+
+// runAsService is only used by the Windows service manager
+func runAsService(name string, args []string) error {
+	return fmt.Errorf("service run is for Windows services, systemd runs the server directly")
+}
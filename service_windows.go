@@ -0,0 +1,211 @@
+//go:build windows
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The service and event log APIs aren't in package syscall, so they are
+// called directly from advapi32 instead of pulling in golang.org/x/sys
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW         = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW                 = advapi32.NewProc("ReportEventW")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceAcceptStop     = 1
+	serviceAcceptShutdown = 4
+
+	serviceControlStop        = 1
+	serviceControlShutdown    = 5
+	serviceControlInterrogate = 4
+
+	eventlogErrorType       = 1
+	eventlogInformationType = 4
+
+	// EventCreate.exe has a "%1" message for IDs 1-1000, so events show
+	// our text without a message file of our own
+	eventID = 1
+)
+
+// serviceStatus is SERVICE_STATUS
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// installService registers the service to start automatically, with the
+// event log source its output is reported under
+func installService(name string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	binPath := syscall.EscapeArg(exe) + " service run -name " + syscall.EscapeArg(name)
+	for _, arg := range args {
+		binPath += " " + syscall.EscapeArg(arg)
+	}
+	if err := runTool("sc.exe", "create", name, "binPath=", binPath, "start=", "auto", "DisplayName=", "dir-mimic ("+name+")"); err != nil {
+		return err
+	}
+	runTool("sc.exe", "description", name, "Serves "+args[len(args)-1]+" to the dir-mimic web UI")
+
+	key := `HKLM\SYSTEM\CurrentControlSet\Services\EventLog\Application\` + name
+	if err := runTool("reg.exe", "add", key, "/v", "EventMessageFile", "/t", "REG_EXPAND_SZ", "/d", `%SystemRoot%\System32\EventCreate.exe`, "/f"); err != nil {
+		return err
+	}
+	if err := runTool("reg.exe", "add", key, "/v", "TypesSupported", "/t", "REG_DWORD", "/d", "7", "/f"); err != nil {
+		return err
+	}
+	fmt.Printf("Service %s installed. Start it with: dir-mimic service start -name %s\n", name, name)
+	fmt.Printf("Its output goes to the Application event log (source %s)\n", name)
+	return nil
+}
+
+// controlService starts, stops or removes the service through sc.exe
+func controlService(name, action string) error {
+	if action != "uninstall" {
+		return runTool("sc.exe", action, name)
+	}
+	runTool("sc.exe", "stop", name)
+	if err := runTool("sc.exe", "delete", name); err != nil {
+		return err
+	}
+	return runTool("reg.exe", "delete", `HKLM\SYSTEM\CurrentControlSet\Services\EventLog\Application\`+name, "/f")
+}
+
+// runTool runs a Windows admin tool, passing its output through
+func runTool(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v", name, strings.Join(args[:1], " "), err)
+	}
+	return nil
+}
+
+// runAsService hands the process to the service manager, which calls
+// serviceMain to start the server with args
+func runAsService(name string, args []string) error {
+	serviceName, _ = syscall.UTF16PtrFromString(name)
+	serverArgs = args
+	table := []struct {
+		name *uint16
+		proc uintptr
+	}{
+		{serviceName, syscall.NewCallback(serviceMain)},
+		{nil, 0},
+	}
+	r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+	if r == 0 {
+		return fmt.Errorf("not started by the service manager: %v", err)
+	}
+	return nil
+}
+
+var (
+	serviceName   *uint16
+	serverArgs    []string
+	statusHandle  uintptr
+	currentStatus = serviceStatus{ServiceType: serviceWin32OwnProcess}
+)
+
+func setStatus(state uint32) {
+	currentStatus.CurrentState = state
+	currentStatus.ControlsAccepted = 0
+	if state == serviceRunning {
+		currentStatus.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+	procSetServiceStatus.Call(statusHandle, uintptr(unsafe.Pointer(&currentStatus)))
+}
+
+// serviceMain runs on a thread of the service manager's dispatcher
+func serviceMain(argc, argv uintptr) uintptr {
+	statusHandle, _, _ = procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(serviceName)), syscall.NewCallback(serviceHandler), 0)
+	if statusHandle == 0 {
+		return 0
+	}
+	setStatus(serviceStartPending)
+	if err := logToEventLog(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: no event log: %v\n", err)
+	}
+
+	os.Args = append([]string{os.Args[0]}, serverArgs...)
+	go runServer()
+	setStatus(serviceRunning)
+	return 0
+}
+
+// serviceHandler gets the service manager's control requests
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		setStatus(serviceStopPending)
+		fmt.Fprintf(os.Stderr, "Service stopping\n")
+		setStatus(serviceStopped)
+		os.Exit(0)
+	case serviceControlInterrogate:
+		setStatus(currentStatus.CurrentState)
+	}
+	return 0
+}
+
+// logToEventLog sends stdout and stderr to the Application event log, one
+// event per line. Lines starting with "Error" are logged as errors.
+func logToEventLog() error {
+	source, _, err := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(serviceName)))
+	if source == 0 {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	os.Stdout, os.Stderr = w, w
+	useColor = false
+	go reportLines(source, r)
+	return nil
+}
+
+func reportLines(source uintptr, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		kind := eventlogInformationType
+		if strings.HasPrefix(line, "Error") {
+			kind = eventlogErrorType
+		}
+		msg, err := syscall.UTF16PtrFromString(line)
+		if err != nil {
+			continue
+		}
+		procReportEventW.Call(source, uintptr(kind), 0, eventID, 0, 1, 0, uintptr(unsafe.Pointer(&msg)), 0)
+	}
+}
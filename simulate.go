@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SimIssue is an ordering problem the simulator ran into: an operation that
+// would fail, or silently destroy data, when the plan runs in this order
+type SimIssue struct {
+	Index  int       `json:"index"` // Into the operations as simulated
+	Op     Operation `json:"op"`
+	Kind   string    `json:"kind"` // "source-missing", "overwrite", "parent-is-file", "destination-is-folder" or "size-mismatch"
+	Detail string    `json:"detail"`
+}
+
+// SimResult is the outcome of simulating a plan: the issues in plan order
+// and what the target would hold afterwards
+type SimResult struct {
+	Issues  []SimIssue     `json:"issues"`
+	Applied int            `json:"applied"` // Operations that would succeed
+	Files   int            `json:"files"`
+	Size    int64          `json:"size"`
+	folders map[string]int // Folders afterwards, with the files below each
+}
+
+// simFile is a file in the simulated target. content identifies the data,
+// so an overwrite can tell whether the data it replaces survives elsewhere.
+type simFile struct {
+	size    int64
+	content string
+}
+
+// simFS is an in-memory model of the target: its files, plus how many files
+// each folder holds below it, which is what makes a path a folder
+type simFS struct {
+	files map[string]simFile
+	dirs  map[string]int
+}
+
+func newSimFS(files []FileEntry) *simFS {
+	fs := &simFS{files: make(map[string]simFile, len(files)), dirs: make(map[string]int)}
+	for _, e := range files {
+		p := filepath.ToSlash(e.Path)
+		content := "path:" + p
+		if e.Hash != "" {
+			content = fmt.Sprintf("hash:%d:%s", e.Size, e.Hash)
+		}
+		fs.put(p, simFile{size: e.Size, content: content})
+	}
+	return fs
+}
+
+func (fs *simFS) put(p string, f simFile) {
+	if _, ok := fs.files[p]; !ok {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			fs.dirs[dir]++
+		}
+	}
+	fs.files[p] = f
+}
+
+func (fs *simFS) remove(p string) {
+	if _, ok := fs.files[p]; !ok {
+		return
+	}
+	delete(fs.files, p)
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if fs.dirs[dir]--; fs.dirs[dir] == 0 {
+			delete(fs.dirs, dir)
+		}
+	}
+}
+
+// fileAbove returns a file standing where one of p's parent folders would
+// have to be created, or ""
+func (fs *simFS) fileAbove(p string) string {
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if _, ok := fs.files[dir]; ok {
+			return dir
+		}
+	}
+	return ""
+}
+
+// simulatePlan runs the operations in order against a model of the files,
+// the way executePlan would run them on disk. Failing operations are left
+// out, like executePlan carries on past errors, so later ones see the same
+// state they would for real. Nothing on disk is read or changed.
+func simulatePlan(files []FileEntry, ops []Operation) SimResult {
+	fs := newSimFS(files)
+	result := SimResult{Issues: []SimIssue{}}
+	type overwrite struct {
+		issue   int
+		content string
+	}
+	var overwrites []overwrite
+
+	for i, op := range ops {
+		issue := func(kind, format string, args ...interface{}) {
+			result.Issues = append(result.Issues, SimIssue{Index: i, Op: op, Kind: kind, Detail: fmt.Sprintf(format, args...)})
+		}
+		// The destination of a move, copy or link must be creatable
+		writable := func(to string) bool {
+			if fs.dirs[to] > 0 {
+				issue("destination-is-folder", "%s is a folder", to)
+				return false
+			}
+			if above := fs.fileAbove(to); above != "" {
+				issue("parent-is-file", "%s would need a folder where the file %s is", to, above)
+				return false
+			}
+			return true
+		}
+
+		switch op.Type {
+		case "mv", "cp", "symlink", "hardlink", "rm":
+			src, ok := fs.files[op.From]
+			if !ok {
+				issue("source-missing", "%s is gone by then (moved or deleted by an earlier operation)", op.From)
+				continue
+			}
+			if op.Type == "rm" {
+				fs.remove(op.From)
+				break
+			}
+			if !writable(op.To) {
+				continue
+			}
+			if dst, ok := fs.files[op.To]; ok && op.To != op.From {
+				if op.Type == "symlink" || op.Type == "hardlink" {
+					// executeLink refuses to replace a file that isn't a copy
+					if dst.size != src.size {
+						issue("size-mismatch", "%s differs in size from %s, so it isn't replaced by a link", op.To, op.From)
+						continue
+					}
+				} else if dst.content != src.content {
+					issue("overwrite", "%s is overwritten while it still holds other data", op.To)
+					overwrites = append(overwrites, overwrite{len(result.Issues) - 1, dst.content})
+				}
+			}
+			if op.Type == "mv" {
+				fs.remove(op.From)
+			}
+			fs.put(op.To, src)
+		case "import":
+			// Replacing an outdated file is what an import is for
+			if !writable(op.To) {
+				continue
+			}
+			fs.put(op.To, simFile{size: op.Size, content: "import:" + op.From})
+		case "placeholder":
+			// A stub is never written over an existing file
+			if _, ok := fs.files[op.From]; ok {
+				continue
+			}
+			if fs.dirs[op.From] > 0 {
+				issue("destination-is-folder", "%s is a folder", op.From)
+				continue
+			}
+			if above := fs.fileAbove(op.From); above != "" {
+				issue("parent-is-file", "%s would need a folder where the file %s is", op.From, above)
+				continue
+			}
+			fs.put(op.From, simFile{size: op.Size, content: "placeholder:" + op.From})
+		default:
+			// Missing and updated files need data from the source
+			continue
+		}
+		result.Applied++
+	}
+
+	// An overwrite whose data is found nowhere afterwards lost it for good
+	left := make(map[string]bool, len(fs.files))
+	for _, f := range fs.files {
+		left[f.content] = true
+	}
+	for _, o := range overwrites {
+		if !left[o.content] {
+			result.Issues[o.issue].Detail += "; its data is lost"
+		}
+	}
+
+	for _, f := range fs.files {
+		result.Files++
+		result.Size += f.size
+	}
+	result.folders = fs.dirs
+	return result
+}
+
+// printSimulation shows the simulator's findings in the terminal
+func printSimulation(result SimResult, total int) {
+	fmt.Println(colorize(colorBold, fmt.Sprintf("Simulated %d operations: %d would succeed", total, result.Applied)))
+	for _, issue := range result.Issues {
+		fmt.Printf("  %s #%d %s %s: %s\n", colorize(colorRed, strings.ToUpper(issue.Kind)), issue.Index+1,
+			issue.Op.Type, shellQuote(issue.Op.From), printable(issue.Detail))
+	}
+	if len(result.Issues) == 0 {
+		fmt.Println(colorize(colorGreen, "No ordering problems found"))
+	}
+	fmt.Printf("Afterwards: %d files, %s\n", result.Files, formatSize(result.Size))
+}
+
+// handleValidate simulates a plan (same format as /apply) against the
+// catalog, as /apply would execute it: in its order and without the
+// operations it leaves out
+func handleValidate(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	plan, _, err := decodePlan(requestBody(w, r, maxPlanBytes))
+	if err != nil {
+		planError(w, err)
+		return
+	}
+	prepared := preparePlan(plan.Operations)
+
+	catalogMu.RLock()
+	files := catalog
+	catalogMu.RUnlock()
+	result := simulatePlan(files, prepared.ops)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
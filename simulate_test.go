@@ -0,0 +1,181 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSimulatePlan(t *testing.T) {
+	files := []FileEntry{
+		{Path: "a.jpg", Size: 10},
+		{Path: "b.jpg", Size: 20},
+		{Path: "c.jpg", Size: 30},
+		{Path: "docs", Size: 5}, // A file, not a folder
+		{Path: "photos/old/d.jpg", Size: 40},
+	}
+	tests := []struct {
+		name    string
+		ops     []Operation
+		kinds   []string // Issue kinds, in order
+		lost    []bool   // Per issue: whether the detail says the data is lost
+		applied int
+		files   int
+	}{
+		{
+			name: "overwrite chain in a safe order",
+			ops: []Operation{
+				{Type: "mv", From: "b.jpg", To: "c.jpg.tmp"},
+				{Type: "mv", From: "c.jpg", To: "b.jpg"},
+				{Type: "mv", From: "c.jpg.tmp", To: "c.jpg"},
+			},
+			applied: 3,
+			files:   5,
+		},
+		{
+			name: "overwrite chain in the wrong order loses data",
+			ops: []Operation{
+				{Type: "mv", From: "a.jpg", To: "b.jpg"},
+				{Type: "mv", From: "b.jpg", To: "c.jpg"},
+			},
+			kinds:   []string{"overwrite", "overwrite"},
+			lost:    []bool{true, true},
+			applied: 2,
+			files:   3,
+		},
+		{
+			name: "overwrite whose data survives in a copy",
+			ops: []Operation{
+				{Type: "cp", From: "b.jpg", To: "b-copy.jpg"},
+				{Type: "mv", From: "a.jpg", To: "b.jpg"},
+			},
+			kinds:   []string{"overwrite"},
+			lost:    []bool{false},
+			applied: 2,
+			files:   5,
+		},
+		{
+			name: "missing intermediate folders are created",
+			ops: []Operation{
+				{Type: "mv", From: "a.jpg", To: "new/deep/folder/a.jpg"},
+				{Type: "cp", From: "photos/old/d.jpg", To: "photos/new/2024/d.jpg"},
+				{Type: "placeholder", From: "stubs/x/e.jpg", Size: 50},
+			},
+			applied: 3,
+			files:   7,
+		},
+		{
+			name: "parent is a file",
+			ops: []Operation{
+				{Type: "mv", From: "a.jpg", To: "docs/a.jpg"},
+				{Type: "cp", From: "b.jpg", To: "c.jpg/b.jpg"},
+				{Type: "placeholder", From: "docs/sub/e.jpg", Size: 50},
+			},
+			kinds:   []string{"parent-is-file", "parent-is-file", "parent-is-file"},
+			applied: 0,
+			files:   5,
+		},
+		{
+			name: "parent file moved away first",
+			ops: []Operation{
+				{Type: "mv", From: "docs", To: "docs.txt"},
+				{Type: "mv", From: "a.jpg", To: "docs/a.jpg"},
+			},
+			applied: 2,
+			files:   5,
+		},
+		{
+			name: "destination is a folder",
+			ops: []Operation{
+				{Type: "mv", From: "a.jpg", To: "photos/old"},
+			},
+			kinds:   []string{"destination-is-folder"},
+			applied: 0,
+			files:   5,
+		},
+		{
+			name: "mv then cp of the same source",
+			ops: []Operation{
+				{Type: "mv", From: "a.jpg", To: "x/a.jpg"},
+				{Type: "cp", From: "a.jpg", To: "y/a.jpg"},
+			},
+			kinds:   []string{"source-missing"},
+			applied: 1,
+			files:   5,
+		},
+		{
+			name: "cp then mv of the same source",
+			ops: []Operation{
+				{Type: "cp", From: "a.jpg", To: "y/a.jpg"},
+				{Type: "mv", From: "a.jpg", To: "x/a.jpg"},
+			},
+			applied: 2,
+			files:   6,
+		},
+		{
+			name: "delete then move",
+			ops: []Operation{
+				{Type: "rm", From: "b.jpg"},
+				{Type: "mv", From: "b.jpg", To: "z.jpg"},
+				{Type: "rm", From: "b.jpg"},
+			},
+			kinds:   []string{"source-missing", "source-missing"},
+			applied: 1,
+			files:   4,
+		},
+		{
+			name: "link over a file of another size",
+			ops: []Operation{
+				{Type: "hardlink", From: "a.jpg", To: "b.jpg"},
+			},
+			kinds:   []string{"size-mismatch"},
+			applied: 0,
+			files:   5,
+		},
+		{
+			name: "missing and updated files are skipped",
+			ops: []Operation{
+				{Type: "missing", From: "new.jpg"},
+				{Type: "update", From: "a.jpg"},
+			},
+			applied: 0,
+			files:   5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := simulatePlan(files, tt.ops)
+			var kinds []string
+			for _, issue := range result.Issues {
+				kinds = append(kinds, issue.Kind)
+			}
+			if !reflect.DeepEqual(kinds, tt.kinds) {
+				t.Fatalf("issues %v, want %v", kinds, tt.kinds)
+			}
+			for i, lost := range tt.lost {
+				if got := strings.Contains(result.Issues[i].Detail, "data is lost"); got != lost {
+					t.Errorf("issue %d (%s): data lost %v, want %v", i, result.Issues[i].Detail, got, lost)
+				}
+			}
+			if result.Applied != tt.applied {
+				t.Errorf("applied %d, want %d", result.Applied, tt.applied)
+			}
+			if result.Files != tt.files {
+				t.Errorf("files %d, want %d", result.Files, tt.files)
+			}
+		})
+	}
+}
+
+func TestSimulatePlanIssueIndex(t *testing.T) {
+	files := []FileEntry{{Path: "a", Size: 1}}
+	ops := []Operation{
+		{Type: "mv", From: "a", To: "b"},
+		{Type: "rm", From: "a"},
+	}
+	result := simulatePlan(files, ops)
+	if len(result.Issues) != 1 || result.Issues[0].Index != 1 || result.Issues[0].Op != ops[1] {
+		t.Fatalf("issues %+v, want source-missing at index 1", result.Issues)
+	}
+}
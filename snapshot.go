@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// snapshotKind is the -snapshot filesystem: "", "btrfs", "zfs" or "apfs"
+var snapshotKind string
+
+func validSnapshotKind(kind string) bool {
+	return kind == "" || kind == "btrfs" || kind == "zfs" || kind == "apfs"
+}
+
+// takeSnapshot snapshots the target dir before a plan runs and returns a
+// name to roll back to. Without -snapshot it does nothing and returns "".
+func takeSnapshot(dir string) (string, error) {
+	name := "dir-mimic-" + time.Now().Format("20060102-150405")
+
+	switch snapshotKind {
+	case "":
+		return "", nil
+
+	case "btrfs":
+		// Read-only snapshot next to the target subvolume, so it isn't scanned
+		dest := filepath.Join(filepath.Dir(dir), filepath.Base(dir)+"@"+name)
+		if _, err := runSnapshotCmd("btrfs", "subvolume", "snapshot", "-r", dir, dest); err != nil {
+			return "", err
+		}
+		return dest, nil
+
+	case "zfs":
+		out, err := runSnapshotCmd("zfs", "list", "-H", "-o", "name", dir)
+		if err != nil {
+			return "", err
+		}
+		snapshot := strings.TrimSpace(out) + "@" + name
+		if _, err := runSnapshotCmd("zfs", "snapshot", snapshot); err != nil {
+			return "", err
+		}
+		return snapshot, nil
+
+	case "apfs":
+		// Local snapshots cover the whole volume and are named by date
+		out, err := runSnapshotCmd("tmutil", "localsnapshot", dir)
+		if err != nil {
+			return "", err
+		}
+		if i := strings.LastIndex(out, ": "); i >= 0 {
+			return "com.apple.TimeMachine." + strings.TrimSpace(out[i+2:]), nil
+		}
+		return strings.TrimSpace(out), nil
+	}
+	return "", fmt.Errorf("unknown snapshot type %q", snapshotKind)
+}
+
+func runSnapshotCmd(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
+
+// snapshotBeforeApply takes the -snapshot snapshot and reports it. A failed
+// snapshot stops the plan, since the escape hatch was asked for.
+func (t *applyTarget) snapshotBeforeApply() (string, bool) {
+	snapshot, err := takeSnapshot(t.dir)
+	if err != nil {
+		t.fprintf(os.Stderr, "Error: could not snapshot the target, not executing: %v\n", err)
+		return "", false
+	}
+	if snapshot != "" {
+		t.printf("Snapshot: %s\n", snapshot)
+	}
+	return snapshot, true
+}
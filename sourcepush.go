@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// pushedSource is the source catalog last sent to /source, by
+// "dir-mimic catalog -post" on the machine where the source is. It takes
+// the place of -source-catalog-url.
+var pushedSource struct {
+	sync.Mutex
+	label string // host:/path the catalog was scanned at
+	files []FileEntry
+}
+
+// haveSourceCatalog reports whether the server has a source catalog, pushed
+// or from -source-catalog-url
+func haveSourceCatalog() bool {
+	pushedSource.Lock()
+	defer pushedSource.Unlock()
+	return pushedSource.files != nil || sourceCatalogURL != ""
+}
+
+// pushedSourceLabel is where the pushed source catalog was scanned, "" if
+// none was pushed
+func pushedSourceLabel() string {
+	pushedSource.Lock()
+	defer pushedSource.Unlock()
+	if pushedSource.files == nil {
+		return ""
+	}
+	return pushedSource.label
+}
+
+// sourceCatalogLabel names the source catalog: where it was pushed from, or
+// its URL
+func sourceCatalogLabel() string {
+	if label := pushedSourceLabel(); label != "" {
+		return label
+	}
+	return sourceCatalogURL
+}
+
+// handleSourcePush takes a catalog (as /catalog returns it, optionally
+// gzipped) as the source to compare the target with, and tells the UI
+func handleSourcePush(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(requestBody(w, r, maxPlanBytes))
+	if err != nil {
+		http.Error(w, "Could not read the catalog: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var meta struct {
+		Path string `json:"path"`
+	}
+	json.Unmarshal(body, &meta)
+	files, err := decodeCatalog(body)
+	if err != nil {
+		http.Error(w, "Invalid catalog: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if meta.Path == "" {
+		meta.Path = "pushed catalog"
+	}
+
+	pushedSource.Lock()
+	pushedSource.label, pushedSource.files = meta.Path, files
+	pushedSource.Unlock()
+	// /plan, /tree and /export compare with it from now on. The plan is
+	// computed right away, so viewers get it without waiting.
+	planCache.Lock()
+	planCache.fetched = time.Time{}
+	planCache.Unlock()
+	fmt.Printf(tr("Source catalog received: %d files from %s\n"), len(files), meta.Path)
+	ops, _, err := currentPlan(diffMode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf(tr("Plan computed: %d operations\n"), len(ops))
+	result := map[string]interface{}{"path": meta.Path, "files": len(files), "operations": len(ops)}
+	events.publish(Event{Type: "source-catalog", Data: result})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// runCatalogCommand scans a directory, normally the source on another
+// machine, and writes its catalog to stdout or sends it to a server's
+// /source
+func runCatalogCommand(args []string) {
+	fs := flag.NewFlagSet("catalog", flag.ExitOnError)
+	hashFlag := fs.Bool("H", false, "Compute sample hashes, if the server compares with -H")
+	post := fs.String("post", "", "Send the catalog to this dir-mimic server, e.g. http://nas:8080")
+	token := fs.String("token", "", "Operator token of the server")
+	noDefaultIgnores := fs.Bool("no-default-ignores", false, "Disable built-in ignore patterns")
+	extraIgnores := fs.String("ignore", "", "Extra ignore patterns (comma-separated, matched against filename)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: dir-mimic catalog [-H] [-post url] [-token t] [-no-default-ignores] [-ignore patterns] <directory>\n")
+		os.Exit(1)
+	}
+
+	dir, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting absolute path: %v\n", err)
+		os.Exit(1)
+	}
+	ignorePatterns = buildIgnorePatterns(*noDefaultIgnores, *extraIgnores)
+	fmt.Fprintf(os.Stderr, "Scanning %s\n", dir)
+	scan, err := scanDirectory(dir, *hashFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error scanning %s: %v\n", dir, err)
+		os.Exit(1)
+	}
+	label := dir
+	if host, err := os.Hostname(); err == nil {
+		label = host + ":" + dir
+	}
+	doc := map[string]interface{}{
+		"version": catalogVersion,
+		"path":    label,
+		"files":   scan.Files,
+	}
+
+	if *post == "" {
+		if err := json.NewEncoder(os.Stdout).Encode(doc); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	ops, err := pushCatalog(sourcePushURL(*post), *token, doc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Sent %d files to %s, its plan has %d operations\n", len(scan.Files), *post, ops)
+}
+
+// sourcePushURL adds /source to a bare server address, like
+// http://nas:8080
+func sourcePushURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return raw
+	}
+	u.Path = "/source"
+	return u.String()
+}
+
+// pushCatalog sends a catalog gzipped to a server's /source and returns
+// the number of operations in the plan the server computed for it
+func pushCatalog(to, token string, doc interface{}) (int, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(doc); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, to, &buf)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if msg = bytes.TrimSpace(msg); len(msg) == 0 {
+			msg = []byte(resp.Status)
+		}
+		return 0, fmt.Errorf("%s: %s", to, msg)
+	}
+	var result struct {
+		Operations int `json:"operations"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("%s: invalid response: %v", to, err)
+	}
+	return result.Operations, nil
+}
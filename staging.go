@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// stageDir is -stage-dir: a cache of copied and imported content, each file
+// a hardlink named after its SHA-256. A file the plan copies to several
+// places is read once, and the further copies are cloned from the cache; an
+// import whose SHA-256 is cached doesn't fetch its data again, on this run
+// or a later one. Clones are reflinks where the filesystem has them (btrfs,
+// XFS) and hardlinks elsewhere, so the cache must be on the target's
+// filesystem.
+var stageDir string
+
+// stageMinSize is the smallest file that goes through the cache; linking
+// saves little on smaller ones
+const stageMinSize = 1 << 20
+
+// stagedFile is a cache entry as it was added. An entry that no longer
+// matches was changed in place through one of its other names, and is
+// dropped.
+type stagedFile struct {
+	Size  int64 `json:"size"`
+	MTime int64 `json:"mtime"` // Unix ns
+}
+
+// stageIndex is the cache's index.json: SHA-256 -> entry
+var stageIndex map[string]stagedFile
+
+// stagedCopies remembers the SHA-256 of the files copied so far, keyed by
+// stageKey, so the next copy of one is cloned without reading it again.
+// Like the index it needs no lock: -stage-dir takes a single target.
+var stagedCopies = make(map[string]string)
+
+// setupStageDir checks -stage-dir and loads its index
+func setupStageDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	abs, err := checkOutsideTarget("-stage-dir", dir)
+	if err != nil {
+		return err
+	}
+	targetInfo, err := os.Stat(targetDir)
+	if err != nil {
+		return err
+	}
+	// The cache may not exist yet, its parent has to
+	parentInfo, err := os.Stat(existingParent(filepath.Join(abs, "x")))
+	if err != nil {
+		return err
+	}
+	targetDev, ok1 := deviceID(targetInfo)
+	parentDev, ok2 := deviceID(parentInfo)
+	if ok1 && ok2 && targetDev != parentDev {
+		return fmt.Errorf("-stage-dir must be on the same filesystem as the target, links can't cross filesystems")
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return err
+	}
+
+	stageIndex = make(map[string]stagedFile)
+	data, err := os.ReadFile(filepath.Join(abs, "index.json"))
+	if err == nil {
+		if err := json.Unmarshal(data, &stageIndex); err != nil {
+			return fmt.Errorf("-stage-dir: invalid index.json: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	stageDir = abs
+	return nil
+}
+
+// saveStageIndex writes the cache's index
+func saveStageIndex() {
+	data, err := json.Marshal(stageIndex)
+	if err == nil {
+		tmp := filepath.Join(stageDir, "index.json.tmp")
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, filepath.Join(stageDir, "index.json"))
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not save the -stage-dir index: %v\n", err)
+	}
+}
+
+// stageKey identifies a copy source as it is now, so a changed file isn't
+// taken for the one copied before
+func stageKey(rel string, info os.FileInfo) string {
+	return fmt.Sprintf("%s|%d|%d", rel, info.Size(), info.ModTime().UnixNano())
+}
+
+// stagedPath returns the cache entry for a SHA-256, or "" when there is
+// none or it was changed since it was added
+func stagedPath(sum string) string {
+	if stageDir == "" || sum == "" {
+		return ""
+	}
+	entry := filepath.Join(stageDir, sum)
+	want, indexed := stageIndex[sum]
+	info, err := os.Stat(entry)
+	if indexed && err == nil && info.Size() == want.Size && info.ModTime().UnixNano() == want.MTime {
+		return entry
+	}
+	if indexed || err == nil {
+		os.Remove(entry)
+		delete(stageIndex, sum)
+		saveStageIndex()
+	}
+	return ""
+}
+
+// stageFile adds a file just written to the target to the cache, as a
+// hardlink, so it takes no extra space
+func stageFile(sum, full string) {
+	if stageDir == "" || stagedPath(sum) != "" {
+		return
+	}
+	info, err := os.Stat(full)
+	if err != nil || info.Size() < stageMinSize {
+		return
+	}
+	if err := os.Link(full, filepath.Join(stageDir, sum)); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not cache %s in -stage-dir: %v\n", full, err)
+		return
+	}
+	stageIndex[sum] = stagedFile{Size: info.Size(), MTime: info.ModTime().UnixNano()}
+	saveStageIndex()
+}
+
+// cloneFromStage puts a cache entry at dst, replacing what is there: a
+// reflink where the filesystem can make one, otherwise a hardlink. It goes
+// through a temporary name, so a failure leaves dst as it was. It reports
+// whether dst got its own inode, which a hardlink shares with the cache and
+// every other copy linked from it.
+func cloneFromStage(entry, dst string) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+	tmp := dst + ".dir-mimic-stage"
+	os.Remove(tmp)
+	own := true
+	if err := reflink(entry, tmp); err != nil {
+		os.Remove(tmp)
+		own = false
+		if err := os.Link(entry, tmp); err != nil {
+			return false, err
+		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return own, nil
+}
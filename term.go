@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// useColor enables ANSI colors in terminal output. Off with -no-color, the
+// NO_COLOR environment variable, or when stdout isn't a terminal.
+var useColor = detectColor()
+
+func detectColor() bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// ANSI color codes
+const (
+	colorRed     = "31"
+	colorGreen   = "32"
+	colorYellow  = "33"
+	colorBlue    = "34"
+	colorMagenta = "35"
+	colorBold    = "1"
+	colorDim     = "2"
+)
+
+// colorize wraps s in an ANSI color if colors are on
+func colorize(code, s string) string {
+	if !useColor {
+		return s
+	}
+	return "\x1b[" + code + "m" + s + "\x1b[0m"
+}
+
+// shellQuote returns s in a form that can be pasted into a POSIX shell as a
+// single word. Plain names are left alone, control characters (which could
+// rewrite the terminal) use $'...' escapes.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	plain, printable := true, true
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			printable = false
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_./+-,:@%=", r) {
+			plain = false
+		}
+	}
+	if plain {
+		return s
+	}
+	if printable {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+
+	var b strings.Builder
+	b.WriteString("$'")
+	for _, r := range s {
+		switch {
+		case r == '\'' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case !unicode.IsPrint(r) && r < 0x10000:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		case !unicode.IsPrint(r):
+			fmt.Fprintf(&b, `\U%08x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// printable replaces control characters with '?', for free text from a plan
+// such as operation reasons
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// stdinIsTerminal reports whether stdin is an interactive terminal, which
+// the confirmation prompt needs
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// /dev/null is a character device too (docker run without -i, nohup)
+	if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(info, null) {
+		return false
+	}
+	return true
+}
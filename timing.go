@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// opTiming accumulates how long one kind of operation took in past applies
+type opTiming struct {
+	Count   int64   `json:"count"`
+	Bytes   int64   `json:"bytes,omitempty"` // Copies only
+	Seconds float64 `json:"seconds"`
+}
+
+// timingDecay halves the totals once an operation kind has this many
+// samples, so recent runs (and disks) weigh more
+const timingDecay = 10000
+
+// TimingRates are the per-operation costs estimates are based on, measured
+// in previous applies or rough defaults
+type TimingRates struct {
+	Move     float64 `json:"move"`     // Seconds per rename
+	Delete   float64 `json:"delete"`   // Seconds per delete
+	Link     float64 `json:"link"`     // Seconds per symlink/hardlink/placeholder
+	CopyRate float64 `json:"copyRate"` // Bytes per second
+	Measured bool    `json:"measured"` // False until an apply recorded timings
+}
+
+var (
+	timingsMu sync.Mutex
+	timings   map[string]*opTiming // By "mv", "cp", "rm", "link"; loaded lazily
+)
+
+// timingsPath is where the history lives, outside any target directory
+func timingsPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dir-mimic", "timings.json"), nil
+}
+
+// loadTimings reads the history once; must be called with timingsMu held
+func loadTimings() {
+	if timings != nil {
+		return
+	}
+	timings = make(map[string]*opTiming)
+	if p, err := timingsPath(); err == nil {
+		if data, err := os.ReadFile(p); err == nil {
+			json.Unmarshal(data, &timings)
+		}
+	}
+}
+
+// timingKind groups operation types the way they are timed
+func timingKind(opType string) string {
+	if opType == "symlink" || opType == "hardlink" || opType == "placeholder" {
+		return "link"
+	}
+	if opType == "import" {
+		return "cp"
+	}
+	return opType
+}
+
+// recordTimings adds the operations of one apply to the history and saves it
+func recordTimings(samples map[string]*opTiming) {
+	timingsMu.Lock()
+	defer timingsMu.Unlock()
+	loadTimings()
+	for kind, s := range samples {
+		t := timings[kind]
+		if t == nil {
+			t = &opTiming{}
+			timings[kind] = t
+		}
+		t.Count += s.Count
+		t.Bytes += s.Bytes
+		t.Seconds += s.Seconds
+		if t.Count > timingDecay {
+			t.Count, t.Bytes, t.Seconds = t.Count/2, t.Bytes/2, t.Seconds/2
+		}
+	}
+
+	p, err := timingsPath()
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+	}
+	if err == nil {
+		data, _ := json.Marshal(timings)
+		err = os.WriteFile(p, data, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not save operation timings: %v\n", err)
+	}
+}
+
+// timingRates returns the measured rates, with defaults where there is no
+// history: a millisecond or two per rename, delete or link, 100 MB/s copies
+func timingRates() TimingRates {
+	timingsMu.Lock()
+	defer timingsMu.Unlock()
+	loadTimings()
+
+	rates := TimingRates{Move: 0.001, Delete: 0.001, Link: 0.002, CopyRate: 100e6}
+	perOp := func(kind string, rate *float64) {
+		if t := timings[kind]; t != nil && t.Count > 0 {
+			*rate = t.Seconds / float64(t.Count)
+			rates.Measured = true
+		}
+	}
+	perOp("mv", &rates.Move)
+	perOp("rm", &rates.Delete)
+	perOp("link", &rates.Link)
+	if t := timings["cp"]; t != nil && t.Bytes > 0 && t.Seconds > 0 {
+		rates.CopyRate = float64(t.Bytes) / t.Seconds
+		rates.Measured = true
+	}
+	return rates
+}
+
+// estimatePlanTime estimates how long executing the plan takes. Copy sizes
+// come from the files on disk.
+func estimatePlanTime(ops []Operation) (time.Duration, TimingRates) {
+	rates := timingRates()
+	var seconds float64
+	for _, op := range ops {
+		switch timingKind(op.Type) {
+		case "mv":
+			seconds += rates.Move
+		case "rm":
+			seconds += rates.Delete
+		case "link":
+			seconds += rates.Link
+		case "cp":
+			if info, err := os.Stat(filepath.Join(targetDir, op.From)); err == nil {
+				seconds += float64(info.Size()) / rates.CopyRate
+			}
+		}
+	}
+	return time.Duration(seconds * float64(time.Second)), rates
+}
+
+// printTimeEstimate shows the estimated execution time in the plan summary
+func printTimeEstimate(ops []Operation) {
+	d, rates := estimatePlanTime(ops)
+	note := "based on previous runs"
+	if !rates.Measured {
+		note = "rough guess, no previous runs"
+	}
+	fmt.Printf(tr("Estimated time: %s (%s)\n"), formatDuration(d), tr(note))
+}
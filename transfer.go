@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// linkSpeedMbps is the -link-speed used to estimate how long missing data
+// takes to copy over from the source
+var linkSpeedMbps = 100.0
+
+// transferBytes sums the data missing and update operations (and
+// placeholders, which only stand in for it) need from the source, in total
+// and per top-level folder
+func transferBytes(ops []Operation) (int64, map[string]int64) {
+	var total int64
+	byFolder := make(map[string]int64)
+	for _, op := range ops {
+		if op.Type == "missing" || op.Type == "update" || op.Type == "placeholder" {
+			total += op.Size
+			byFolder[topFolder(op.From)] += op.Size
+		}
+	}
+	return total, byFolder
+}
+
+// transferTime estimates how long moving n bytes takes at -link-speed
+func transferTime(n int64) time.Duration {
+	return time.Duration(float64(n) * 8 / (linkSpeedMbps * 1e6) * float64(time.Second))
+}
+
+// formatDuration formats an estimate the same way as the web UI
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()+0.5))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()+0.5))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%.1f days", d.Hours()/24)
+}
+
+// printTransferEstimate shows how much data has to come from the source and
+// where it goes, largest folders first
+func printTransferEstimate(ops []Operation) {
+	total, byFolder := transferBytes(ops)
+	if total == 0 {
+		return
+	}
+	fmt.Printf(tr("To transfer from source: %s, about %s at %g Mbit/s\n"),
+		formatSize(total), formatDuration(transferTime(total)), linkSpeedMbps)
+
+	folders := make([]string, 0, len(byFolder))
+	for f := range byFolder {
+		folders = append(folders, f)
+	}
+	sort.Slice(folders, func(i, j int) bool { return byFolder[folders[i]] > byFolder[folders[j]] })
+	for _, f := range folders {
+		fmt.Printf("  %10s  %s/\n", formatSize(byFolder[f]), shellQuote(f))
+	}
+}
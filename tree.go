@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourceCacheTTL is how long /tree reuses a fetched source catalog, so
+// drilling down level by level doesn't refetch it on every click
+const sourceCacheTTL = time.Minute
+
+// planCache holds the last plan computed for /tree
+var planCache struct {
+	sync.Mutex
+	fetched    time.Time
+	source     []FileEntry
+	catalogSeq int64
+	mode       string
+	ops        []Operation
+	sizes      planSizes
+}
+
+// planSizes looks up file sizes on either side of a plan
+type planSizes struct {
+	source, target map[string]int64
+}
+
+// TreeNode aggregates the operations below a folder. Counts use the same
+// categories as the UI summary (mv, cp, rm, ln, update, special, missing).
+type TreeNode struct {
+	Name     string           `json:"name"`
+	Path     string           `json:"path"`
+	Counts   map[string]int   `json:"counts"`
+	Bytes    map[string]int64 `json:"bytes"`
+	Children []*TreeNode      `json:"children,omitempty"`
+	Ops      []Operation      `json:"ops,omitempty"` // Only for the requested folder
+}
+
+// opCategory maps an operation type to its summary category
+func opCategory(op Operation) string {
+	if op.Type == "symlink" || op.Type == "hardlink" {
+		return "ln"
+	}
+	return op.Type
+}
+
+// opPath is where an operation shows up in the tree: links where they will
+// be created, everything else at its source path
+func opPath(op Operation) string {
+	if op.Type == "symlink" || op.Type == "hardlink" {
+		return op.To
+	}
+	return op.From
+}
+
+// currentPlan returns the plan of the source catalog (pushed to /source or
+// from -source-catalog-url) against the server catalog, recomputing it when
+// either side or the mode changed
+func currentPlan(mode string) ([]Operation, planSizes, error) {
+	planCache.Lock()
+	defer planCache.Unlock()
+
+	refetch := time.Since(planCache.fetched) > sourceCacheTTL
+	if refetch {
+		files, err := fetchSourceCatalog()
+		if err != nil {
+			return nil, planSizes{}, err
+		}
+		planCache.source, planCache.fetched = files, time.Now()
+	}
+
+	catalogMu.RLock()
+	seq, target, special, mounts := catalogSeq, catalog, specialFiles, mountPoints
+	catalogMu.RUnlock()
+
+	if refetch || seq != planCache.catalogSeq || mode != planCache.mode || planCache.ops == nil {
+		planCache.ops = computePlan(planCache.source, target, special, mounts, mode)
+		planCache.catalogSeq, planCache.mode = seq, mode
+		planCache.sizes = planSizes{source: sizeIndex(planCache.source), target: sizeIndex(target)}
+	}
+	return planCache.ops, planCache.sizes, nil
+}
+
+func sizeIndex(files []FileEntry) map[string]int64 {
+	sizes := make(map[string]int64, len(files))
+	for _, e := range files {
+		sizes[e.Path] = e.Size
+	}
+	return sizes
+}
+
+// opSize is the number of bytes an operation concerns. Missing and update
+// sizes come from the source, everything else from the target.
+func (s planSizes) opSize(op Operation) int64 {
+	if op.Type == "missing" || op.Type == "update" {
+		return s.source[op.From]
+	}
+	return s.target[op.From]
+}
+
+// buildTreeNode aggregates ops below dir, expanding depth levels of
+// children. Only the top node lists the operations directly inside it.
+func buildTreeNode(ops []Operation, sizes planSizes, dir string, depth int, withOps bool) *TreeNode {
+	node := &TreeNode{
+		Name:   dir[strings.LastIndex(dir, "/")+1:],
+		Path:   dir,
+		Counts: make(map[string]int),
+		Bytes:  make(map[string]int64),
+	}
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	children := make(map[string][]Operation)
+	for _, op := range ops {
+		p := opPath(op)
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		cat := opCategory(op)
+		node.Counts[cat]++
+		node.Bytes[cat] += sizes.opSize(op)
+
+		rest := p[len(prefix):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			children[rest[:i]] = append(children[rest[:i]], op)
+		} else if withOps {
+			node.Ops = append(node.Ops, op)
+		}
+	}
+
+	if depth > 0 {
+		names := make([]string, 0, len(children))
+		for name := range children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := buildTreeNode(children[name], sizes, prefix+name, depth-1, false)
+			node.Children = append(node.Children, child)
+		}
+	}
+	return node
+}
+
+// handleTree returns per-folder operation counts and sizes for the plan of
+// the -source-catalog-url catalog, one or more levels below ?path=
+func handleTree(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !haveSourceCatalog() {
+		http.Error(w, "No source catalog URL configured or catalog pushed", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	dir := strings.Trim(q.Get("path"), "/")
+	depth := 1
+	if d := q.Get("depth"); d != "" {
+		var err error
+		if depth, err = strconv.Atoi(d); err != nil || depth < 1 {
+			http.Error(w, "depth must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	mode := q.Get("mode")
+	if mode == "" {
+		mode = diffMode
+	}
+	if mode != "relocate" && mode != "strict" && mode != "content" {
+		http.Error(w, "mode must be relocate, strict or content", http.StatusBadRequest)
+		return
+	}
+
+	ops, sizes, err := currentPlan(mode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildTreeNode(ops, sizes, dir, depth, true))
+}
+
+// handlePlan returns the plan computed on the server for the source catalog
+// (pushed to /source or from -source-catalog-url), in the format /apply
+// takes, so a client can show or execute it without computing it itself.
+// ?mode= as for /tree.
+func handlePlan(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !haveSourceCatalog() {
+		http.Error(w, "No source catalog URL configured or catalog pushed", http.StatusNotFound)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = diffMode
+	}
+	if mode != "relocate" && mode != "strict" && mode != "content" {
+		http.Error(w, "mode must be relocate, strict or content", http.StatusBadRequest)
+		return
+	}
+
+	ops, _, err := currentPlan(mode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	planCache.Lock()
+	seq := planCache.catalogSeq
+	planCache.Unlock()
+	if ops == nil {
+		ops = []Operation{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Plan{Version: planVersion, Operations: ops, CatalogSeq: seq})
+}
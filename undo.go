@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// UndoPlan takes back an executed plan. It is a plan like any other, so
+// `dir-mimic apply` runs it; Incomplete lists the operations it can't take
+// back fully, like deletes.
+type UndoPlan struct {
+	Version    int         `json:"version"` // planVersion
+	Operations []Operation `json:"operations"`
+	Incomplete []Operation `json:"incomplete,omitempty"`
+}
+
+// writeUndoPlan saves the undo plan of an apply to path
+func writeUndoPlan(path string, undo *UndoPlan) error {
+	data, err := json.MarshalIndent(undo, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Printf(tr("Undo plan written to %s (%d operations, %d not undoable)\n"), shellQuote(path), len(undo.Operations), len(undo.Incomplete))
+	return nil
+}
+
+// undoOperation returns the operations that take back an executed one, in
+// the order to run them, and whether they undo it completely. replaced says
+// whether a file was at the destination before, backup is where it was kept
+// (see backupExisting). Deletes can't be undone, and neither can replacing a
+// file whose backup isn't inside the target dir, where a plan could reach
+// it; a move is still moved back then.
+func undoOperation(dir string, op Operation, replaced bool, backup string) ([]Operation, bool) {
+	// A backup next to the destination (-backup-suffix) can be moved back
+	var restore []Operation
+	if replaced && (op.Type == "mv" || op.Type == "cp" || op.Type == "import") {
+		rel, err := filepath.Rel(dir, backup)
+		if backup != "" && err == nil && filepath.IsLocal(rel) {
+			restore = []Operation{{Type: "mv", From: filepath.ToSlash(rel), To: op.To, Reason: "undo: restore the replaced file"}}
+		} else if op.Type != "mv" {
+			return nil, false
+		}
+	}
+
+	switch op.Type {
+	case "mv":
+		return append([]Operation{{Type: "mv", From: op.To, To: op.From, Reason: "undo: move back"}}, restore...), !replaced || restore != nil
+	case "cp", "import":
+		if restore != nil {
+			return restore, true
+		}
+		what := "copy"
+		if op.Type == "import" {
+			what = "imported file"
+		}
+		return []Operation{{Type: "rm", From: op.To, Reason: "undo: remove the " + what}}, true
+	case "symlink", "hardlink":
+		// The duplicate had the same data as the canonical copy
+		return []Operation{
+			{Type: "rm", From: op.To, Reason: "undo: remove the link"},
+			{Type: "cp", From: op.From, To: op.To, Reason: "undo: separate copy again"},
+		}, true
+	case "placeholder":
+		return []Operation{{Type: "rm", From: op.From, Reason: "undo: remove the placeholder"}}, true
+	}
+	return nil, false
+}
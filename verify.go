@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VerifySummary is printed to stdout by `dir-mimic verify`
+type VerifySummary struct {
+	Match      bool           `json:"match"`
+	Source     string         `json:"source"`
+	Directory  string         `json:"directory"`
+	Mode       string         `json:"mode"`
+	Files      int            `json:"files"`
+	Counts     map[string]int `json:"counts"`
+	Transfer   int64          `json:"transferBytes"` // Missing and outdated data
+	Operations []Operation    `json:"operations"`
+}
+
+// runVerify implements `dir-mimic verify <source-catalog> <dir>`: compare a
+// directory against a catalog and exit 0 if it matches, 1 if not, 2 on error
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	linkSpeed := fs.Float64("link-speed", linkSpeedMbps, "Link speed in Mbit/s for the transfer estimate")
+	dates := fs.Bool("photo-dates", false, "Read photo capture times from EXIF and match photos by capture time + size")
+	audio := fs.Bool("audio-hash", false, "Hash the audio data of MP3 and FLAC files, so retagged copies still match")
+	conflict := fs.String("conflict", conflictStrategy, "Strict mode conflicts: source, newer, larger, keep-both or ask")
+	honorIgnore := fs.Bool("honor-ignore-files", false, "Don't catalog what the directory's .stignore and .rsync-filter files exclude")
+	matcher := fs.String("matcher-cmd", "", "Command that pairs up files left unmatched by the diff")
+	hashFlag := fs.Bool("H", false, "Compare sample hashes too (when the catalog has them)")
+	mode := fs.String("mode", "strict", "Comparison mode: strict, relocate or content")
+	noDefaultIgnores := fs.Bool("no-default-ignores", false, "Disable built-in ignore patterns")
+	extraIgnores := fs.String("ignore", "", "Extra ignore patterns (comma-separated, matched against filename)")
+	configFile := fs.String("config", "", "Config file with named profiles")
+	profile := fs.String("profile", "", "Take flags not given on the command line from this profile")
+	fs.Parse(args)
+	if err := setupProfile(fs, *configFile, *profile, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: dir-mimic verify [-profile name] [-config file] [-H] [-honor-ignore-files] [-photo-dates] [-audio-hash] [-mode strict|relocate|content] [-conflict strategy] [-link-speed mbps] [-matcher-cmd cmd] [-no-default-ignores] [-ignore patterns] <source-catalog> <directory>\n")
+		os.Exit(exitError)
+	}
+	if *mode != "strict" && *mode != "relocate" && *mode != "content" {
+		fmt.Fprintf(os.Stderr, "Error: -mode must be strict, relocate or content\n")
+		os.Exit(exitError)
+	}
+
+	if linkSpeedMbps = *linkSpeed; linkSpeedMbps <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -link-speed must be positive\n")
+		os.Exit(exitError)
+	}
+	matcherCmd = *matcher
+	honorIgnoreFiles = *honorIgnore
+	if conflictStrategy = *conflict; !containsString(conflictStrategies, conflictStrategy) {
+		fmt.Fprintf(os.Stderr, "Error: -conflict must be one of %s\n", strings.Join(conflictStrategies, ", "))
+		os.Exit(exitError)
+	}
+	photoDates = *dates
+	audioHashing = *audio
+	ignorePatterns = buildIgnorePatterns(*noDefaultIgnores, *extraIgnores)
+
+	source, err := loadCatalogArg(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	targetDir, err = filepath.Abs(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting absolute path: %v\n", err)
+		os.Exit(exitError)
+	}
+	fmt.Fprintf(os.Stderr, "Scanning directory: %s\n", targetDir)
+	scan, err := scanDirectory(targetDir, *hashFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error scanning directory: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	summary := VerifySummary{
+		Source:     fs.Arg(0),
+		Directory:  targetDir,
+		Mode:       *mode,
+		Files:      len(scan.Files),
+		Counts:     make(map[string]int),
+		Operations: []Operation{},
+	}
+	// Special files can't be in a catalog, so they don't count as drift
+	for _, op := range computePlan(source, scan.Files, nil, scan.Mounts, *mode) {
+		summary.Counts[opCategory(op)]++
+		summary.Operations = append(summary.Operations, op)
+	}
+	summary.Transfer, _ = transferBytes(summary.Operations)
+	summary.Match = len(summary.Operations) == 0 && len(scan.Inaccessible) == 0
+	for _, e := range scan.Inaccessible {
+		fmt.Fprintf(os.Stderr, "Unreadable: %s: %s\n", e.Path, e.Error)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(summary)
+
+	if !summary.Match {
+		fmt.Fprintf(os.Stderr, "Directory differs from catalog: %d operations\n", len(summary.Operations))
+		if summary.Transfer > 0 {
+			fmt.Fprintf(os.Stderr, "Missing data: %s, about %s at %g Mbit/s\n",
+				formatSize(summary.Transfer), formatDuration(transferTime(summary.Transfer)), linkSpeedMbps)
+		}
+		os.Exit(exitDifferences)
+	}
+	fmt.Fprintf(os.Stderr, "Directory matches catalog\n")
+}
+
+// loadCatalogArg reads a catalog from a file, or fetches it if the argument
+// is a URL
+func loadCatalogArg(arg string) ([]FileEntry, error) {
+	if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+		return fetchCatalog(normalizeCatalogURL(arg))
+	}
+	data, err := os.ReadFile(arg)
+	if err != nil {
+		return nil, err
+	}
+	files, err := decodeCatalog(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid catalog %s: %w", arg, err)
+	}
+	return files, nil
+}
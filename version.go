@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jokkebk/dir-mimic/planspec"
+)
+
+// Versions of the catalog and plan JSON this build writes, as their
+// "version" field. Bump one when the format changes in a way an older
+// reader would get wrong, and teach upgradeCatalog or decodePlan the old
+// one. Documents without the field predate versioning and count as 0.
+const (
+	catalogVersion = 1
+	planVersion    = planspec.Version
+)
+
+// checkVersion refuses a document from a newer dir-mimic instead of
+// misreading it
+func checkVersion(what string, version, current int) error {
+	if version < 0 {
+		return fmt.Errorf("invalid %s version %d", what, version)
+	}
+	if version > current {
+		return fmt.Errorf("%s version %d was written by a newer dir-mimic, this one reads up to version %d; upgrade dir-mimic to use it",
+			what, version, current)
+	}
+	return nil
+}
+
+// upgradeCatalog converts the entries of an older catalog to the current
+// version. Version 0 catalogs made on Windows have paths with backslashes;
+// since version 1 paths are always separated by "/". A catalog counts as
+// made on Windows when no path has a "/" but some have a "\", which a file
+// name on Unix can have too.
+func upgradeCatalog(files []FileEntry, version int) []FileEntry {
+	if version >= 1 {
+		return files
+	}
+	backslashes := false
+	for _, f := range files {
+		if strings.Contains(f.Path, "/") {
+			return files
+		}
+		backslashes = backslashes || strings.Contains(f.Path, `\`)
+	}
+	if backslashes {
+		for i := range files {
+			files[i].Path = strings.ReplaceAll(files[i].Path, `\`, "/")
+		}
+	}
+	return files
+}
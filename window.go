@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// applyWindow is -apply-window, the time of day plans may run, e.g.
+// 01:00-06:00 when the disks are shared with daytime users. A window may
+// span midnight (22:00-06:00).
+type applyWindow struct {
+	start, end int // Minutes after midnight, local time
+}
+
+// window is the -apply-window, nil when plans run whenever they are confirmed
+var window *applyWindow
+
+// parseApplyWindow reads a window like 01:00-06:00
+func parseApplyWindow(s string) (*applyWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid apply window %q, expected HH:MM-HH:MM", s)
+	}
+	var w applyWindow
+	for _, p := range []struct {
+		s string
+		m *int
+	}{{from, &w.start}, {to, &w.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(p.s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid apply window %q, expected HH:MM-HH:MM", s)
+		}
+		*p.m = t.Hour()*60 + t.Minute()
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("apply window %q is empty", s)
+	}
+	return &w, nil
+}
+
+func (w *applyWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+// isOpen reports whether t is inside the window
+func (w *applyWindow) isOpen(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// opensAt returns when the window next opens after t, t itself if it is open
+func (w *applyWindow) opensAt(t time.Time) time.Time {
+	if w.isOpen(t) {
+		return t
+	}
+	open := time.Date(t.Year(), t.Month(), t.Day(), w.start/60, w.start%60, 0, 0, t.Location())
+	if !open.After(t) {
+		open = open.AddDate(0, 0, 1)
+	}
+	return open
+}
+
+// queuedRun is the confirmed plan waiting for the apply window, or running
+// in it. While it is set the apply state is applyQueued or applyExecuting,
+// so no other plan runs until it is done or cancelled.
+var queuedRun struct {
+	sync.Mutex
+	plan     *confirmedPlan
+	next     int       // Index of the first operation not run yet
+	opensAt  time.Time // When it runs next, zero while it runs
+	cancel   chan struct{}
+	errors   []string
+	deferred []Operation // Files in use, not run
+	undo     *UndoPlan
+	snapshot string
+	last     map[string]interface{} // Outcome of the last queued plan
+}
+
+// QueuedStatus describes the queued plan in /status and /apply/queued
+type QueuedStatus struct {
+	Checksum string     `json:"checksum"`
+	Done     int        `json:"done"`
+	Total    int        `json:"total"`
+	Errors   int        `json:"errors"`
+	Deferred int        `json:"deferred"`
+	OpensAt  *time.Time `json:"opensAt,omitempty"` // Missing while it runs
+}
+
+// queuedStatus returns how far the queued plan is; the caller holds the lock
+func queuedStatus() *QueuedStatus {
+	if queuedRun.plan == nil {
+		return nil
+	}
+	status := &QueuedStatus{
+		Checksum: queuedRun.plan.checksum,
+		Done:     queuedRun.next,
+		Total:    len(queuedRun.plan.ops),
+		Errors:   len(queuedRun.errors),
+		Deferred: len(queuedRun.deferred),
+	}
+	if !queuedRun.opensAt.IsZero() {
+		opensAt := queuedRun.opensAt
+		status.OpensAt = &opensAt
+	}
+	return status
+}
+
+// applyWindowString is the -apply-window, "" when there is none
+func applyWindowString() string {
+	if window == nil {
+		return ""
+	}
+	return window.String()
+}
+
+// outsideWindow reports whether -apply-window holds plans back right now
+func outsideWindow() bool {
+	return window != nil && !window.isOpen(time.Now())
+}
+
+// queuePlan holds a confirmed plan until the apply window opens (right away
+// if it is open) and runs it there, pausing whenever the window closes
+// before it is done
+func queuePlan(plan *confirmedPlan) *QueuedStatus {
+	queuedRun.Lock()
+	defer queuedRun.Unlock()
+	queuedRun.plan, queuedRun.next, queuedRun.errors = plan, 0, []string{}
+	queuedRun.deferred = []Operation{}
+	queuedRun.undo = &UndoPlan{Version: planVersion, Operations: []Operation{}}
+	queuedRun.snapshot = ""
+	queuedRun.cancel = make(chan struct{})
+	queuedRun.opensAt = window.opensAt(time.Now())
+	setApplyPhase(applyQueued)
+	if outsideWindow() {
+		fmt.Printf(tr("Plan queued, it runs when the apply window %s opens at %s\n"), window, queuedRun.opensAt.Format("2006-01-02 15:04"))
+	}
+	go runQueued(queuedRun.cancel)
+	return queuedStatus()
+}
+
+// executeWhile, when set, is asked before each operation of executePlan
+// whether to run it (the i-th of its operations); executePlan stops at the
+// first one it declines. runQueued sets it to stop when the window closes.
+var executeWhile func(i int) bool
+
+// runQueued waits for the window and executes the queued plan, checking
+// the window before each operation, so it stops when the window closes and
+// goes on in the next
+func runQueued(cancel chan struct{}) {
+	for {
+		queuedRun.Lock()
+		wait := time.Until(queuedRun.opensAt)
+		queuedRun.Unlock()
+		select {
+		case <-cancel:
+			return
+		case <-time.After(wait):
+		}
+
+		queuedRun.Lock()
+		select {
+		case <-cancel:
+			queuedRun.Unlock()
+			return
+		default:
+		}
+		queuedRun.opensAt = time.Time{}
+		setApplyPhase(applyExecuting)
+		plan := queuedRun.plan
+		if queuedRun.next == 0 {
+			fmt.Println(colorize(colorBold, fmt.Sprintf(tr("Apply window open, running the queued plan %s"), plan.checksum)))
+			snapshot, ok := currentTarget().snapshotBeforeApply()
+			if !ok {
+				finishQueued(map[string]interface{}{"status": "failed", "errors": []string{"Could not snapshot the target, plan not executed"}})
+				queuedRun.Unlock()
+				return
+			}
+			queuedRun.snapshot = snapshot
+		}
+		start := queuedRun.next
+		ops := plan.ops[start:]
+		ran := 0
+		executeWhile = func(i int) bool {
+			if !window.isOpen(time.Now()) {
+				return false
+			}
+			ran = i + 1
+			return true
+		}
+		errors, deferred, _, undo := currentTarget().executePlan(ops, findLockedOps(ops))
+		executeWhile = nil
+		queuedRun.next += ran
+		queuedRun.errors = append(queuedRun.errors, errors...)
+		queuedRun.deferred = append(queuedRun.deferred, deferred...)
+		queuedRun.undo.Operations = append(undo.Operations, queuedRun.undo.Operations...)
+		queuedRun.undo.Incomplete = append(queuedRun.undo.Incomplete, undo.Incomplete...)
+		rescanned := rescanAfterApply()
+		notifyLibraries(plan.ops[start:queuedRun.next])
+
+		if queuedRun.next < len(plan.ops) {
+			queuedRun.opensAt = window.opensAt(time.Now())
+			fmt.Printf(tr("Apply window closed after %d of %d operations, the rest runs at %s\n"), queuedRun.next, len(plan.ops), queuedRun.opensAt.Format("2006-01-02 15:04"))
+			setApplyPhase(applyQueued)
+			queuedRun.Unlock()
+			continue
+		}
+		if rescanned && writeManifestOn {
+			writeManifestAfter(plan.ops, queuedRun.errors)
+		}
+		result := map[string]interface{}{
+			"status":   "completed",
+			"checksum": plan.checksum,
+			"errors":   queuedRun.errors,
+			"deferred": queuedRun.deferred,
+		}
+		if queuedRun.snapshot != "" {
+			result["snapshot"] = queuedRun.snapshot
+		}
+		if len(plan.protected) > 0 {
+			result["protected"] = plan.protected
+		}
+		if len(plan.deletes) > 0 {
+			result["skippedDeletes"] = plan.deletes
+		}
+		if len(queuedRun.undo.Operations) > 0 {
+			result["undo"] = queuedRun.undo
+		}
+		finishQueued(result)
+		queuedRun.Unlock()
+		return
+	}
+}
+
+// finishQueued records the outcome of the queued plan, tells the UI and
+// releases the apply state; the caller holds the lock
+func finishQueued(result map[string]interface{}) {
+	queuedRun.plan = nil
+	queuedRun.last = result
+	setApplyPhase(applyIdle)
+	events.publish(Event{Type: "queued-done", Data: result})
+}
+
+// handleApplyQueued returns the plan waiting for the apply window (GET), or
+// cancels it before it runs (DELETE). A plan the window closed on halfway
+// can be cancelled too; what already ran stays done. While the plan runs it
+// can be neither looked at here nor cancelled, /status tells it is running.
+func handleApplyQueued(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !queuedRun.TryLock() {
+		http.Error(w, "The queued plan is executing", http.StatusConflict)
+		return
+	}
+	defer queuedRun.Unlock()
+	if queuedRun.plan == nil {
+		http.Error(w, "No plan is queued", http.StatusNotFound)
+		return
+	}
+	status := queuedStatus()
+	if r.Method == http.MethodDelete {
+		fmt.Printf(tr("Queued plan %s cancelled after %d of %d operations\n"), status.Checksum, status.Done, status.Total)
+		close(queuedRun.cancel)
+		result := map[string]interface{}{"status": "cancelled", "queued": status}
+		if len(queuedRun.undo.Operations) > 0 {
+			result["undo"] = queuedRun.undo
+		}
+		finishQueued(result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleStatus tells what the server is doing: the apply state, the apply
+// window, a plan queued for it or running in batches, and how the last
+// queued plan went
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result := map[string]interface{}{"phase": currentApplyPhase().String()}
+	if window != nil {
+		result["applyWindow"] = window.String()
+		result["windowOpen"] = window.isOpen(time.Now())
+	}
+	// The queued plan's lock is held while it executes; report it as
+	// executing rather than wait for it
+	if queuedRun.TryLock() {
+		if status := queuedStatus(); status != nil {
+			result["queued"] = status
+		}
+		if queuedRun.last != nil {
+			result["lastQueued"] = queuedRun.last
+		}
+		queuedRun.Unlock()
+	}
+	if batchRun.TryLock() {
+		if batchRun.plan != nil {
+			result["batch"] = batchStatus()
+		}
+		batchRun.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}